@@ -1,6 +1,9 @@
 package apis
 
 import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeadmv1alpha1 "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1alpha1"
 	kubeletconfigv1beta1 "k8s.io/kubernetes/pkg/kubelet/apis/kubeletconfig/v1beta1"
 	kubeproxyconfigv1alpha1 "k8s.io/kubernetes/pkg/proxy/apis/kubeproxyconfig/v1alpha1"
@@ -8,6 +11,7 @@ import (
 
 // InitConfiguration specifies the configuration used by the init command
 type InitConfiguration struct {
+	CacheConfiguration
 	Networking          Networking                                      `json:"networking"`
 	VIPConfiguration    VIPConfiguration                                `json:"vipConfiguration"`
 	MasterConfiguration kubeadmv1alpha1.MasterConfiguration             `json:"masterConfiguration"`
@@ -15,12 +19,126 @@ type InitConfiguration struct {
 	Kubelet             *kubeletconfigv1beta1.KubeletConfiguration      `json:"kubelet"`
 	NetworkBackend      map[string]string                               `json:"networkBackend"`
 	KeepAlived          map[string]string                               `json:"keepAlived"`
+	LocalRegistry       LocalRegistryConfiguration                      `json:"localRegistry"`
+	HostPreparation     HostPreparationConfiguration                    `json:"hostPreparation"`
 }
 
 // JoinConfiguration specifies the configuration used by the join command
 type JoinConfiguration struct {
-	Networking Networking                                 `json:"networking"`
-	Kubelet    *kubeletconfigv1beta1.KubeletConfiguration `json:"kubelet"`
+	CacheConfiguration
+	Networking      Networking                                 `json:"networking"`
+	Kubelet         *kubeletconfigv1beta1.KubeletConfiguration `json:"kubelet"`
+	HostPreparation HostPreparationConfiguration               `json:"hostPreparation"`
+}
+
+// CacheConfiguration specifies how nodeadm populates its cache
+type CacheConfiguration struct {
+	ImageConfiguration
+	// ContainerRuntime specifies the container runtime images are cached in.
+	ContainerRuntime ContainerRuntimeConfiguration `json:"containerRuntime"`
+	// SignatureVerification specifies how downloaded artifacts are verified.
+	SignatureVerification SignatureVerificationConfiguration `json:"signatureVerification"`
+	// Timeouts bound the operations of every command.
+	Timeouts TimeoutConfiguration `json:"timeouts"`
+}
+
+// TimeoutConfiguration bounds the operations of nodeadm, e.g. "90s" or "10m".
+// An operation that does not complete in time fails the command.
+type TimeoutConfiguration struct {
+	// Download bounds the download of each artifact. Defaults to 10m.
+	Download metav1.Duration `json:"download"`
+	// ImagePull bounds pulling each image. Defaults to 10m.
+	ImagePull metav1.Duration `json:"imagePull"`
+	// Kubeadm bounds each of kubeadm init, join and reset. Defaults to 10m.
+	Kubeadm metav1.Duration `json:"kubeadm"`
+	// Kubectl bounds each kubectl command. Defaults to 2m.
+	Kubectl metav1.Duration `json:"kubectl"`
+	// UnitActive bounds waiting for a systemd unit, e.g. the kubelet, to
+	// become active. Defaults to 2m.
+	UnitActive metav1.Duration `json:"unitActive"`
+	// RestartLoop bounds how long a unit may keep restarting while nodeadm
+	// waits for it, e.g. the kubelet until kubeadm has configured it, before
+	// it is considered to be in a restart loop. Defaults to 1m.
+	RestartLoop metav1.Duration `json:"restartLoop"`
+	// Ready bounds waiting for the node, the control plane and the addons to
+	// become ready at the end of init and join. Defaults to 5m.
+	Ready metav1.Duration `json:"ready"`
+}
+
+// ContainerRuntimeConfiguration specifies the container runtime used by the
+// kubelet and by nodeadm
+type ContainerRuntimeConfiguration struct {
+	// Name is one of "docker", "containerd" or "cri-o". Defaults to "docker".
+	Name string `json:"name"`
+	// Endpoint is the CRI socket of the runtime. Defaults to the default
+	// socket of containerd or CRI-O. Not used with docker.
+	Endpoint string `json:"endpoint"`
+	// CgroupDriver is the cgroup driver of the runtime, "cgroupfs" or
+	// "systemd". If it is not specified, it is read from docker, and defaults
+	// to "cgroupfs" for containerd and "systemd" for CRI-O.
+	CgroupDriver string `json:"cgroupDriver"`
+}
+
+// SignatureVerificationConfiguration specifies the keys that sign the
+// binaries and manifests nodeadm downloads. Each artifact must have a detached
+// signature, the base64 encoded ECDSA or RSA signature of its SHA-256 digest,
+// as produced by `cosign sign-blob`.
+type SignatureVerificationConfiguration struct {
+	// Keyring is the path to a file of PEM encoded public keys. A signature made
+	// by any of the keys is accepted.
+	Keyring string `json:"keyring"`
+	// SignatureURL is the base URL signatures are downloaded from, as
+	// <SignatureURL>/<path of the artifact in the cache>.sig. If it is not
+	// specified, signatures are downloaded from <artifact URL>.sig.
+	SignatureURL string `json:"signatureURL"`
+	// Insecure accepts unsigned and badly signed artifacts.
+	Insecure bool `json:"insecure"`
+}
+
+// ImageConfiguration specifies where the images nodeadm pulls, caches and
+// references in the cluster come from.
+type ImageConfiguration struct {
+	// ImageRepository replaces the registry of every image, e.g. with
+	// "mirror.example.com/k8s", "k8s.gcr.io/pause-amd64:3.1" becomes
+	// "mirror.example.com/k8s/pause-amd64:3.1" and
+	// "quay.io/coreos/flannel:v0.10.0-amd64" becomes
+	// "mirror.example.com/k8s/coreos/flannel:v0.10.0-amd64".
+	ImageRepository string `json:"imageRepository"`
+	// ImageOverrides maps an upstream image name, without tag, to the image used
+	// instead. The upstream tag is kept if the replacement has none. Overrides
+	// take precedence over ImageRepository, but do not apply to the control
+	// plane images pulled by kubeadm.
+	ImageOverrides map[string]string `json:"imageOverrides"`
+	// RegistryAuth specifies the credentials used to pull from private registries.
+	RegistryAuth RegistryAuthConfiguration `json:"registryAuth"`
+}
+
+// RegistryAuthConfiguration specifies the credentials used to pull images
+type RegistryAuthConfiguration struct {
+	// DockerConfigFile is the path to a docker config.json holding credentials
+	// for one or more registries.
+	DockerConfigFile string `json:"dockerConfigFile"`
+	// Credentials maps a registry host, e.g. "mirror.example.com:5000", to its
+	// credentials. They take precedence over those in DockerConfigFile.
+	Credentials map[string]RegistryCredentials `json:"credentials"`
+	// CreatePullSecret creates a kube-system imagePullSecret holding the
+	// credentials and adds it to the service accounts of the addons nodeadm
+	// deploys. Only used by init.
+	CreatePullSecret bool `json:"createPullSecret"`
+	// PullSecretName is the name of the imagePullSecret. Defaults to
+	// "nodeadm-registry-auth".
+	PullSecretName string `json:"pullSecretName"`
+}
+
+// RegistryCredentials authenticate against a single registry
+type RegistryCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// String hides the password when the configuration is printed
+func (c RegistryCredentials) String() string {
+	return fmt.Sprintf("{%s <redacted>}", c.Username)
 }
 
 // VIPConfiguration specifies the parameters used to provision a virtual IP
@@ -36,6 +154,30 @@ type VIPConfiguration struct {
 	NetworkInterface string `json:"networkInterface"`
 }
 
+// LocalRegistryConfiguration specifies the parameters of the pull-only image
+// registry that serves the nodeadm image cache from the master.
+type LocalRegistryConfiguration struct {
+	// Enabled runs the registry on the master and points the cluster's image
+	// repository at it.
+	Enabled bool `json:"enabled"`
+	// ListenAddress is the address the registry listens on. Defaults to ":5000".
+	ListenAddress string `json:"listenAddress"`
+	// Address is the host:port nodes pull images from. If it is not specified,
+	// the API advertise address and the listen port are used.
+	Address string `json:"address"`
+}
+
+// HostPreparationConfiguration specifies how init and join prepare the host
+// before installing the kubelet. The kernel modules and sysctls persist across
+// reboots.
+type HostPreparationConfiguration struct {
+	// ConntrackMax is net.netfilter.nf_conntrack_max. Defaults to 131072.
+	ConntrackMax int `json:"conntrackMax"`
+	// DisableSwap turns swap off, and comments out the swap entries of
+	// /etc/fstab so that it stays off. Reset turns it back on.
+	DisableSwap bool `json:"disableSwap"`
+}
+
 // Networking contains elements describing cluster's networking configuration
 type Networking struct {
 	// ServiceSubnet is the subnet used by k8s services. Defaults to "10.96.0.0/12".
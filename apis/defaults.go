@@ -2,18 +2,32 @@ package apis
 
 import (
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/platform9/nodeadm/constants"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeadmv1alpha1 "k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm/v1alpha1"
 )
 
 // SetInitDefaults sets defaults on the configuration used by init
 func SetInitDefaults(config *InitConfiguration) {
+	SetCacheDefaults(&config.CacheConfiguration)
+	SetHostPreparationDefaults(&config.HostPreparation)
 	// First set Networking defaults
 	SetNetworkingDefaults(&config.Networking)
 	// Second set MasterConfiguration.Networking defaults
 	SetMasterConfigurationNetworkingDefaultsWithNetworking(config)
-	// Third use the remainder of MasterConfiguration defaults
+	// Third set MasterConfiguration.ImageRepository from the top-level image configuration
+	if config.MasterConfiguration.ImageRepository == "" {
+		config.MasterConfiguration.ImageRepository = config.ImageRepository
+	}
+	// Fourth set MasterConfiguration.CRISocket from the container runtime, before kubeadm defaults it to dockershim
+	if config.MasterConfiguration.CRISocket == "" {
+		config.MasterConfiguration.CRISocket = CRISocket(config.ContainerRuntime)
+	}
+	// Fifth use the remainder of MasterConfiguration defaults
 	kubeadmv1alpha1.SetDefaults_MasterConfiguration(&config.MasterConfiguration)
 	config.MasterConfiguration.Kind = "MasterConfiguration"
 	config.MasterConfiguration.APIVersion = "kubeadm.k8s.io/v1alpha1"
@@ -31,14 +45,112 @@ func SetInitDynamicDefaults(config *InitConfiguration) error {
 		return fmt.Errorf("unable to dervice hostname override: %v", err)
 	}
 	config.MasterConfiguration.NodeName = nodeName
+	if config.LocalRegistry.Enabled {
+		if err := setLocalRegistryDynamicDefaults(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLocalRegistryDynamicDefaults derives the registry address and points
+// the control plane image repository at it
+func setLocalRegistryDynamicDefaults(config *InitConfiguration) error {
+	if config.LocalRegistry.ListenAddress == "" {
+		config.LocalRegistry.ListenAddress = fmt.Sprintf(":%d", constants.DefaultRegistryPort)
+	}
+	if config.LocalRegistry.Address == "" {
+		_, port, err := net.SplitHostPort(config.LocalRegistry.ListenAddress)
+		if err != nil {
+			return fmt.Errorf("unable to parse local registry listen address %q: %v", config.LocalRegistry.ListenAddress, err)
+		}
+		host := config.MasterConfiguration.API.AdvertiseAddress
+		if host == "" {
+			host = config.MasterConfiguration.NodeName
+		}
+		config.LocalRegistry.Address = net.JoinHostPort(host, port)
+	}
+	config.MasterConfiguration.ImageRepository = config.LocalRegistry.Address
 	return nil
 }
 
 // SetJoinDefaults sets defaults on the configuration used by join
 func SetJoinDefaults(config *JoinConfiguration) {
+	SetCacheDefaults(&config.CacheConfiguration)
+	SetHostPreparationDefaults(&config.HostPreparation)
 	SetNetworkingDefaults(&config.Networking)
 }
 
+// SetHostPreparationDefaults sets defaults for the preparation of the host
+func SetHostPreparationDefaults(config *HostPreparationConfiguration) {
+	if config.ConntrackMax == 0 {
+		config.ConntrackMax = constants.DefaultConntrackMax
+	}
+}
+
+// SetCacheDefaults sets defaults for the configuration shared by init and join
+func SetCacheDefaults(config *CacheConfiguration) {
+	SetImageDefaults(&config.ImageConfiguration)
+	SetContainerRuntimeDefaults(&config.ContainerRuntime)
+	SetTimeoutDefaults(&config.Timeouts)
+}
+
+// SetTimeoutDefaults sets the timeouts that are not specified
+func SetTimeoutDefaults(timeouts *TimeoutConfiguration) {
+	setDurationDefault(&timeouts.Download, constants.DefaultDownloadTimeout)
+	setDurationDefault(&timeouts.ImagePull, constants.DefaultImagePullTimeout)
+	setDurationDefault(&timeouts.Kubeadm, constants.DefaultKubeadmTimeout)
+	setDurationDefault(&timeouts.Kubectl, constants.DefaultKubectlTimeout)
+	setDurationDefault(&timeouts.UnitActive, constants.DefaultUnitActiveTimeout)
+	setDurationDefault(&timeouts.RestartLoop, constants.DefaultRestartLoopTimeout)
+	setDurationDefault(&timeouts.Ready, constants.DefaultReadyTimeout)
+}
+
+func setDurationDefault(d *metav1.Duration, value time.Duration) {
+	if d.Duration == 0 {
+		d.Duration = value
+	}
+}
+
+// SetImageDefaults sets defaults for the image configuration
+func SetImageDefaults(imageConfig *ImageConfiguration) {
+	if imageConfig.RegistryAuth.PullSecretName == "" {
+		imageConfig.RegistryAuth.PullSecretName = constants.DefaultPullSecretName
+	}
+}
+
+// SetContainerRuntimeDefaults sets defaults for the container runtime. The
+// cgroup driver of docker is left empty, because it is read from docker.
+func SetContainerRuntimeDefaults(runtimeConfig *ContainerRuntimeConfiguration) {
+	switch runtimeConfig.Name {
+	case "":
+		runtimeConfig.Name = constants.ContainerRuntimeDocker
+	case constants.ContainerRuntimeContainerd:
+		if runtimeConfig.Endpoint == "" {
+			runtimeConfig.Endpoint = constants.DefaultContainerdEndpoint
+		}
+		if runtimeConfig.CgroupDriver == "" {
+			runtimeConfig.CgroupDriver = constants.CgroupDriverCgroupfs
+		}
+	case constants.ContainerRuntimeCRIO:
+		if runtimeConfig.Endpoint == "" {
+			runtimeConfig.Endpoint = constants.DefaultCRIOEndpoint
+		}
+		if runtimeConfig.CgroupDriver == "" {
+			runtimeConfig.CgroupDriver = constants.CgroupDriverSystemd
+		}
+	}
+}
+
+// CRISocket returns the CRI socket kubeadm uses to reach the container
+// runtime, or an empty string for docker
+func CRISocket(runtimeConfig ContainerRuntimeConfiguration) string {
+	if runtimeConfig.Name == constants.ContainerRuntimeDocker {
+		return ""
+	}
+	return strings.TrimPrefix(runtimeConfig.Endpoint, "unix://")
+}
+
 // SetNetworkingDefaults sets defaults for the network configuration
 func SetNetworkingDefaults(netConfig *Networking) {
 	if netConfig.ServiceSubnet == "" {
@@ -2,8 +2,12 @@ package apis
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/platform9/nodeadm/constants"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // ValidateInit validates the configuration used by the init verb
@@ -31,5 +35,88 @@ func ValidateInit(config *InitConfiguration) []error {
 		errorList = append(errorList, fmt.Errorf("configuration conflict: Networking.DNSDomain=%q, MasterConfiguration.Networking.DNSDomain=%q. Values should be identical, or MasterConfiguration.Networking.DNSDomain omitted",
 			config.Networking.DNSDomain, config.MasterConfiguration.Networking.DNSDomain))
 	}
+	if !config.LocalRegistry.Enabled && config.ImageRepository != "" && config.MasterConfiguration.ImageRepository != config.ImageRepository {
+		errorList = append(errorList, fmt.Errorf("configuration conflict: ImageRepository=%q, MasterConfiguration.ImageRepository=%q. Values should be identical, or MasterConfiguration.ImageRepository omitted",
+			config.ImageRepository, config.MasterConfiguration.ImageRepository))
+	}
+	if config.LocalRegistry.Enabled && strings.Contains(config.ImageRepository, "/") {
+		// The registry serves the cached images under their upstream paths, which
+		// a repository path would no longer match
+		errorList = append(errorList, fmt.Errorf("invalid configuration: ImageRepository=%q has a path, which is not supported with LocalRegistry.Enabled=true",
+			config.ImageRepository))
+	}
+	if config.RegistryAuth.CreatePullSecret && len(config.RegistryAuth.DockerConfigFile) == 0 && len(config.RegistryAuth.Credentials) == 0 {
+		errorList = append(errorList, fmt.Errorf("invalid configuration: RegistryAuth.CreatePullSecret=true requires RegistryAuth.DockerConfigFile or RegistryAuth.Credentials"))
+	}
+	errorList = append(errorList, ValidateCache(&config.CacheConfiguration)...)
+	return errorList
+}
+
+// ValidateJoin validates the configuration used by the join verb
+func ValidateJoin(config *JoinConfiguration) []error {
+	return ValidateCache(&config.CacheConfiguration)
+}
+
+// ValidateCache validates the configuration shared by init and join
+func ValidateCache(config *CacheConfiguration) []error {
+	var errorList []error
+	switch config.ContainerRuntime.Name {
+	case constants.ContainerRuntimeDocker:
+		if config.ContainerRuntime.Endpoint != "" {
+			errorList = append(errorList, fmt.Errorf("invalid configuration: ContainerRuntime.Endpoint=%q is not supported with docker", config.ContainerRuntime.Endpoint))
+		}
+	case constants.ContainerRuntimeContainerd, constants.ContainerRuntimeCRIO:
+	default:
+		errorList = append(errorList, fmt.Errorf("invalid configuration: ContainerRuntime.Name=%q. Supported runtimes are %q, %q and %q",
+			config.ContainerRuntime.Name, constants.ContainerRuntimeDocker, constants.ContainerRuntimeContainerd, constants.ContainerRuntimeCRIO))
+	}
+	switch config.ContainerRuntime.CgroupDriver {
+	case "", constants.CgroupDriverCgroupfs, constants.CgroupDriverSystemd:
+	default:
+		errorList = append(errorList, fmt.Errorf("invalid configuration: ContainerRuntime.CgroupDriver=%q. Supported drivers are %q and %q",
+			config.ContainerRuntime.CgroupDriver, constants.CgroupDriverCgroupfs, constants.CgroupDriverSystemd))
+	}
+	for _, timeout := range []struct {
+		name string
+		d    metav1.Duration
+	}{
+		{"Download", config.Timeouts.Download},
+		{"ImagePull", config.Timeouts.ImagePull},
+		{"Kubeadm", config.Timeouts.Kubeadm},
+		{"Kubectl", config.Timeouts.Kubectl},
+		{"UnitActive", config.Timeouts.UnitActive},
+		{"RestartLoop", config.Timeouts.RestartLoop},
+		{"Ready", config.Timeouts.Ready},
+	} {
+		if timeout.d.Duration < 0 {
+			errorList = append(errorList, fmt.Errorf("invalid configuration: Timeouts.%s=%v must not be negative", timeout.name, timeout.d.Duration))
+		}
+	}
+	errorList = append(errorList, validateRegistryAuth(config.RegistryAuth)...)
+	return errorList
+}
+
+// validateRegistryAuth checks that the configured credentials are usable, so
+// they do not fail after kubeadm has run
+func validateRegistryAuth(config RegistryAuthConfiguration) []error {
+	var errorList []error
+	if len(config.DockerConfigFile) != 0 {
+		if _, err := os.Stat(config.DockerConfigFile); err != nil {
+			errorList = append(errorList, fmt.Errorf("invalid configuration: RegistryAuth.DockerConfigFile=%q: %v", config.DockerConfigFile, err))
+		}
+	}
+	for server, credentials := range config.Credentials {
+		if len(server) == 0 {
+			errorList = append(errorList, fmt.Errorf("invalid configuration: RegistryAuth.Credentials has an empty registry host"))
+		}
+		if len(credentials.Username) == 0 || len(credentials.Password) == 0 {
+			errorList = append(errorList, fmt.Errorf("invalid configuration: RegistryAuth.Credentials[%q] requires a username and password", server))
+		}
+	}
+	if len(config.PullSecretName) != 0 {
+		if msgs := validation.IsDNS1123Subdomain(config.PullSecretName); len(msgs) != 0 {
+			errorList = append(errorList, fmt.Errorf("invalid configuration: RegistryAuth.PullSecretName=%q: %s", config.PullSecretName, strings.Join(msgs, ", ")))
+		}
+	}
 	return errorList
 }
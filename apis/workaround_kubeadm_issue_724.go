@@ -6,6 +6,9 @@ import (
 
 // SetControllerManagerExtraArgs sets controller manager extra args for a given pod network subnet
 func setControllerManagerExtraArgs(config *InitConfiguration) {
+	if config.MasterConfiguration.ControllerManagerExtraArgs == nil {
+		config.MasterConfiguration.ControllerManagerExtraArgs = make(map[string]string)
+	}
 	if _, ok := config.MasterConfiguration.ControllerManagerExtraArgs[constants.ControllerManagerAllocateNodeCIDRsKey]; !ok {
 		config.MasterConfiguration.ControllerManagerExtraArgs[constants.ControllerManagerAllocateNodeCIDRsKey] = constants.ControllerManagerAllocateNodeCIDRs
 	}
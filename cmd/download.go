@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/utils"
 	"github.com/spf13/cobra"
 )
@@ -11,10 +14,56 @@ var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Download components",
 	Run: func(cmd *cobra.Command, args []string) {
-		utils.PopulateCache()
+		config := cacheConfigurationFromFlag(cmd)
+		setInsecureFromFlag(cmd, config)
+		ctx, stop := signalContext()
+		defer stop()
+		defer lockHost(ctx, cmd)()
+		if err := utils.PopulateCache(ctx, *config); err != nil {
+			log.Fatalf("Failed to populate cache: %v", err)
+		}
 	},
 }
 
+// cacheConfigurationFromFlag reads the cache configuration from the file given
+// by the cfg flag, if any
+func cacheConfigurationFromFlag(cmd *cobra.Command) *apis.CacheConfiguration {
+	configPath := cmd.Flag("cfg").Value.String()
+	config := &apis.CacheConfiguration{}
+	if len(configPath) != 0 {
+		var err error
+		config, err = utils.CacheConfigurationFromFile(configPath)
+		if err != nil {
+			log.Fatalf("Failed to read configuration from file %q: %v", configPath, err)
+		}
+	}
+	apis.SetCacheDefaults(config)
+	return config
+}
+
+// setInsecureFromFlag disables signature verification if requested on the
+// command line
+func setInsecureFromFlag(cmd *cobra.Command, config *apis.CacheConfiguration) {
+	if cmd.Flags().Lookup("insecure-skip-signature-verification") == nil {
+		return
+	}
+	insecure, err := cmd.Flags().GetBool("insecure-skip-signature-verification")
+	if err != nil {
+		log.Fatalf("Error parsing option value for insecure-skip-signature-verification")
+	}
+	if insecure {
+		config.SignatureVerification.Insecure = true
+	}
+}
+
+// addInsecureFlag adds the flag that disables signature verification
+func addInsecureFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("insecure-skip-signature-verification", false, "Accept unsigned and badly signed artifacts")
+}
+
 func init() {
 	rootCmd.AddCommand(downloadCmd)
+	downloadCmd.Flags().String("cfg", "", "Location of configuration file")
+	addInsecureFlag(downloadCmd)
+	addLockFlags(downloadCmd)
 }
@@ -0,0 +1,531 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/systemd"
+	"github.com/platform9/nodeadm/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// hashPattern matches the content hash of generated kubelet units, which
+// covers the hostname override
+var hashPattern = regexp.MustCompile(`sha256:[0-9a-f]{64}`)
+
+// fakeHost roots the host filesystem in a temporary directory holding a
+// populated cache, and records the commands run on the host
+type fakeHost struct {
+	root     string
+	executor *host.FakeExecutor
+	network  *host.FakeNetwork
+	restore  func()
+}
+
+func newFakeHost(t *testing.T) *fakeHost {
+	root, err := ioutil.TempDir("", "nodeadm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	executor := host.NewFakeExecutor()
+	// Every unit is active and every image is present
+	executor.Responses["systemctl show --property=ActiveState"] = host.FakeResponse{Stdout: "ActiveState=active\nSubState=running\nNRestarts=0\n"}
+	executor.Responses["ctr --address /run/containerd/containerd.sock --namespace k8s.io images list"] = host.FakeResponse{Stdout: "sha256:0123\n"}
+	executor.Responses["ctr --address /run/containerd/containerd.sock --namespace k8s.io images export"] = host.FakeResponse{
+		Effect: func(args []string) error {
+			return ioutil.WriteFile(args[6], []byte("fake images\n"), 0644)
+		},
+	}
+
+	// The nodes, the control plane and the addons are ready
+	hostnameOverride, err := constants.GetHostnameOverride()
+	if err != nil {
+		t.Fatal(err)
+	}
+	executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get node"] = host.FakeResponse{Stdout: readyNode}
+	executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/kubelet.conf get node"] = host.FakeResponse{Stdout: readyNode}
+	executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get pods"] = host.FakeResponse{Stdout: readyPods(t, "master", hostnameOverride)}
+	executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/kubelet.conf get pods"] = host.FakeResponse{Stdout: readyPods(t, "master", hostnameOverride)}
+
+	// kubeadm init creates the cluster CA, and kubeadm creates tokens
+	executor.Responses["/opt/bin/kubeadm init"] = host.FakeResponse{
+		Effect: func(args []string) error {
+			if err := os.MkdirAll(filepath.Dir(host.Path(constants.CACertFile)), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(host.Path(constants.CACertFile), []byte(caCert), 0644)
+		},
+	}
+	executor.Responses["/opt/bin/kubeadm token create"] = host.FakeResponse{Stdout: "abcdef.0123456789abcdef\n"}
+	executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get secrets"] = host.FakeResponse{Stdout: `{"items": [{"type": "bootstrap.kubernetes.io/token", "data": {
+		"token-id": "YWJjZGVm",
+		"token-secret": "MDEyMzQ1Njc4OWFiY2RlZg==",
+		"expiration": "MjA5OS0wMS0wMVQwMDowMDowMFo="
+	}}]}`}
+
+	previousRoot := host.SetRoot(root)
+	previousExecutor := host.SetExecutor(executor)
+	network := &host.FakeNetwork{}
+	previousNetwork := host.SetNetwork(network)
+	previousEuid := host.SetEuid(0)
+	systemd.SetManager(systemd.NewExecManager())
+	previousSettlePeriod := systemd.SettlePeriod
+	systemd.SettlePeriod = 0
+	h := &fakeHost{
+		root:     root,
+		executor: executor,
+		network:  network,
+		restore: func() {
+			host.SetRoot(previousRoot)
+			host.SetExecutor(previousExecutor)
+			host.SetNetwork(previousNetwork)
+			host.SetEuid(previousEuid)
+			systemd.SettlePeriod = previousSettlePeriod
+			os.RemoveAll(root)
+		},
+	}
+	if err := os.MkdirAll(host.Path("/tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Swap is off and no port is in use
+	h.writeFile(t, "/proc/swaps", "Filename\tType\tSize\tUsed\tPriority\n")
+	h.writeFile(t, "/proc/net/tcp", "  sl  local_address rem_address   st\n")
+	h.writeFile(t, constants.FstabFile, "/dev/sda1 / ext4 defaults 0 1\n/swapfile none swap sw 0 0\n")
+	for _, artifact := range utils.NodeArtifact {
+		content := "fake " + artifact.Name + "\n"
+		switch artifact.Name {
+		case constants.FlannelManifestFilename:
+			content = fmt.Sprintf("network: %s\nimage: %s\n", constants.DefaultPodNetwork, constants.FlannelImage)
+		case constants.CNIPluginsFilename:
+			content = tarGz(t, map[string]string{"./flannel": "fake flannel\n", "./loopback": "fake loopback\n"})
+		}
+		h.writeFile(t, filepath.Join(artifact.Local, artifact.Name), content)
+	}
+	return h
+}
+
+// caCert is a self-signed CA certificate, as created by kubeadm init
+const caCert = `-----BEGIN CERTIFICATE-----
+MIIBSjCB8aADAgECAgEBMAoGCCqGSM49BAMCMBUxEzARBgNVBAMTCmt1YmVybmV0
+ZXMwHhcNMjYxMDE5MTczNzIxWhcNMjYxMDE5MTgzNzIxWjAVMRMwEQYDVQQDEwpr
+dWJlcm5ldGVzMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEAPNoduRxvQBmaWk0
+P9VrYq7A/vQlMAmOz4PNRn4TMkDyVdyHtp1dWsiiCcVKXownnXCWSIwJz1R5ibOq
+9C2qFaMyMDAwDwYDVR0TAQH/BAUwAwEB/zAdBgNVHQ4EFgQU1wNXCBLE7VosMLf6
+NrFU07sfy7cwCgYIKoZIzj0EAwIDSAAwRQIhAKFwJC4UNB9q6lj1Yy/FNtipdZps
+t9XgCZL/xS3oRcLRAiBFy+dDzJJBHsX7kyR/5oUYXYYZQFJEZfbIV/0X4veIUA==
+-----END CERTIFICATE-----
+`
+
+const readyNode = `{"status": {"conditions": [{"type": "Ready", "status": "True"}]}}`
+
+// readyPods returns the kube-system pods of a cluster whose first node is the
+// master, with every pod ready
+func readyPods(t *testing.T, nodes ...string) string {
+	ready := corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}}
+	pod := func(name, node string, labels map[string]string, owner string) corev1.Pod {
+		p := corev1.Pod{Spec: corev1.PodSpec{NodeName: node}, Status: ready}
+		p.Name, p.Labels = name, labels
+		if owner != "" {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: owner}}
+		}
+		return p
+	}
+	var pods corev1.PodList
+	for _, component := range []string{"kube-apiserver", "kube-controller-manager", "kube-scheduler", "etcd"} {
+		pods.Items = append(pods.Items, pod(component+"-"+nodes[0], nodes[0], nil, ""))
+	}
+	pods.Items = append(pods.Items, pod("kube-dns", nodes[0], map[string]string{"k8s-app": "kube-dns"}, ""))
+	for _, node := range nodes {
+		pods.Items = append(pods.Items, pod("kube-proxy-"+node, node, nil, constants.KubeProxyDaemonSet))
+		pods.Items = append(pods.Items, pod("kube-flannel-ds-"+node, node, nil, constants.FlannelDaemonSet))
+	}
+	data, err := json.Marshal(pods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (h *fakeHost) writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(host.Path(filepath.Dir(path)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(host.Path(path), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// state renders the commands run so far and the files outside the cache and
+// /proc
+func (h *fakeHost) state(t *testing.T) string {
+	var b bytes.Buffer
+	b.WriteString("# commands\n")
+	for _, command := range h.executor.Commands {
+		b.WriteString(command + "\n")
+	}
+	b.WriteString("# deleted links\n")
+	for _, link := range h.network.DeletedLinks {
+		b.WriteString(link + "\n")
+	}
+	b.WriteString("# files\n")
+	var paths []string
+	err := filepath.Walk(h.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(path, h.root+"/")
+		if info.IsDir() && (strings.HasPrefix(rel, filepath.Clean(constants.CacheDir)) || rel == "/proc") {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if target, err := os.Readlink(host.Path(path)); err == nil {
+			fmt.Fprintf(&b, "== %s -> %s\n", path, target)
+			continue
+		}
+		content, err := ioutil.ReadFile(host.Path(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "== %s\n%s", path, content)
+	}
+	return h.normalize(t, b.String())
+}
+
+// normalize removes what depends on the machine running the test
+func (h *fakeHost) normalize(t *testing.T, s string) string {
+	s = strings.Replace(s, h.root, "", -1)
+	hostnameOverride, err := constants.GetHostnameOverride()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = strings.Replace(s, "--hostname-override="+hostnameOverride, "--hostname-override=HOSTNAME", -1)
+	s = strings.Replace(s, "get node "+hostnameOverride+" ", "get node HOSTNAME ", -1)
+	return hashPattern.ReplaceAllString(s, "sha256:HASH")
+}
+
+// tarGz returns a gzipped tarball of files
+func tarGz(t *testing.T, files map[string]string) string {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func assertGolden(t *testing.T, name, actual string) {
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != actual {
+		t.Errorf("%s differs from %s, run the test with -update to see the difference in git diff:\n%s", name, golden, actual)
+	}
+}
+
+func initConfiguration(t *testing.T) *apis.InitConfiguration {
+	config, err := utils.InitConfigurationFromFile(filepath.Join("testdata", "init.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apis.SetInitDefaults(config)
+	if errors := apis.ValidateInit(config); len(errors) > 0 {
+		t.Fatalf("invalid configuration: %v", errors)
+	}
+	return config
+}
+
+func joinConfiguration(t *testing.T) *apis.JoinConfiguration {
+	config, err := utils.JoinConfigurationFromFile(filepath.Join("testdata", "join.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apis.SetJoinDefaults(config)
+	if errors := apis.ValidateJoin(config); len(errors) > 0 {
+		t.Fatalf("invalid configuration: %v", errors)
+	}
+	return config
+}
+
+func TestInit(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	assertGolden(t, "init", h.state(t))
+}
+
+func TestInitAgain(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	h.executor.Commands = nil
+	// Without the state file, every phase runs again
+	if err := removeState(); err != nil {
+		t.Fatal(err)
+	}
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	state := h.state(t)
+	// The kubelet units did not change, so the kubelet keeps running
+	if strings.Contains(state, "systemctl stop kubelet.service") {
+		t.Errorf("kubelet was stopped although its units did not change")
+	}
+	assertGolden(t, "init-again", state)
+}
+
+func TestInitResume(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{skip: []string{"network", "addons"}})
+	h.executor.Commands = nil
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	assertGolden(t, "init-resume", h.state(t))
+}
+
+func TestJoin(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	joinNode(context.Background(), joinConfiguration(t), "abcdef.0123456789abcdef", "192.168.10.10:6443", "sha256:0123", phaseOptions{})
+	assertGolden(t, "join", h.state(t))
+}
+
+func TestJoinRollback(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.executor.Responses["/opt/bin/kubeadm join"] = host.FakeResponse{Err: errors.New("unable to reach master")}
+	s, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &transaction{}
+	phases := tx.wrap(joinPhases(joinConfiguration(t), "abcdef.0123456789abcdef", "192.168.10.10:6443", "sha256:0123", nil, true))
+	if err := executeSteps(context.Background(), "join", recordPhases(s, "join", phases)); err == nil {
+		t.Fatal("expected kubeadm join to fail")
+	}
+	if err := tx.rollback(context.Background(), "join", s); err != nil {
+		t.Fatal(err)
+	}
+	state := h.state(t)
+	if strings.Contains(state, "/opt/bin/kubelet") || strings.Contains(state, constants.StateFile) {
+		t.Errorf("join was not rolled back")
+	}
+	assertGolden(t, "join-rollback", state)
+}
+
+func TestInitRollback(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.executor.Responses["/opt/bin/kubeadm token create"] = host.FakeResponse{Err: errors.New("unable to reach the API server")}
+	s, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &transaction{}
+	phases := tx.wrap(initPhases(initConfiguration(t), nil, true))
+	if err := executeSteps(context.Background(), "init", recordPhases(s, "init", phases)); err == nil {
+		t.Fatal("expected the join-info phase to fail")
+	}
+	if err := tx.rollback(context.Background(), "init", s); err != nil {
+		t.Fatal(err)
+	}
+	// The phases without an undo action ran on the cluster kubeadm reset
+	// removed, so they must not be skipped on the next run
+	if len(s.Completed) != 0 {
+		t.Errorf("phases %v are still completed after the rollback", s.Completed)
+	}
+	assertGolden(t, "init-rollback", h.state(t))
+}
+
+func TestJoinChecksBridgeNetfilter(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	for _, prepareHost := range []bool{true, false} {
+		phase, err := findPhase(joinPhases(joinConfiguration(t), "abcdef.0123456789abcdef", "192.168.10.10:6443", "sha256:0123", nil, prepareHost), "preflight")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = phase[0].run(context.Background())
+		if prepareHost && err != nil {
+			t.Errorf("br_netfilter is loaded by the host phase, got %v", err)
+		}
+		if !prepareHost && (err == nil || !strings.Contains(err.Error(), "br_netfilter")) {
+			t.Errorf("expected br_netfilter not to be loaded without the host phase, got %v", err)
+		}
+	}
+}
+
+func TestInitChecksPortsWhileKubeletRuns(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	// The kubelet is active, and it and the API server listen
+	h.writeFile(t, "/proc/net/tcp", `  sl  local_address rem_address   st
+   0: 00000000:280A 00000000:0000 0A
+   1: 00000000:192B 00000000:0000 0A
+`)
+	checks, err := initChecks(context.Background(), initConfiguration(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range checks {
+		err := check.Run(context.Background())
+		switch check.Name {
+		case "Port-10250":
+			if err != nil {
+				t.Errorf("expected the kubelet port not to be checked, got %v", err)
+			}
+		case "Port-6443":
+			if err == nil {
+				t.Errorf("expected the API server port to be checked")
+			}
+		}
+	}
+}
+
+func TestJoinStoppedByKubelet(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	defer func(interval time.Duration) { kubeletPollInterval = interval }(kubeletPollInterval)
+	kubeletPollInterval = time.Millisecond
+	// kubeadm configures the kubelet, then waits for it forever
+	h.executor.Responses["/opt/bin/kubeadm join"] = host.FakeResponse{
+		Effect: func(args []string) error {
+			return ioutil.WriteFile(host.Path(constants.KubeletBootstrapKubeconfigFile), []byte("bootstrap\n"), 0600)
+		},
+		Hangs: true,
+	}
+	h.executor.Responses["systemctl show --property=ActiveState --property=SubState --property=NRestarts kubelet.service"] = host.FakeResponse{Stdout: "ActiveState=failed\nSubState=failed\nNRestarts=0\n"}
+	h.executor.Responses["journalctl --unit=kubelet.service"] = host.FakeResponse{Stdout: "kubelet[42]: failed to parse kubelet flag: unknown flag: --cadvisor-port\n"}
+	if err := os.MkdirAll(host.Path(filepath.Dir(constants.KubeletBootstrapKubeconfigFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	phase, err := findPhase(joinPhases(joinConfiguration(t), "abcdef.0123456789abcdef", "192.168.10.10:6443", "sha256:0123", nil, true), "kubeadm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- phase[0].run(context.Background())
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("kubeadm was not stopped")
+	}
+	if err == nil || !strings.Contains(err.Error(), "unit kubelet.service failed") || !strings.Contains(err.Error(), "unknown flag: --cadvisor-port") {
+		t.Errorf("expected the kubelet failure and its journal, got %v", err)
+	}
+}
+
+// dryRun runs a flow while planning, and returns the plan followed by the
+// host state
+func dryRun(t *testing.T, h *fakeHost, run func()) string {
+	plan := &host.Plan{}
+	previous := host.SetPlan(plan)
+	run()
+	host.SetPlan(previous)
+	var out bytes.Buffer
+	plan.Print(&out)
+	return "# plan\n" + h.normalize(t, out.String()) + h.state(t)
+}
+
+func TestInitDryRun(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	state := dryRun(t, h, func() {
+		initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	})
+	if strings.Contains(state, constants.StateFile+"\n{") {
+		t.Errorf("dry run wrote the state file")
+	}
+	assertGolden(t, "init-dry-run", state)
+}
+
+func TestResetDryRun(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	h.executor.Commands = nil
+	config := initConfiguration(t)
+	assertGolden(t, "reset-dry-run", dryRun(t, h, func() {
+		resetNode(context.Background(), config, nil)
+	}))
+}
+
+func TestReset(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	h.executor.Commands = nil
+	config := initConfiguration(t)
+	resetNode(context.Background(), config, nil)
+	assertGolden(t, "reset", h.state(t))
+}
+
+func TestResetRemovesLocalRegistryImages(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	config := initConfiguration(t)
+	config.LocalRegistry = apis.LocalRegistryConfiguration{Enabled: true, Address: "192.168.10.10:5000"}
+	if err := cleanupImages(context.Background(), &config.CacheConfiguration, utils.ClusterImageConfiguration(config)); err != nil {
+		t.Fatal(err)
+	}
+	remove := "ctr --address /run/containerd/containerd.sock --namespace k8s.io images remove 192.168.10.10:5000/coreos/flannel:" + constants.FlannelVersion + "-amd64"
+	for _, command := range h.executor.Commands {
+		if command == remove {
+			return
+		}
+	}
+	t.Errorf("reset did not run %q, ran:\n%s", remove, strings.Join(h.executor.Commands, "\n"))
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/utils"
+)
+
+// joinInfoMode keeps the token in the join information from other users
+const joinInfoMode = 0600
+
+// joinInfo is what a node needs to join the cluster, as written to
+// constants.JoinInfoFile
+type joinInfo struct {
+	// Endpoint is the host:port of the API server
+	Endpoint string `json:"endpoint"`
+	// Token is a bootstrap token
+	Token string `json:"token"`
+	// CACertHash is the hash of the public key of the cluster CA, as given to
+	// nodeadm join --cahash
+	CACertHash string `json:"caCertHash"`
+	// TTL is how long the token is valid after it was created
+	TTL string `json:"ttl"`
+}
+
+// joinCommand returns the nodeadm join command that joins a node
+func (j *joinInfo) joinCommand() string {
+	return fmt.Sprintf("nodeadm join --master %s --token %s --cahash %s", j.Endpoint, j.Token, j.CACertHash)
+}
+
+// createJoinInfo writes the join information to constants.JoinInfoFile and
+// prints the nodeadm join command to out. The token of the join information
+// of an earlier run is kept while it is valid and the endpoint and cluster CA
+// are unchanged; otherwise a bootstrap token is created, and the earlier one
+// deleted.
+func createJoinInfo(ctx context.Context, config *apis.InitConfiguration, out io.Writer) error {
+	ttl := config.MasterConfiguration.TokenTTL.Duration
+	if host.Planning() {
+		host.Record(host.CommandAction, "create a bootstrap token valid for %v, unless the token of %s is valid", ttl, constants.JoinInfoFile)
+		host.Record(host.FileAction, "write join information to %s", constants.JoinInfoFile)
+		return nil
+	}
+	endpoint, err := apiEndpoint(config)
+	if err != nil {
+		return err
+	}
+	info, err := newJoinInfo(endpoint, "", ttl)
+	if err != nil {
+		return err
+	}
+	previous, err := readJoinInfo()
+	if err != nil {
+		return err
+	}
+	var stale string
+	if previous != nil {
+		token, err := validToken(ctx, config.Timeouts.Kubectl.Duration, previous.Token)
+		if err != nil {
+			return err
+		}
+		switch {
+		case token != nil && previous.Endpoint == info.Endpoint && previous.CACertHash == info.CACertHash:
+			log.Infof("[nodeadm] Keeping the valid token of %s", constants.JoinInfoFile)
+			validity := "at any time"
+			if token.Expires != "" {
+				validity = "until " + token.Expires
+			}
+			printJoinInfo(out, previous, validity)
+			return nil
+		case token != nil:
+			stale = previous.Token
+		}
+	}
+	timeout := config.Timeouts.Kubeadm.Duration
+	info.Token, err = createToken(ctx, timeout, ttl, nil, "Created by nodeadm init")
+	if err != nil {
+		return err
+	}
+	if err := writeJoinInfo(info); err != nil {
+		if deleteErr := deleteToken(ctx, timeout, info.Token); deleteErr != nil {
+			log.Errorf("[nodeadm] Failed to delete the token of the join information that was not written: %v", deleteErr)
+		}
+		return err
+	}
+	if stale != "" {
+		log.Infof("[nodeadm] Deleting the token of the earlier join information")
+		if err := deleteToken(ctx, timeout, stale); err != nil {
+			return err
+		}
+	}
+	validity := "at any time"
+	if ttl > 0 {
+		validity = fmt.Sprintf("within %v", ttl)
+	}
+	printJoinInfo(out, info, validity)
+	return nil
+}
+
+// printJoinInfo prints the nodeadm join command of info to out, and how long
+// it can be run
+func printJoinInfo(out io.Writer, info *joinInfo, validity string) {
+	fmt.Fprintf(out, "Join nodes to the cluster %s with:\n\n  %s\n\nThe join information is in %s\n", validity, info.joinCommand(), constants.JoinInfoFile)
+}
+
+// readJoinInfo returns the join information of constants.JoinInfoFile, or nil
+// if there is none
+func readJoinInfo() (*joinInfo, error) {
+	data, err := ioutil.ReadFile(host.Path(constants.JoinInfoFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read join information: %v", err)
+	}
+	var info joinInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("unable to decode join information: %v", err)
+	}
+	return &info, nil
+}
+
+// writeJoinInfo writes info to constants.JoinInfoFile
+func writeJoinInfo(info *joinInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal join information: %v", err)
+	}
+	return utils.WriteFile(host.Path(constants.JoinInfoFile), append(data, '\n'), joinInfoMode)
+}
+
+// validToken returns the bootstrap token of the cluster, or nil if the
+// cluster does not have it or it expired
+func validToken(ctx context.Context, timeout time.Duration, token string) (*bootstrapToken, error) {
+	tokens, err := listTokens(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.Token != token {
+			continue
+		}
+		if t.Expires == "" {
+			return &t, nil
+		}
+		expires, err := time.Parse(time.RFC3339, t.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse expiration of bootstrap token %s: %v", tokenID(token), err)
+		}
+		if time.Now().Before(expires) {
+			return &t, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// newJoinInfo returns the join information of a token valid for ttl, with
+// the hash of the cluster CA of the host
+func newJoinInfo(endpoint, token string, ttl time.Duration) (*joinInfo, error) {
+	hash, err := caCertHash(host.Path(constants.CACertFile))
+	if err != nil {
+		return nil, err
+	}
+	return &joinInfo{Endpoint: endpoint, Token: token, CACertHash: hash, TTL: ttl.String()}, nil
+}
+
+// caCertHash returns the hash of the public key of the CA certificate in
+// file, in the format of kubeadm join --discovery-token-ca-cert-hash
+func caCertHash(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read CA certificate: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("unable to decode CA certificate %q", file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse CA certificate: %v", err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// apiEndpoint returns the host:port nodes reach the API server at: the
+// control plane endpoint, the virtual IP or the advertise address. Without
+// an advertise address, it is the address of the default route interface,
+// which kubeadm advertises.
+func apiEndpoint(config *apis.InitConfiguration) (string, error) {
+	address := config.MasterConfiguration.API.AdvertiseAddress
+	switch {
+	case config.MasterConfiguration.API.ControlPlaneEndpoint != "":
+		address = config.MasterConfiguration.API.ControlPlaneEndpoint
+	case config.VIPConfiguration.IP != "":
+		address = config.VIPConfiguration.IP
+	case address == "":
+		var err error
+		if address, err = constants.GetHostnameOverride(); err != nil {
+			return "", fmt.Errorf("unable to derive the API server address: %v", err)
+		}
+	}
+	return net.JoinHostPort(address, strconv.Itoa(int(config.MasterConfiguration.API.BindPort))), nil
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestCACertHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodeadm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(file, []byte(caCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := caCertHash(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | sha256sum
+	if expected := "sha256:6f2b49245bf901d452a232cb67967c62513e487a06f05b366049704a18f48ec5"; hash != expected {
+		t.Errorf("got %s, expected %s", hash, expected)
+	}
+}
+
+func TestAPIEndpoint(t *testing.T) {
+	defaultAddress, err := constants.GetHostnameOverride()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &apis.InitConfiguration{}
+	config.MasterConfiguration.API.BindPort = 6443
+	for _, tt := range []struct {
+		set      func()
+		expected string
+	}{
+		{func() {}, net.JoinHostPort(defaultAddress, "6443")},
+		{func() { config.MasterConfiguration.API.AdvertiseAddress = "10.0.0.1" }, "10.0.0.1:6443"},
+		{func() { config.VIPConfiguration.IP = "10.0.0.100" }, "10.0.0.100:6443"},
+		{func() { config.MasterConfiguration.API.ControlPlaneEndpoint = "api.example.com" }, "api.example.com:6443"},
+	} {
+		tt.set()
+		endpoint, err := apiEndpoint(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint != tt.expected {
+			t.Errorf("got %s, expected %s", endpoint, tt.expected)
+		}
+	}
+}
+
+func TestCreateJoinInfo(t *testing.T) {
+	const hash = "sha256:6f2b49245bf901d452a232cb67967c62513e487a06f05b366049704a18f48ec5"
+	const (
+		list   = "/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get secrets --namespace=kube-system --field-selector=type=bootstrap.kubernetes.io/token --output=json"
+		create = "/opt/bin/kubeadm token create --kubeconfig /etc/kubernetes/admin.conf --ttl 24h0m0s --description Created by nodeadm init"
+		delete = "/opt/bin/kubeadm token delete --kubeconfig /etc/kubernetes/admin.conf abcdef.0123456789abcdef"
+	)
+	tests := []struct {
+		name     string
+		previous string
+		token    string
+		output   string
+		commands []string
+	}{
+		{"first run", "", "uvwxyz.0123456789abcdef", "within 24h0m0s", []string{create}},
+		{"valid token", `{"endpoint": "192.168.10.5:6443", "token": "abcdef.0123456789abcdef", "caCertHash": "` + hash + `"}`, "abcdef.0123456789abcdef", "until 2099-01-01T00:00:00Z", []string{list}},
+		{"expired token", `{"endpoint": "192.168.10.5:6443", "token": "expird.0123456789abcdef", "caCertHash": "` + hash + `"}`, "uvwxyz.0123456789abcdef", "within 24h0m0s", []string{list, create}},
+		{"endpoint changed", `{"endpoint": "10.0.0.1:6443", "token": "abcdef.0123456789abcdef", "caCertHash": "` + hash + `"}`, "uvwxyz.0123456789abcdef", "within 24h0m0s", []string{list, create, delete}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			defer h.restore()
+			h.executor.Responses["/opt/bin/kubeadm token create"] = host.FakeResponse{Stdout: "uvwxyz.0123456789abcdef\n"}
+			h.writeFile(t, constants.CACertFile, caCert)
+			if tt.previous != "" {
+				h.writeFile(t, constants.JoinInfoFile, tt.previous)
+			}
+			var out bytes.Buffer
+			if err := createJoinInfo(context.Background(), initConfiguration(t), &out); err != nil {
+				t.Fatal(err)
+			}
+			info, err := readJoinInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Token != tt.token {
+				t.Errorf("join information has token %s, expected %s", info.Token, tt.token)
+			}
+			if !strings.Contains(out.String(), tt.output) || !strings.Contains(out.String(), "--token "+tt.token) {
+				t.Errorf("printed %q, expected the join command of %s %s", out.String(), tt.token, tt.output)
+			}
+			if !reflect.DeepEqual(h.executor.Commands, tt.commands) {
+				t.Errorf("ran %q, expected %q", h.executor.Commands, tt.commands)
+			}
+		})
+	}
+}
+
+func TestDeletesJoinToken(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.writeFile(t, constants.CACertFile, caCert)
+	config := initConfiguration(t)
+	undo, err := deletesJoinToken(config.Timeouts.Kubeadm.Duration)(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createJoinInfo(context.Background(), config, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	h.executor.Commands = nil
+	if err := undo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(host.Path(constants.JoinInfoFile)); !os.IsNotExist(err) {
+		t.Errorf("join information must be removed, got %v", err)
+	}
+	expected := []string{"/opt/bin/kubeadm token delete --kubeconfig /etc/kubernetes/admin.conf abcdef.0123456789abcdef"}
+	if !reflect.DeepEqual(h.executor.Commands, expected) {
+		t.Errorf("ran %q, expected %q", h.executor.Commands, expected)
+	}
+}
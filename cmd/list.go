@@ -13,7 +13,7 @@ var listCmd = &cobra.Command{
 	Short: "List components to download",
 	Run: func(cmd *cobra.Command, args []string) {
 		if images {
-			images := utils.GetImages()
+			images := utils.GetResolvedImages(cacheConfigurationFromFlag(cmd).ImageConfiguration)
 			for _, image := range images {
 				fmt.Println(image)
 			}
@@ -24,4 +24,5 @@ var listCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(listCmd)
 	listCmd.Flags().BoolVar(&images, "images", false, "set to show list of images")
+	listCmd.Flags().String("cfg", "", "Location of configuration file")
 }
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"context"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/spf13/cobra"
+)
+
+// addLockFlags adds the flags that control waiting for another nodeadm run
+// to release the host lock
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("wait", false, "Wait for another running nodeadm command to finish instead of failing")
+	cmd.Flags().Duration("wait-timeout", constants.DefaultLockWaitTimeout, "How long --wait waits for another nodeadm command")
+}
+
+// lockHost takes the host lock for a command that changes the host, so that
+// concurrent runs do not trample each other's files and units. It exits if
+// another run holds the lock. The returned function releases the lock.
+func lockHost(ctx context.Context, cmd *cobra.Command) func() {
+	// Only the command path is recorded, since flags may hold secrets
+	command := cmd.CommandPath()
+	lock, err := host.Lock(ctx, constants.LockFile, command, 0)
+	if lockErr, ok := err.(*host.LockError); ok {
+		wait, _ := cmd.Flags().GetBool("wait")
+		if !wait {
+			log.Fatalf("Another nodeadm command is running: %v. Retry when it finishes, or pass --wait", lockErr)
+		}
+		timeout, _ := cmd.Flags().GetDuration("wait-timeout")
+		log.Infof("[nodeadm] Waiting up to %v for another nodeadm command to finish: %v", timeout, lockErr)
+		lock, err = host.Lock(ctx, constants.LockFile, command, timeout)
+	}
+	if err != nil {
+		log.Fatalf("Failed to take the nodeadm lock: %v", err)
+	}
+	return func() {
+		if err := lock.Unlock(); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+}
@@ -1,12 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
 
@@ -14,6 +14,8 @@ import (
 
 	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/preflight"
 	"github.com/platform9/nodeadm/utils"
 	"github.com/spf13/cobra"
 )
@@ -23,50 +25,139 @@ var nodeCmdInit = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize the master node with given configuration",
 	Run: func(cmd *cobra.Command, args []string) {
-		var err error
-		config := &apis.InitConfiguration{}
-		configPath := cmd.Flag("cfg").Value.String()
-		if len(configPath) != 0 {
-			config, err = utils.InitConfigurationFromFile(configPath)
-			if err != nil {
-				log.Fatalf("Failed to read configuration from file %q: %v", configPath, err)
-			}
-		}
-		apis.SetInitDefaults(config)
-		if err := apis.SetInitDynamicDefaults(config); err != nil {
-			log.Fatalf("Failed to set dynamic defaults: %v", err)
-		}
-		if errors := apis.ValidateInit(config); len(errors) > 0 {
-			log.Error("Failed to validate configuration:")
-			for i, err := range errors {
-				log.Errorf("%v: %v", i, err)
-			}
-			os.Exit(1)
-		}
+		config := loadInitConfiguration(cmd)
+		opts := phaseOptionsFromFlags(cmd)
+		changeHost(cmd, func(ctx context.Context) {
+			initNode(ctx, config, opts)
+		})
+	},
+}
 
-		masterConfig, err := yaml.Marshal(config.MasterConfiguration)
+// loadInitConfiguration reads, defaults and validates the configuration
+// given with --cfg, and exits if it is invalid
+func loadInitConfiguration(cmd *cobra.Command) *apis.InitConfiguration {
+	var err error
+	config := &apis.InitConfiguration{}
+	configPath := cmd.Flag("cfg").Value.String()
+	if len(configPath) != 0 {
+		config, err = utils.InitConfigurationFromFile(configPath)
 		if err != nil {
-			log.Fatalf("\nFailed to marshal master config with err %v", err)
+			log.Fatalf("Failed to read configuration from file %q: %v", configPath, err)
 		}
-		err = ioutil.WriteFile(constants.KubeadmConfig, masterConfig, constants.Read)
-		if err != nil {
-			log.Fatalf("\nFailed to write file %q with error %v", constants.KubeadmConfig, err)
+	}
+	setInsecureFromFlag(cmd, &config.CacheConfiguration)
+	apis.SetInitDefaults(config)
+	if err := apis.SetInitDynamicDefaults(config); err != nil {
+		log.Fatalf("Failed to set dynamic defaults: %v", err)
+	}
+	if errors := apis.ValidateInit(config); len(errors) > 0 {
+		log.Error("Failed to validate configuration:")
+		for i, err := range errors {
+			log.Errorf("%v: %v", i, err)
 		}
+		os.Exit(1)
+	}
+	return config
+}
 
-		utils.InstallMasterComponents(config)
+// initNode initializes the master with a validated configuration
+func initNode(ctx context.Context, config *apis.InitConfiguration, opts phaseOptions) {
+	phases, err := skipPhases(initPhases(config, opts.skipChecks, opts.runs("host")), opts.skip)
+	if err != nil {
+		log.Fatalf("Failed to select phases: %v", err)
+	}
+	runPhases(ctx, "init", phases, true, opts.rollback)
+}
 
-		kubeadmInit(constants.KubeadmConfig)
+// initPhases returns the phases of init, named as in initPhaseNames. The
+// inputs of a phase are the parts of the configuration it applies. The
+// changes of the workarounds and network phases are in the cluster, so they
+// are undone by kubeadm reset. The preflight checks in skipChecks are not run,
+// and those of the host phase are left to it if prepareHost is set.
+func initPhases(config *apis.InitConfiguration, skipChecks []string, prepareHost bool) []phase {
+	timeouts := config.Timeouts
+	images := utils.ClusterImageConfiguration(config)
+	return []phase{
+		{"preflight", nil, func(ctx context.Context) error {
+			return runChecks(ctx, func(ctx context.Context) ([]preflight.Check, error) {
+				return initChecks(ctx, config, prepareHost)
+			}, skipChecks)
+		}, nil},
+		{"host", config.HostPreparation, func(ctx context.Context) error {
+			return utils.PrepareHost(ctx, config.HostPreparation)
+		}, restores(hostPaths)},
+		{"download", []interface{}{images, config.ContainerRuntime, config.LocalRegistry.Enabled}, func(ctx context.Context) error {
+			return download(ctx, config.CacheConfiguration, images, config.LocalRegistry.Enabled)
+		}, removesImages(config.CacheConfiguration, images)},
+		{"install-binaries", []string{constants.KubernetesVersion, constants.CNIVersion}, func(ctx context.Context) error {
+			return utils.InstallBinaries()
+		}, restores(binaryPaths)},
+		{"kubelet", []interface{}{config.Networking, config.Kubelet, images, config.ContainerRuntime}, func(ctx context.Context) error {
+			return utils.InstallKubelet(ctx, config.Networking, config.Kubelet, images, config.ContainerRuntime)
+		}, restores(kubeletPaths, constants.KubeletSystemdUnitFilename)},
+		{"vip", []interface{}{config.VIPConfiguration, config.KeepAlived, images, config.ContainerRuntime}, func(ctx context.Context) error {
+			return utils.InstallVIP(ctx, config)
+		}, restores(vipPaths, "keepalived.service")},
+		{"kubeadm", config.MasterConfiguration, func(ctx context.Context) error {
+			file, err := kubeadmConfigFile(config)
+			if err != nil {
+				return err
+			}
+			if err := utils.WriteFiles([]utils.GeneratedFile{file}); err != nil {
+				return err
+			}
+			return kubeadmWatchingKubelet(ctx, timeouts, func(ctx context.Context) error {
+				return kubeadmInit(ctx, constants.KubeadmConfig, timeouts.Kubeadm.Duration)
+			})
+		}, resetsKubeadm(timeouts.Kubeadm.Duration, constants.KubeadmConfig)},
+		{"workarounds", utils.ResolveImage(images, constants.KubeProxyImage), func(ctx context.Context) error {
+			log.Infoln("Applying workaround for https://github.com/kubernetes/kubeadm/issues/857")
+			if err := ensureKubeProxyRespectsHostoverride(ctx, timeouts.Kubectl.Duration, utils.ResolveImage(images, constants.KubeProxyImage)); err != nil {
+				return fmt.Errorf("unable to apply workaround: %v", err)
+			}
+			return nil
+		}, nil},
+		{"network", []interface{}{config.MasterConfiguration.Networking, config.MasterConfiguration.ControllerManagerExtraArgs, utils.ResolveImage(images, constants.FlannelImage)}, func(ctx context.Context) error {
+			return networkInit(ctx, config)
+		}, nil},
+		{"addons", []interface{}{config.RegistryAuth, config.LocalRegistry}, func(ctx context.Context) error {
+			if config.RegistryAuth.CreatePullSecret {
+				if err := ensureImagePullSecret(ctx, timeouts.Kubectl.Duration, config.RegistryAuth); err != nil {
+					return fmt.Errorf("unable to create imagePullSecret: %v", err)
+				}
+			}
+			return utils.InstallLocalRegistry(ctx, config)
+		}, restores(addonPaths, constants.RegistrySystemdUnitFilename)},
+		{"wait", nil, func(ctx context.Context) error {
+			ready := initReadiness(config.MasterConfiguration.NodeName, len(config.MasterConfiguration.Etcd.Endpoints) > 0)
+			return waitReady(ctx, ready, timeouts.Ready.Duration, timeouts.Kubectl.Duration)
+		}, nil},
+		{"join-info", nil, func(ctx context.Context) error {
+			return createJoinInfo(ctx, config, os.Stdout)
+		}, deletesJoinToken(timeouts.Kubeadm.Duration)},
+	}
+}
 
-		log.Infoln("Applying workaround for https://github.com/kubernetes/kubeadm/issues/857")
-		if err := ensureKubeProxyRespectsHostoverride(); err != nil {
-			log.Fatalf("Failed to apply workaround: %v", err)
-		}
+// kubeadmConfigFile renders the configuration of kubeadm init
+func kubeadmConfigFile(config *apis.InitConfiguration) (utils.GeneratedFile, error) {
+	masterConfig, err := yaml.Marshal(config.MasterConfiguration)
+	if err != nil {
+		return utils.GeneratedFile{}, fmt.Errorf("unable to marshal master configuration: %v", err)
+	}
+	return utils.GeneratedFile{Path: constants.KubeadmConfig, Mode: constants.Read, Data: masterConfig}, nil
+}
 
-		networkInit(config)
-	},
+func networkInit(ctx context.Context, config *apis.InitConfiguration) error {
+	manifest, err := podNetworkManifest(config)
+	if err != nil {
+		return err
+	}
+	return kubectl(ctx, config.Timeouts.Kubectl.Duration, strings.NewReader(manifest), "apply", "-f", "-")
 }
 
-func networkInit(config *apis.InitConfiguration) {
+// podNetworkManifest renders the cached flannel manifest with the pod subnet
+// and the flannel image of the cluster
+func podNetworkManifest(config *apis.InitConfiguration) (string, error) {
 	file := filepath.Join(constants.CacheDir, constants.FlannelDirName, constants.FlannelManifestFilename)
 	podSubnetCIDR := config.MasterConfiguration.Networking.PodSubnet
 	if len(podSubnetCIDR) == 0 {
@@ -75,33 +166,40 @@ func networkInit(config *apis.InitConfiguration) {
 		}
 	}
 	log.Infof("Pod network %s", podSubnetCIDR)
-	manifestStr := utils.Substitute(file, constants.DefaultPodNetwork, podSubnetCIDR)
-
-	cmd := exec.Command(constants.Sysctl, "net.bridge.bridge-nf-call-iptables=1")
-	err := cmd.Run()
+	manifestStr, err := utils.Substitute(file, constants.DefaultPodNetwork, podSubnetCIDR)
 	if err != nil {
-		log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
+		return "", fmt.Errorf("unable to render pod network manifest: %v", err)
 	}
-
-	cmd = exec.Command(filepath.Join(constants.BaseInstallDir, "kubectl"), fmt.Sprintf("--kubeconfig=%s", constants.AdminKubeconfigFile), "apply", "-f", "-")
-	reader := strings.NewReader(manifestStr)
-	cmd.Stdin = reader
-	err = cmd.Run()
-	if err != nil {
-		log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
-	}
-
+	flannelImage := utils.ResolveImage(utils.ClusterImageConfiguration(config), constants.FlannelImage)
+	return strings.Replace(manifestStr, constants.FlannelImage, flannelImage, -1), nil
 }
 
-func kubeadmInit(config string) {
-	cmd := exec.Command(filepath.Join(constants.BaseInstallDir, "kubeadm"), "init", "--ignore-preflight-errors=all", "--config="+config)
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
-	}
+func kubeadmInit(ctx context.Context, config string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return host.Run(ctx, filepath.Join(constants.BaseInstallDir, "kubeadm"), "init", kubeadmIgnorePreflightErrors(kubeadmIgnoredChecks), "--config="+config)
 }
 
 func init() {
 	rootCmd.AddCommand(nodeCmdInit)
-	nodeCmdInit.Flags().String("cfg", "", "Location of configuration file")
+	addInitFlags(nodeCmdInit)
+	addPhaseFlags(nodeCmdInit, initPhaseNames)
+	addPhaseCommands(nodeCmdInit, initPhaseNames, addInitFlags, func(cmd *cobra.Command, name string) {
+		config := loadInitConfiguration(cmd)
+		phase, err := findPhase(initPhases(config, skippedChecksFromFlags(cmd), false), name)
+		if err != nil {
+			log.Fatalf("Failed to select phase: %v", err)
+		}
+		changeHost(cmd, func(ctx context.Context) {
+			runPhases(ctx, "init", phase, false, false)
+		})
+	})
+}
+
+func addInitFlags(cmd *cobra.Command) {
+	cmd.Flags().String("cfg", "", "Location of configuration file")
+	addInsecureFlag(cmd)
+	addLockFlags(cmd)
+	addDryRunFlag(cmd)
+	addPreflightFlag(cmd)
 }
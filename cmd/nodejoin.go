@@ -1,14 +1,19 @@
 package cmd
 
 import (
-	"os/exec"
+	"context"
+	"fmt"
+	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
 
 	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/preflight"
+	"github.com/platform9/nodeadm/systemd"
 	"github.com/platform9/nodeadm/utils"
 	"github.com/spf13/cobra"
 )
@@ -18,35 +23,201 @@ var nodeCmdJoin = &cobra.Command{
 	Use:   "join",
 	Short: "Initalize the node with given configuration",
 	Run: func(cmd *cobra.Command, args []string) {
-		var err error
-		config := &apis.JoinConfiguration{}
-		configPath := cmd.Flag("cfg").Value.String()
-		if len(configPath) != 0 {
-			config, err = utils.JoinConfigurationFromFile(configPath)
+		config := loadJoinConfiguration(cmd)
+		opts := phaseOptionsFromFlags(cmd)
+		changeHost(cmd, func(ctx context.Context) {
+			joinNode(ctx, config, cmd.Flag("token").Value.String(), cmd.Flag("master").Value.String(), cmd.Flag("cahash").Value.String(), opts)
+		})
+	},
+}
+
+// loadJoinConfiguration reads, defaults and validates the configuration
+// given with --cfg, and exits if it is invalid
+func loadJoinConfiguration(cmd *cobra.Command) *apis.JoinConfiguration {
+	var err error
+	config := &apis.JoinConfiguration{}
+	configPath := cmd.Flag("cfg").Value.String()
+	if len(configPath) != 0 {
+		config, err = utils.JoinConfigurationFromFile(configPath)
+		if err != nil {
+			log.Fatalf("Failed to read configuration from file %q: %v", configPath, err)
+		}
+	}
+	setInsecureFromFlag(cmd, &config.CacheConfiguration)
+	apis.SetJoinDefaults(config)
+	if errors := apis.ValidateJoin(config); len(errors) > 0 {
+		log.Error("Failed to validate configuration:")
+		for i, err := range errors {
+			log.Errorf("%v: %v", i, err)
+		}
+		os.Exit(1)
+	}
+	return config
+}
+
+// joinNode joins the node to the cluster with a validated configuration
+func joinNode(ctx context.Context, config *apis.JoinConfiguration, token, master, cahash string, opts phaseOptions) {
+	phases, err := skipPhases(joinPhases(config, token, master, cahash, opts.skipChecks, opts.runs("host")), opts.skip)
+	if err != nil {
+		log.Fatalf("Failed to select phases: %v", err)
+	}
+	runPhases(ctx, "join", phases, true, opts.rollback)
+}
+
+// joinPhases returns the phases of join, named as in joinPhaseNames. The
+// inputs of a phase are the parts of the configuration it applies. The
+// preflight checks in skipChecks are not run, and those of the host phase are
+// left to it if prepareHost is set.
+func joinPhases(config *apis.JoinConfiguration, token, master, cahash string, skipChecks []string, prepareHost bool) []phase {
+	timeouts := config.Timeouts
+	return []phase{
+		{"preflight", nil, func(ctx context.Context) error {
+			return runChecks(ctx, func(ctx context.Context) ([]preflight.Check, error) {
+				return joinChecks(ctx, config, prepareHost)
+			}, skipChecks)
+		}, nil},
+		{"host", config.HostPreparation, func(ctx context.Context) error {
+			return utils.PrepareHost(ctx, config.HostPreparation)
+		}, restores(hostPaths)},
+		{"download", []interface{}{config.ImageConfiguration, config.ContainerRuntime}, func(ctx context.Context) error {
+			return download(ctx, config.CacheConfiguration, config.ImageConfiguration, false)
+		}, removesImages(config.CacheConfiguration, config.ImageConfiguration)},
+		{"install-binaries", []string{constants.KubernetesVersion, constants.CNIVersion}, func(ctx context.Context) error {
+			return utils.InstallBinaries()
+		}, restores(binaryPaths)},
+		{"kubelet", []interface{}{config.Networking, config.Kubelet, config.ImageConfiguration, config.ContainerRuntime}, func(ctx context.Context) error {
+			return utils.InstallKubelet(ctx, config.Networking, config.Kubelet, config.ImageConfiguration, config.ContainerRuntime)
+		}, restores(kubeletPaths, constants.KubeletSystemdUnitFilename)},
+		{"kubeadm", []interface{}{master, cahash, config.ContainerRuntime}, func(ctx context.Context) error {
+			return kubeadmWatchingKubelet(ctx, timeouts, func(ctx context.Context) error {
+				return kubeadmJoin(ctx, timeouts.Kubeadm.Duration, token, master, cahash, apis.CRISocket(config.ContainerRuntime))
+			})
+		}, resetsKubeadm(timeouts.Kubeadm.Duration)},
+		{"wait", nil, func(ctx context.Context) error {
+			node, err := constants.GetHostnameOverride()
 			if err != nil {
-				log.Fatalf("Failed to read configuration from file %q: %v", configPath, err)
+				return fmt.Errorf("unable to derive node name: %v", err)
 			}
+			return waitReady(ctx, joinReadiness(node), timeouts.Ready.Duration, timeouts.Kubectl.Duration)
+		}, nil},
+	}
+}
+
+func kubeadmJoin(ctx context.Context, timeout time.Duration, token, master, cahash, criSocket string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	args := []string{"join", kubeadmIgnorePreflightErrors(kubeadmIgnoredChecks), "--token", token, master, "--discovery-token-ca-cert-hash", cahash}
+	if criSocket != "" {
+		args = append(args, "--cri-socket", criSocket)
+	}
+	return host.Run(ctx, filepath.Join(constants.BaseInstallDir, "kubeadm"), args...)
+}
+
+// kubeletPollInterval is how often kubeadmWatchingKubelet checks whether
+// kubeadm has configured the kubelet
+var kubeletPollInterval = time.Second
+
+// kubeadmWatchingKubelet runs kubeadm, which the kubelet started before it
+// waits for, and watches the kubelet as soon as kubeadm has written one of
+// its kubeconfigs. A kubelet that does not become active stops kubeadm, which
+// would otherwise wait for the control plane until it times out, and its
+// journal is reported.
+func kubeadmWatchingKubelet(ctx context.Context, timeouts apis.TimeoutConfiguration, kubeadm func(ctx context.Context) error) error {
+	if host.Planning() {
+		if err := kubeadm(ctx); err != nil {
+			return err
 		}
-		apis.SetJoinDefaults(config)
-		utils.InstallNodeComponents(config)
-		kubeadmJoin(cmd.Flag("token").Value.String(),
-			cmd.Flag("master").Value.String(),
-			cmd.Flag("cahash").Value.String())
-	},
+		return waitKubeletActive(ctx, timeouts)
+	}
+	kubeadmCtx, stopKubeadm := context.WithCancel(ctx)
+	defer stopKubeadm()
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	kubeadmDone := make(chan error, 1)
+	go func() {
+		kubeadmDone <- kubeadm(kubeadmCtx)
+	}()
+	kubeletDone := make(chan error, 1)
+	go func() {
+		kubeletDone <- watchKubelet(watchCtx, timeouts)
+	}()
+
+	select {
+	case err := <-kubeadmDone:
+		stopWatching()
+		<-kubeletDone
+		if err != nil {
+			return err
+		}
+		return waitKubeletActive(ctx, timeouts)
+	case err := <-kubeletDone:
+		if err == nil || ctx.Err() != nil {
+			return <-kubeadmDone
+		}
+		log.Errorf("[nodeadm] Stopping kubeadm: %v", err)
+		stopKubeadm()
+		<-kubeadmDone
+		return err
+	}
 }
 
-func kubeadmJoin(token, master, cahash string) {
-	cmd := exec.Command(filepath.Join(constants.BaseInstallDir, "kubeadm"), "join", "--ignore-preflight-errors=all", "--token", token, master, "--discovery-token-ca-cert-hash", cahash)
-	err := cmd.Run()
-	if err != nil {
-		log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
+// watchKubelet waits until kubeadm has written a kubeconfig of the kubelet,
+// then until the kubelet is active
+func watchKubelet(ctx context.Context, timeouts apis.TimeoutConfiguration) error {
+	for !kubeletConfigured() {
+		select {
+		case <-time.After(kubeletPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+	return waitKubeletActive(ctx, timeouts)
+}
+
+// kubeletConfigured checks whether kubeadm has written a kubeconfig of the
+// kubelet, its bootstrap kubeconfig on join
+func kubeletConfigured() bool {
+	for _, file := range []string{constants.KubeletKubeconfigFile, constants.KubeletBootstrapKubeconfigFile} {
+		if _, err := os.Stat(host.Path(file)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// waitKubeletActive checks that the kubelet runs once kubeadm has configured
+// it. Before that, the kubelet restarts until its kubeconfig is written.
+func waitKubeletActive(ctx context.Context, timeouts apis.TimeoutConfiguration) error {
+	log.Infof("[nodeadm] Waiting for kubelet to become active")
+	if err := systemd.WaitActive(ctx, constants.KubeletSystemdUnitFilename, timeouts.UnitActive.Duration, timeouts.RestartLoop.Duration); err != nil {
+		return fmt.Errorf("kubelet is not healthy: %v", err)
+	}
+	return nil
 }
 
 func init() {
 	rootCmd.AddCommand(nodeCmdJoin)
-	nodeCmdJoin.Flags().String("cfg", "", "Location of configuration file")
-	nodeCmdJoin.Flags().String("token", "", "kubeadm token to be used for kubeadm join")
-	nodeCmdJoin.Flags().String("master", "", "masterIP:masterPort for the master to join")
-	nodeCmdJoin.Flags().String("cahash", "", "CA hash")
+	addJoinFlags(nodeCmdJoin)
+	addPhaseFlags(nodeCmdJoin, joinPhaseNames)
+	addPhaseCommands(nodeCmdJoin, joinPhaseNames, addJoinFlags, func(cmd *cobra.Command, name string) {
+		config := loadJoinConfiguration(cmd)
+		phase, err := findPhase(joinPhases(config, cmd.Flag("token").Value.String(), cmd.Flag("master").Value.String(), cmd.Flag("cahash").Value.String(), skippedChecksFromFlags(cmd), false), name)
+		if err != nil {
+			log.Fatalf("Failed to select phase: %v", err)
+		}
+		changeHost(cmd, func(ctx context.Context) {
+			runPhases(ctx, "join", phase, false, false)
+		})
+	})
+}
+
+func addJoinFlags(cmd *cobra.Command) {
+	cmd.Flags().String("cfg", "", "Location of configuration file")
+	addInsecureFlag(cmd)
+	addLockFlags(cmd)
+	addDryRunFlag(cmd)
+	addPreflightFlag(cmd)
+	cmd.Flags().String("token", "", "kubeadm token to be used for kubeadm join")
+	cmd.Flags().String("master", "", "masterIP:masterPort for the master to join")
+	cmd.Flags().String("cahash", "", "CA hash")
 }
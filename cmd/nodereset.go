@@ -1,13 +1,19 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"time"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
 
+	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/preflight"
 	"github.com/platform9/nodeadm/systemd"
 	"github.com/platform9/nodeadm/utils"
 	"github.com/spf13/cobra"
@@ -18,77 +24,166 @@ var nodeCmdReset = &cobra.Command{
 	Use:   "reset",
 	Short: "Reset node to clean up all kubernetes install and configuration",
 	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: Fail on first error instead of best effort cleanup
-		cleanupKeepalived()
-		kubeadmReset()
-		cleanupKubelet()
-		cleanupBinaries()
-		cleanupNetworking()
-		cleanupDockerImages()
+		config := loadInitConfiguration(cmd)
+		skipChecks := skippedChecksFromFlags(cmd)
+		changeHost(cmd, func(ctx context.Context) {
+			resetNode(ctx, config, skipChecks)
+		})
 	},
 }
 
-func kubeadmReset() {
+// resetNode removes everything init and join installed. The configuration
+// of a join is read as an init configuration without a master configuration.
+// The preflight checks in skipChecks are not run.
+func resetNode(ctx context.Context, config *apis.InitConfiguration, skipChecks []string) {
+	runSteps(ctx, "reset", []step{
+		{"preflight", func(ctx context.Context) error {
+			return preflight.Run(ctx, []preflight.Check{preflight.PrivilegedUser()}, skipChecks)
+		}},
+		{"forget completed phases", func(ctx context.Context) error {
+			if err := removeState(); err != nil {
+				return err
+			}
+			return utils.RemoveBackups()
+		}},
+		{"remove keepalived", cleanupKeepalived},
+		{"remove local registry", cleanupRegistry},
+		{"kubeadm reset", func(ctx context.Context) error {
+			kubeadmReset(ctx, config.Timeouts.Kubeadm.Duration)
+			return host.RemoveAll(constants.JoinInfoFile)
+		}},
+		{"remove kubelet", cleanupKubelet},
+		{"remove binaries", cleanupBinaries},
+		{"restore host", utils.RestoreHost},
+		{"reset networking", cleanupNetworking},
+		{"remove images", func(ctx context.Context) error {
+			return cleanupImages(ctx, &config.CacheConfiguration, utils.ClusterImageConfiguration(config))
+		}},
+	})
+}
+
+// kubeadmReset runs kubeadm reset, ignoring its failure since the node may
+// not have been initialized
+func kubeadmReset(ctx context.Context, timeout time.Duration) {
 	log.Infof("[nodeadm:reset] Invoking kubeadm reset")
-	_ = exec.Command(filepath.Join(constants.BaseInstallDir, "kubeadm"), "reset", "--ignore-preflight-errors=all").Run()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_ = host.Run(ctx, filepath.Join(constants.BaseInstallDir, "kubeadm"), "reset")
 }
 
-func cleanupKeepalived() {
+func cleanupKeepalived(ctx context.Context) error {
 	log.Infof("[nodeadm:reset] Stopping & Removing Keepalived")
-	if err := systemd.StopIfActive("keepalived.service"); err != nil {
-		log.Fatalf("Failed to stop keepalived service: %v", err)
+	if err := systemd.StopIfActive(ctx, "keepalived.service"); err != nil {
+		return fmt.Errorf("unable to stop keepalived service: %v", err)
+	}
+	if err := systemd.DisableIfEnabled(ctx, "keepalived.service"); err != nil {
+		return fmt.Errorf("unable to disable keepalived service: %v", err)
+	}
+	host.RemoveAll(filepath.Join(constants.SystemdDir, "keepalived.service"))
+	host.RemoveAll(constants.KeepalivedConfigFilename)
+	return nil
+}
+
+func cleanupRegistry(ctx context.Context) error {
+	log.Infof("[nodeadm:reset] Stopping & Removing local registry")
+	if err := systemd.StopIfActive(ctx, constants.RegistrySystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to stop registry service: %v", err)
 	}
-	if err := systemd.DisableIfEnabled("keepalived.service"); err != nil {
-		log.Fatalf("Failed to disable keepalived service: %v", err)
+	if err := systemd.DisableIfEnabled(ctx, constants.RegistrySystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to disable registry service: %v", err)
 	}
-	os.RemoveAll(filepath.Join(constants.SystemdDir, "keepalived.service"))
-	os.Remove(constants.KeepalivedConfigFilename)
+	unit := filepath.Join(constants.SystemdDir, constants.RegistrySystemdUnitFilename)
+	if _, err := os.Stat(host.Path(unit)); err == nil {
+		// The installed nodeadm only runs the registry
+		host.RemoveAll(constants.NodeadmInstallPath)
+	}
+	host.RemoveAll(unit)
+	return nil
 }
 
-func cleanupKubelet() {
+func cleanupKubelet(ctx context.Context) error {
 	log.Infof("[nodeadm:reset] Stopping & Removing kubelet")
-	if err := systemd.StopIfActive("kubelet.service"); err != nil {
-		log.Fatalf("Failed to stop kubelet service: %v", err)
+	if err := systemd.StopIfActive(ctx, "kubelet.service"); err != nil {
+		return fmt.Errorf("unable to stop kubelet service: %v", err)
 	}
-	if err := systemd.DisableIfEnabled("kubelet.service"); err != nil {
-		log.Fatalf("Failed to disable kubelet service: %v", err)
+	if err := systemd.DisableIfEnabled(ctx, "kubelet.service"); err != nil {
+		return fmt.Errorf("unable to disable kubelet service: %v", err)
 	}
-	failed, err := systemd.Failed("kubelet.service")
+	failed, err := systemd.Failed(ctx, "kubelet.service")
 	if err != nil {
-		log.Fatalf("Failed to check if kubelet service failed: %v", err)
+		return fmt.Errorf("unable to check if kubelet service failed: %v", err)
 	}
 	if failed {
-		if err := systemd.ResetFailed("kubelet.service"); err != nil {
-			log.Fatalf("Failed to reset failed kubelet service: %v", err)
+		if err := systemd.ResetFailed(ctx, "kubelet.service"); err != nil {
+			return fmt.Errorf("unable to reset failed kubelet service: %v", err)
 		}
 	}
-	os.RemoveAll(filepath.Join(constants.SystemdDir, "kubelet.service"))
-	os.RemoveAll(filepath.Join(constants.SystemdDir, "kubelet.service.d"))
+	host.RemoveAll(filepath.Join(constants.SystemdDir, "kubelet.service"))
+	host.RemoveAll(filepath.Join(constants.SystemdDir, "kubelet.service.d"))
+	return nil
 }
 
-func cleanupBinaries() {
+func cleanupBinaries(ctx context.Context) error {
 	log.Infof("[nodeadm:reset] Removing kubernetes binaries")
-	os.RemoveAll(filepath.Join(constants.BaseInstallDir, "kubelet"))
-	os.RemoveAll(filepath.Join(constants.BaseInstallDir, "kubeadm"))
-	os.RemoveAll(filepath.Join(constants.BaseInstallDir, "kubectl"))
+	host.RemoveAll(filepath.Join(constants.BaseInstallDir, "kubelet"))
+	host.RemoveAll(filepath.Join(constants.BaseInstallDir, "kubeadm"))
+	host.RemoveAll(filepath.Join(constants.BaseInstallDir, "kubectl"))
 
-	os.RemoveAll(constants.CNIBaseDir)
+	host.RemoveAll(constants.CNIBaseDir)
+	return nil
 }
 
-func cleanupNetworking() {
+func cleanupNetworking(ctx context.Context) error {
 	log.Infof("[nodeadm:reset] Removing flannel state files & resetting networking")
-	os.RemoveAll(constants.CNIConfigDir)
-	os.RemoveAll(constants.CNIStateDir)
-	_ = exec.Command("ip", "link", "del", "cni0").Run()
-	_ = exec.Command("ip", "link", "del", "flannel.1").Run()
+	host.RemoveAll(constants.CNIConfigDir)
+	host.RemoveAll(constants.CNIStateDir)
+	for _, link := range []string{"cni0", "flannel.1"} {
+		if err := host.DeleteLink(link); err != nil {
+			log.Warnf("[nodeadm:reset] %v", err)
+		}
+	}
+	return nil
 }
 
-func cleanupDockerImages() {
-	for _, image := range utils.GetImages() {
-		_ = exec.Command("docker", "rmi", image).Run()
+// cleanupImages removes the upstream images, their mirrored names and the
+// names of the local registry that init tagged them with
+func cleanupImages(ctx context.Context, config *apis.CacheConfiguration, clusterImages apis.ImageConfiguration) error {
+	log.Infof("[nodeadm:reset] Removing images")
+	rt, err := containerruntime.New(config.ContainerRuntime)
+	if err != nil {
+		return fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, upstream := range utils.GetImages() {
+		for _, image := range []string{upstream, utils.ResolveImage(config.ImageConfiguration, upstream), utils.ResolveImage(clusterImages, upstream)} {
+			if seen[image] {
+				continue
+			}
+			seen[image] = true
+			present, err := rt.ImagePresent(ctx, image)
+			if err != nil {
+				log.Warnf("[nodeadm:reset] %v", err)
+				continue
+			}
+			if !present {
+				continue
+			}
+			if host.Planning() {
+				host.Record(host.ImageAction, "remove %s", image)
+				continue
+			}
+			if err := rt.RemoveImage(ctx, image); err != nil {
+				log.Warnf("[nodeadm:reset] %v", err)
+			}
+		}
 	}
+	return nil
 }
 
 func init() {
 	rootCmd.AddCommand(nodeCmdReset)
+	nodeCmdReset.Flags().String("cfg", "", "Location of configuration file")
+	addPreflightFlag(nodeCmdReset)
+	addDryRunFlag(nodeCmdReset)
+	addLockFlags(nodeCmdReset)
 }
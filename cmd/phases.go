@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/utils"
+	"github.com/spf13/cobra"
+)
+
+// Phases of init and join, in the order they run
+var (
+	initPhaseNames = []string{"preflight", "host", "download", "install-binaries", "kubelet", "vip", "kubeadm", "workarounds", "network", "addons", "wait", "join-info"}
+	joinPhaseNames = []string{"preflight", "host", "download", "install-binaries", "kubelet", "kubeadm", "wait"}
+)
+
+// commandPhaseNames are the phases of each command that records them
+var commandPhaseNames = map[string][]string{"init": initPhaseNames, "join": joinPhaseNames}
+
+// phase is a named part of init or join. Its inputs are the configuration it
+// depends on; a phase without inputs is run every time. Its undo, if any,
+// registers how to roll the phase back.
+type phase struct {
+	name   string
+	inputs interface{}
+	run    func(ctx context.Context) error
+	undo   undoFunc
+}
+
+// phaseOptions select how init and join run their phases
+type phaseOptions struct {
+	// skip are the names of the phases not to run
+	skip []string
+	// rollback undoes the phases that ran when one fails
+	rollback bool
+	// skipChecks are the names of the preflight checks not to run
+	skipChecks []string
+}
+
+// runs returns whether the phase with the given name is not skipped
+func (o phaseOptions) runs(name string) bool {
+	for _, skipped := range o.skip {
+		if skipped == name {
+			return false
+		}
+	}
+	return true
+}
+
+// runPhases runs the phases of command. With resume, phases that completed
+// before with the same inputs are skipped. With rollback, the phases that ran
+// are undone when one fails.
+func runPhases(ctx context.Context, command string, phases []phase, resume, rollback bool) {
+	s, err := loadState()
+	if err != nil {
+		log.Fatalf("Failed to load state: %v", err)
+	}
+	if s.Command != "" && s.Command != command {
+		log.Fatalf("The host was set up by nodeadm %s, run nodeadm reset first", s.Command)
+	}
+	var tx *transaction
+	if rollback {
+		tx = &transaction{}
+		phases = tx.wrap(phases)
+	}
+	steps := recordPhases(s, command, phases)
+	if resume {
+		if steps, err = resumePhases(s, command, phases); err != nil {
+			log.Fatalf("Failed to resume %s: %v", command, err)
+		}
+	}
+	err = executeSteps(ctx, command, steps)
+	if err == nil {
+		if tx != nil {
+			if err := utils.RemoveBackups(); err != nil {
+				log.Warnf("[nodeadm:%s] %v", command, err)
+			}
+		}
+		return
+	}
+	if tx == nil {
+		log.Fatalf("[nodeadm:%s] %v", command, err)
+	}
+	log.Errorf("[nodeadm:%s] %v", command, err)
+	// Roll back even if ctx was cancelled; a second signal still exits
+	if rollbackErr := tx.rollback(context.Background(), command, s); rollbackErr != nil {
+		log.Fatalf("[nodeadm:%s] %v. Rollback failed: %v", command, err, rollbackErr)
+	}
+	log.Fatalf("[nodeadm:%s] %v. Rolled back %d phases", command, err, len(tx.undo))
+}
+
+// skipPhases returns the phases whose names are not in skip. It fails on
+// names that are not phases, so that a typo does not run a phase.
+func skipPhases(phases []phase, skip []string) ([]phase, error) {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	var selected []phase
+	for _, p := range phases {
+		if skipped[p.name] {
+			log.Infof("[nodeadm] Skipping phase %q", p.name)
+			delete(skipped, p.name)
+			continue
+		}
+		selected = append(selected, p)
+	}
+	for name := range skipped {
+		return nil, fmt.Errorf("unknown phase %q, phases are %s", name, phaseNames(phases))
+	}
+	return selected, nil
+}
+
+// findPhase returns the phase with the given name
+func findPhase(phases []phase, name string) ([]phase, error) {
+	for _, p := range phases {
+		if p.name == name {
+			return []phase{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown phase %q, phases are %s", name, phaseNames(phases))
+}
+
+func phaseNames(phases []phase) string {
+	var names []string
+	for _, p := range phases {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// download populates the cache and, on a master that serves the cache, tags
+// the cached images with their local registry names
+func download(ctx context.Context, config apis.CacheConfiguration, images apis.ImageConfiguration, tagImages bool) error {
+	if err := utils.PopulateCache(ctx, config); err != nil {
+		return err
+	}
+	if !tagImages {
+		return nil
+	}
+	rt, err := containerruntime.New(config.ContainerRuntime)
+	if err != nil {
+		return fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	// The master runs the images it serves without pulling them from itself
+	return utils.TagImages(ctx, rt, images)
+}
+
+// addPhaseCommands adds a "phase" subcommand to cmd, which runs a single one
+// of the named phases with run. Each phase takes the flags added by addFlags.
+func addPhaseCommands(cmd *cobra.Command, names []string, addFlags func(cmd *cobra.Command), run func(cmd *cobra.Command, phase string)) {
+	phaseCmd := &cobra.Command{
+		Use:   "phase",
+		Short: fmt.Sprintf("Run a single phase of %s", cmd.Name()),
+	}
+	for _, name := range names {
+		name := name
+		c := &cobra.Command{
+			Use:   name,
+			Short: fmt.Sprintf("Run the %s phase of %s", name, cmd.Name()),
+			Run: func(cmd *cobra.Command, args []string) {
+				run(cmd, name)
+			},
+		}
+		addFlags(c)
+		phaseCmd.AddCommand(c)
+	}
+	cmd.AddCommand(phaseCmd)
+}
+
+// addPhaseFlags adds the flags that select how a full init or join runs its
+// phases
+func addPhaseFlags(cmd *cobra.Command, names []string) {
+	cmd.Flags().StringSlice("skip-phases", nil, fmt.Sprintf("Phases to skip, out of %s", strings.Join(names, ", ")))
+	cmd.Flags().Bool("rollback", false, "Undo the phases that ran if one fails")
+}
+
+// phaseOptionsFromFlags returns the options given with the flags added by
+// addPhaseFlags
+func phaseOptionsFromFlags(cmd *cobra.Command) phaseOptions {
+	skip, err := cmd.Flags().GetStringSlice("skip-phases")
+	if err != nil {
+		log.Fatalf("Error parsing option value for skip-phases")
+	}
+	rollback, err := cmd.Flags().GetBool("rollback")
+	if err != nil {
+		log.Fatalf("Error parsing option value for rollback")
+	}
+	return phaseOptions{skip: skip, rollback: rollback, skipChecks: skippedChecksFromFlags(cmd)}
+}
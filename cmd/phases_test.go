@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/platform9/nodeadm/apis"
+)
+
+func names(phases []phase) []string {
+	var names []string
+	for _, p := range phases {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+func TestPhaseNames(t *testing.T) {
+	if got := names(initPhases(&apis.InitConfiguration{}, nil, true)); !reflect.DeepEqual(got, initPhaseNames) {
+		t.Errorf("init phases are %v, initPhaseNames are %v", got, initPhaseNames)
+	}
+	if got := names(joinPhases(&apis.JoinConfiguration{}, "", "", "", nil, true)); !reflect.DeepEqual(got, joinPhaseNames) {
+		t.Errorf("join phases are %v, joinPhaseNames are %v", got, joinPhaseNames)
+	}
+}
+
+func TestSkipPhases(t *testing.T) {
+	nop := func(ctx context.Context) error { return nil }
+	phases := []phase{{"a", nil, nop, nil}, {"b", nil, nop, nil}, {"c", nil, nop, nil}}
+	selected, err := skipPhases(phases, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(selected); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("selected %v, want [a c]", got)
+	}
+	if _, err := skipPhases(phases, []string{"d"}); err == nil || !strings.Contains(err.Error(), `unknown phase "d"`) {
+		t.Errorf("expected unknown phase error, got %v", err)
+	}
+}
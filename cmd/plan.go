@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/platform9/nodeadm/host"
+	"github.com/spf13/cobra"
+)
+
+// addDryRunFlag adds the flag that prints the changes a command would make
+// instead of making them
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("dry-run", false, "Print the changes to the host without making them")
+}
+
+// changeHost runs a command that changes the host, holding the host lock and
+// stopping on SIGINT or SIGTERM. With --dry-run, run records the changes
+// instead, which are printed once it completes. A dry run only reads the
+// host, so it does not take the lock.
+func changeHost(cmd *cobra.Command, run func(ctx context.Context)) {
+	ctx, stop := signalContext()
+	defer stop()
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		plan := &host.Plan{}
+		defer host.SetPlan(host.SetPlan(plan))
+		run(ctx)
+		plan.Print(os.Stdout)
+		return
+	}
+	defer lockHost(ctx, cmd)()
+	run(ctx)
+}
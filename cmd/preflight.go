@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/preflight"
+	"github.com/platform9/nodeadm/systemd"
+	"github.com/spf13/cobra"
+	kubeletconfigv1beta1 "k8s.io/kubernetes/pkg/kubelet/apis/kubeletconfig/v1beta1"
+)
+
+// Ports of the kubelet and of the control plane components kubeadm runs
+const (
+	kubeletPort           = 10250
+	schedulerPort         = 10251
+	controllerManagerPort = 10252
+	etcdPort              = 2379
+)
+
+// kubeadmIgnoredChecks are the kubeadm preflight checks nodeadm overrides.
+// nodeadm starts the kubelet before kubeadm runs, and checks swap against
+// failSwapOn and the container runtime itself, which kubeadm checks with
+// crictl that nodeadm does not install.
+var kubeadmIgnoredChecks = []string{"Port-10250", "Swap", "CRI"}
+
+// initChecks returns the preflight checks of init. prepareHost is set if the
+// host phase runs after them.
+func initChecks(ctx context.Context, config *apis.InitConfiguration, prepareHost bool) ([]preflight.Check, error) {
+	ports := []int{int(config.MasterConfiguration.API.BindPort), kubeletPort, schedulerPort, controllerManagerPort}
+	if len(config.MasterConfiguration.Etcd.Endpoints) == 0 {
+		ports = append(ports, etcdPort)
+	}
+	return nodeChecks(ctx, config.ContainerRuntime, config.Kubelet, config.HostPreparation, prepareHost, ports)
+}
+
+// joinChecks returns the preflight checks of join. prepareHost is set if the
+// host phase runs after them.
+func joinChecks(ctx context.Context, config *apis.JoinConfiguration, prepareHost bool) ([]preflight.Check, error) {
+	return nodeChecks(ctx, config.ContainerRuntime, config.Kubelet, config.HostPreparation, prepareHost, []int{kubeletPort})
+}
+
+// nodeChecks returns the checks of a host that runs the kubelet, and of the
+// ports it and the components it runs listen on. The kubelet port is not
+// checked while the kubelet runs. Swap is not checked if the
+// host phase disables it, and BridgeNetfilter if the host phase, which loads
+// br_netfilter, runs after the checks.
+func nodeChecks(ctx context.Context, runtimeConfig apis.ContainerRuntimeConfiguration, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, hostConfig apis.HostPreparationConfiguration, prepareHost bool, ports []int) ([]preflight.Check, error) {
+	rt, err := containerruntime.New(runtimeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	swap := preflight.Swap(*kubeletConfig.FailSwapOn)
+	if hostConfig.DisableSwap {
+		swap.Run = func(ctx context.Context) error { return nil }
+	}
+	bridgeNetfilter := preflight.BridgeNetfilter()
+	if prepareHost {
+		bridgeNetfilter.Run = func(ctx context.Context) error { return nil }
+	}
+	checks := []preflight.Check{
+		preflight.PrivilegedUser(),
+		preflight.ContainerRuntime(rt),
+		preflight.CgroupDriver(rt, runtimeConfig.CgroupDriver),
+		swap,
+		bridgeNetfilter,
+	}
+	kubeletActive, err := systemd.Active(ctx, constants.KubeletSystemdUnitFilename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check kubelet: %v", err)
+	}
+	for _, port := range ports {
+		check := preflight.Port(port)
+		if kubeletActive && port == kubeletPort {
+			// The port is held by the kubelet of an earlier run
+			check.Run = func(ctx context.Context) error { return nil }
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// runChecks runs the checks returned by checks, except those in skip
+func runChecks(ctx context.Context, checks func(ctx context.Context) ([]preflight.Check, error), skip []string) error {
+	c, err := checks(ctx)
+	if err != nil {
+		return err
+	}
+	return preflight.Run(ctx, c, skip)
+}
+
+// kubeadmIgnorePreflightErrors returns the kubeadm flag that ignores the
+// checks nodeadm overrides
+func kubeadmIgnorePreflightErrors(checks []string) string {
+	return "--ignore-preflight-errors=" + strings.Join(checks, ",")
+}
+
+// addPreflightFlag adds the flag that skips preflight checks by name
+func addPreflightFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("skip-preflight-checks", nil, "Preflight checks to skip, by name")
+}
+
+// skippedChecksFromFlags returns the checks given with the flag added by
+// addPreflightFlag
+func skippedChecksFromFlags(cmd *cobra.Command) []string {
+	skip, err := cmd.Flags().GetStringSlice("skip-preflight-checks")
+	if err != nil {
+		log.Fatalf("Error parsing option value for skip-preflight-checks")
+	}
+	return skip
+}
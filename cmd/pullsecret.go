@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/utils"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pullSecretServiceAccounts are the kube-system service accounts of the addons
+// deployed by nodeadm
+var pullSecretServiceAccounts = []string{"kube-proxy", "kube-dns", "flannel"}
+
+// ensureImagePullSecret creates or updates the kube-system imagePullSecret
+// holding the registry credentials, and adds it to the addon service accounts
+func ensureImagePullSecret(ctx context.Context, timeout time.Duration, authConfig apis.RegistryAuthConfiguration) error {
+	auths, err := utils.RegistryAuths(authConfig)
+	if err != nil {
+		return fmt.Errorf("unable to read registry credentials: %v", err)
+	}
+	if len(auths) == 0 {
+		return fmt.Errorf("no registry credentials configured")
+	}
+	type dockerConfigEntry struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	}
+	entries := make(map[string]dockerConfigEntry)
+	for host, auth := range auths {
+		if host == "docker.io" {
+			host = "https://index.docker.io/v1/"
+		}
+		entries[host] = dockerConfigEntry{
+			Username: auth.Username,
+			Password: auth.Password,
+			Auth:     base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password)),
+		}
+	}
+	dockerConfigJSON, err := json.Marshal(struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}{entries})
+	if err != nil {
+		return fmt.Errorf("unable to encode registry credentials: %v", err)
+	}
+	secret := v1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      authConfig.PullSecretName,
+			Namespace: "kube-system",
+		},
+		Type: v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			v1.DockerConfigJsonKey: dockerConfigJSON,
+		},
+	}
+	manifest, err := json.Marshal(secret)
+	if err != nil {
+		return fmt.Errorf("unable to encode secret: %v", err)
+	}
+
+	log.Infof("[registry-auth] Creating imagePullSecret %s", authConfig.PullSecretName)
+	if err := kubectl(ctx, timeout, bytes.NewReader(manifest), "apply", "-f", "-"); err != nil {
+		return err
+	}
+	for _, serviceAccount := range pullSecretServiceAccounts {
+		if err := addImagePullSecret(ctx, timeout, serviceAccount, authConfig.PullSecretName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addImagePullSecret appends the imagePullSecret to a kube-system service
+// account, keeping the imagePullSecrets it already has
+func addImagePullSecret(ctx context.Context, timeout time.Duration, serviceAccount, name string) error {
+	var sa v1.ServiceAccount
+	if err := kubectlGet(ctx, timeout, constants.AdminKubeconfigFile, &sa, "--namespace=kube-system", "serviceaccount", serviceAccount); err != nil {
+		return err
+	}
+	for _, secret := range sa.ImagePullSecrets {
+		if secret.Name == name {
+			log.Infof("[registry-auth] Service account %s already has imagePullSecret %s", serviceAccount, name)
+			return nil
+		}
+	}
+	// A JSON patch can only append to an array that exists
+	op := map[string]interface{}{"op": "add", "path": "/imagePullSecrets/-", "value": v1.LocalObjectReference{Name: name}}
+	if len(sa.ImagePullSecrets) == 0 {
+		op["path"], op["value"] = "/imagePullSecrets", []v1.LocalObjectReference{{Name: name}}
+	}
+	patch, err := json.Marshal([]interface{}{op})
+	if err != nil {
+		return fmt.Errorf("unable to encode patch: %v", err)
+	}
+	log.Infof("[registry-auth] Adding imagePullSecret to service account %s", serviceAccount)
+	return kubectl(ctx, timeout, nil, "--namespace=kube-system", "patch", "serviceaccount", serviceAccount, "--type=json", "--patch", string(patch))
+}
+
+// kubectl runs kubectl with the admin kubeconfig, giving up after timeout. The
+// manifest is not logged, since it may contain credentials.
+func kubectl(ctx context.Context, timeout time.Duration, stdin io.Reader, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return host.RunWithInput(ctx, stdin, filepath.Join(constants.BaseInstallDir, constants.KubectlFilename), append([]string{fmt.Sprintf("--kubeconfig=%s", constants.AdminKubeconfigFile)}, args...)...)
+}
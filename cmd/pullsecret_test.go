@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestAddImagePullSecret(t *testing.T) {
+	const get = "/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get --namespace=kube-system serviceaccount flannel --output=json"
+	const patch = "/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf --namespace=kube-system patch serviceaccount flannel --type=json --patch "
+	tests := []struct {
+		name           string
+		serviceAccount string
+		expected       []string
+	}{
+		{"no secrets", `{"metadata": {"name": "flannel"}}`, []string{
+			get,
+			patch + `[{"op":"add","path":"/imagePullSecrets","value":[{"name":"nodeadm-registry-auth"}]}]`,
+		}},
+		{"other secrets", `{"imagePullSecrets": [{"name": "mirror"}]}`, []string{
+			get,
+			patch + `[{"op":"add","path":"/imagePullSecrets/-","value":{"name":"nodeadm-registry-auth"}}]`,
+		}},
+		{"already added", `{"imagePullSecrets": [{"name": "mirror"}, {"name": "nodeadm-registry-auth"}]}`, []string{
+			get,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			defer h.restore()
+			h.executor.Responses[get] = host.FakeResponse{Stdout: tt.serviceAccount}
+			if err := addImagePullSecret(context.Background(), time.Minute, "flannel", "nodeadm-registry-auth"); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h.executor.Commands, tt.expected) {
+				t.Errorf("ran %q, expected %q", h.executor.Commands, tt.expected)
+			}
+		})
+	}
+}
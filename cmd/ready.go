@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// readyPollInterval is how often the cluster is queried while waiting
+var readyPollInterval = 5 * time.Second
+
+// The label of the pods of the cluster DNS
+const (
+	dnsLabelKey   = "k8s-app"
+	dnsLabelValue = "kube-dns"
+)
+
+// readiness is what must be ready once init or join completes
+type readiness struct {
+	// kubeconfig is used to query the cluster
+	kubeconfig string
+	node       string
+	// staticPods are the components whose static pods run on the node
+	staticPods []string
+	// daemonSets must each have a ready pod on the node
+	daemonSets []string
+	// dns requires a ready pod of the cluster DNS, on any node
+	dns bool
+}
+
+// initReadiness is what must be ready once init completes
+func initReadiness(node string, externalEtcd bool) readiness {
+	staticPods := []string{"kube-apiserver", "kube-controller-manager", "kube-scheduler"}
+	if !externalEtcd {
+		staticPods = append(staticPods, "etcd")
+	}
+	return readiness{
+		kubeconfig: constants.AdminKubeconfigFile,
+		node:       node,
+		staticPods: staticPods,
+		daemonSets: []string{constants.KubeProxyDaemonSet, constants.FlannelDaemonSet},
+		dns:        true,
+	}
+}
+
+// joinReadiness is what must be ready once join completes. The node only has
+// the credentials of its kubelet, which can read nodes and pods.
+func joinReadiness(node string) readiness {
+	return readiness{
+		kubeconfig: constants.KubeletKubeconfigFile,
+		node:       node,
+		daemonSets: []string{constants.KubeProxyDaemonSet, constants.FlannelDaemonSet},
+	}
+}
+
+// waitReady waits until everything in r is ready. When it times out, it
+// reports every component that is not ready and why.
+func waitReady(ctx context.Context, r readiness, timeout, kubectlTimeout time.Duration) error {
+	if host.Planning() {
+		host.Record(host.CommandAction, "wait for node %s to become ready", r.node)
+		return nil
+	}
+	log.Infof("[nodeadm] Waiting for node %s to become ready", r.node)
+	deadline := time.Now().Add(timeout)
+	for {
+		notReady, err := r.check(ctx, kubectlTimeout)
+		if err == nil && len(notReady) == 0 {
+			return nil
+		}
+		// The API server may not serve requests yet, so errors are retried
+		if err != nil {
+			notReady = []string{err.Error()}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("node %s did not become ready within %v: %s", r.node, timeout, strings.Join(notReady, "; "))
+		}
+		select {
+		case <-time.After(readyPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for node %s: %v", r.node, ctx.Err())
+		}
+	}
+}
+
+// check returns the components that are not ready, each with the reason
+func (r readiness) check(ctx context.Context, timeout time.Duration) ([]string, error) {
+	var node corev1.Node
+	if err := kubectlGet(ctx, timeout, r.kubeconfig, &node, "node", r.node); err != nil {
+		return nil, err
+	}
+	var notReady []string
+	if reason := nodeNotReady(&node); reason != "" {
+		notReady = append(notReady, fmt.Sprintf("node %s: %s", r.node, reason))
+	}
+	var pods corev1.PodList
+	if err := kubectlGet(ctx, timeout, r.kubeconfig, &pods, "pods", "--namespace=kube-system"); err != nil {
+		return nil, err
+	}
+	for _, component := range r.staticPods {
+		name := component + "-" + r.node
+		pod := findPod(pods.Items, func(p *corev1.Pod) bool {
+			return p.Name == name
+		})
+		if reason := podNotReady(pod); reason != "" {
+			notReady = append(notReady, fmt.Sprintf("%s: %s", component, reason))
+		}
+	}
+	for _, daemonSet := range r.daemonSets {
+		pod := findPod(pods.Items, func(p *corev1.Pod) bool {
+			return p.Spec.NodeName == r.node && ownedBy(p, "DaemonSet", daemonSet)
+		})
+		if reason := podNotReady(pod); reason != "" {
+			notReady = append(notReady, fmt.Sprintf("daemonset %s: %s", daemonSet, reason))
+		}
+	}
+	if r.dns {
+		var reasons []string
+		ready := false
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Labels[dnsLabelKey] != dnsLabelValue {
+				continue
+			}
+			reason := podNotReady(pod)
+			if reason == "" {
+				ready = true
+				break
+			}
+			reasons = append(reasons, pod.Name+" "+reason)
+		}
+		if !ready {
+			if len(reasons) == 0 {
+				reasons = []string{"no pod"}
+			}
+			notReady = append(notReady, "dns: "+strings.Join(reasons, ", "))
+		}
+	}
+	return notReady, nil
+}
+
+// kubectlGet gets objects from the cluster, and decodes them into object
+func kubectlGet(ctx context.Context, timeout time.Duration, kubeconfig string, object interface{}, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	args = append([]string{"--kubeconfig=" + kubeconfig, "get"}, append(args, "--output=json")...)
+	out, err := host.Output(ctx, filepath.Join(constants.BaseInstallDir, constants.KubectlFilename), args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, object); err != nil {
+		return fmt.Errorf("unable to decode kubectl output: %v", err)
+	}
+	return nil
+}
+
+// nodeNotReady returns why the node is not ready, or an empty string if it is
+func nodeNotReady(node *corev1.Node) string {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			if c.Status == corev1.ConditionTrue {
+				return ""
+			}
+			return conditionReason(c.Reason, c.Message)
+		}
+	}
+	return "no Ready condition"
+}
+
+// podNotReady returns why the pod is not ready, or an empty string if it is
+func podNotReady(pod *corev1.Pod) string {
+	if pod == nil {
+		return "no pod"
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			return ""
+		}
+	}
+	// The state of a container says more than the conditions of the pod
+	for _, s := range pod.Status.ContainerStatuses {
+		switch {
+		case s.State.Waiting != nil:
+			return fmt.Sprintf("container %s is waiting: %s", s.Name, conditionReason(s.State.Waiting.Reason, s.State.Waiting.Message))
+		case s.State.Terminated != nil:
+			return fmt.Sprintf("container %s terminated: %s", s.Name, conditionReason(s.State.Terminated.Reason, s.State.Terminated.Message))
+		case !s.Ready:
+			return fmt.Sprintf("container %s is not ready", s.Name)
+		}
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Status != corev1.ConditionTrue && c.Reason != "" {
+			return conditionReason(c.Reason, c.Message)
+		}
+	}
+	return fmt.Sprintf("pod is %s", pod.Status.Phase)
+}
+
+func conditionReason(reason, message string) string {
+	if message == "" {
+		return reason
+	}
+	return reason + ": " + message
+}
+
+func findPod(pods []corev1.Pod, match func(p *corev1.Pod) bool) *corev1.Pod {
+	for i := range pods {
+		if match(&pods[i]) {
+			return &pods[i]
+		}
+	}
+	return nil
+}
+
+func ownedBy(pod *corev1.Pod, kind, name string) bool {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == kind && owner.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestWaitReadyTimeout(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get node"] = host.FakeResponse{
+		Stdout: `{"status": {"conditions": [{"type": "Ready", "status": "False", "reason": "KubeletNotReady", "message": "runtime network not ready"}]}}`,
+	}
+	h.executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get pods"] = host.FakeResponse{
+		Stdout: `{"items": [
+			{"metadata": {"name": "kube-apiserver-master"}, "status": {"conditions": [{"type": "Ready", "status": "True"}]}},
+			{"metadata": {"name": "kube-dns-1", "labels": {"k8s-app": "kube-dns"}}, "status": {"phase": "Pending", "containerStatuses": [{"name": "kubedns", "state": {"waiting": {"reason": "ContainerCreating"}}}]}}
+		]}`,
+	}
+	err := waitReady(context.Background(), initReadiness("master", true), 0, time.Minute)
+	if err == nil {
+		t.Fatal("expected the wait to time out")
+	}
+	for _, expected := range []string{
+		"node master: KubeletNotReady: runtime network not ready",
+		"kube-scheduler: no pod",
+		"daemonset kube-flannel-ds: no pod",
+		"dns: kube-dns-1 container kubedns is waiting: ContainerCreating",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "kube-apiserver") || strings.Contains(err.Error(), "etcd") {
+		t.Errorf("expected only components that are not ready, got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/registry"
+	"github.com/spf13/cobra"
+)
+
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Manage the local image registry",
+}
+
+var registryCmdServe = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the cached images through a pull-only Docker registry",
+	Run: func(cmd *cobra.Command, args []string) {
+		listen := cmd.Flag("listen").Value.String()
+		tlsCert := cmd.Flag("tls-cert").Value.String()
+		tlsKey := cmd.Flag("tls-key").Value.String()
+
+		store, err := registry.NewStore(constants.RegistryCacheDir)
+		if err != nil {
+			log.Fatalf("Failed to create registry store: %v", err)
+		}
+		if err := store.AddImagesFromDir(constants.ImagesCacheDir); err != nil {
+			log.Fatalf("Failed to index image cache: %v", err)
+		}
+		server := &http.Server{Addr: listen, Handler: registry.NewServer(store)}
+		log.Infof("[registry] Listening on %s", listen)
+		if len(tlsCert) != 0 || len(tlsKey) != 0 {
+			err = server.ListenAndServeTLS(tlsCert, tlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		log.Fatalf("Registry stopped: %v", err)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(registryCmd)
+	registryCmd.AddCommand(registryCmdServe)
+	registryCmdServe.Flags().String("listen", fmt.Sprintf(":%d", constants.DefaultRegistryPort), "Address to listen on")
+	registryCmdServe.Flags().String("tls-cert", "", "Location of the TLS certificate, serves plain HTTP if omitted")
+	registryCmdServe.Flags().String("tls-key", "", "Location of the TLS key")
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/utils"
+	"github.com/spf13/cobra"
+)
+
+// renderIndexFilename is the index of the rendered files, at the top of the
+// output directory
+const renderIndexFilename = "index.json"
+
+// renderedFile is an entry of the index written by nodeadm render
+type renderedFile struct {
+	Path  string `json:"path"`
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+	Mode  string `json:"mode"`
+}
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Write the files init or join would generate, without changing the host",
+}
+
+var renderCmdInit = &cobra.Command{
+	Use:   "init",
+	Short: "Write the files init would generate",
+	Run: func(cmd *cobra.Command, args []string) {
+		files, err := renderInitFiles(loadInitConfiguration(cmd))
+		if err != nil {
+			log.Fatalf("Failed to render init: %v", err)
+		}
+		writeRenderedFiles(cmd, files)
+	},
+}
+
+var renderCmdJoin = &cobra.Command{
+	Use:   "join",
+	Short: "Write the files join would generate",
+	Run: func(cmd *cobra.Command, args []string) {
+		files, err := renderJoinFiles(loadJoinConfiguration(cmd))
+		if err != nil {
+			log.Fatalf("Failed to render join: %v", err)
+		}
+		writeRenderedFiles(cmd, files)
+	},
+}
+
+// renderInitFiles returns the files init writes on the host, and the
+// manifests it applies to the cluster placed in constants.ManifestsDir. The
+// pod network manifest is read from the cache.
+func renderInitFiles(config *apis.InitConfiguration) ([]utils.GeneratedFile, error) {
+	images := utils.ClusterImageConfiguration(config)
+	rt, err := containerruntime.New(config.ContainerRuntime)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	units, err := utils.RenderKubeletUnits(constants.KubernetesVersion, config.Networking, config.Kubelet, images, rt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render kubelet units: %v", err)
+	}
+	files := append(utils.RenderHostFiles(config.HostPreparation), units.Files()...)
+	if config.VIPConfiguration.IP != "" {
+		vipFiles, err := utils.RenderKeepalivedFiles(config, rt)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, vipFiles...)
+	}
+	kubeadmConfig, err := kubeadmConfigFile(config)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, kubeadmConfig)
+	manifest, err := podNetworkManifest(config)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files,
+		utils.GeneratedFile{Path: filepath.Join(constants.ManifestsDir, constants.FlannelManifestFilename), Mode: constants.Read, Data: []byte(manifest)},
+		utils.GeneratedFile{Path: filepath.Join(constants.ManifestsDir, constants.KubeProxyPatchFilename), Mode: constants.Read, Data: []byte(kubeProxyPatch(utils.ResolveImage(images, constants.KubeProxyImage)))},
+	)
+	if config.LocalRegistry.Enabled {
+		registryUnit, err := utils.RenderRegistryServiceFile(config)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, registryUnit)
+	}
+	return files, nil
+}
+
+// renderJoinFiles returns the files join writes on the host
+func renderJoinFiles(config *apis.JoinConfiguration) ([]utils.GeneratedFile, error) {
+	rt, err := containerruntime.New(config.ContainerRuntime)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	units, err := utils.RenderKubeletUnits(constants.KubernetesVersion, config.Networking, config.Kubelet, config.ImageConfiguration, rt)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render kubelet units: %v", err)
+	}
+	return append(utils.RenderHostFiles(config.HostPreparation), units.Files()...), nil
+}
+
+func writeRenderedFiles(cmd *cobra.Command, files []utils.GeneratedFile) {
+	out := cmd.Flag("out").Value.String()
+	if err := writeRendered(out, files); err != nil {
+		log.Fatalf("Failed to write rendered files: %v", err)
+	}
+	log.Infof("Rendered %d files to %s", len(files), out)
+}
+
+// writeRendered writes files below out, at their paths on the host, and the
+// index of their paths, owners and modes
+func writeRendered(out string, files []utils.GeneratedFile) error {
+	var index []renderedFile
+	for _, file := range files {
+		if err := utils.WriteFile(filepath.Join(out, file.Path), file.Data, file.Mode); err != nil {
+			return err
+		}
+		// nodeadm runs as root, so every file it writes is owned by root
+		index = append(index, renderedFile{Path: file.Path, Owner: "root", Group: "root", Mode: fmt.Sprintf("%04o", file.Mode.Perm())})
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal index: %v", err)
+	}
+	return utils.WriteFile(filepath.Join(out, renderIndexFilename), append(data, '\n'), constants.Read)
+}
+
+func init() {
+	rootCmd.AddCommand(renderCmd)
+	for _, cmd := range []*cobra.Command{renderCmdInit, renderCmdJoin} {
+		cmd.Flags().String("cfg", "", "Location of configuration file")
+		cmd.Flags().String("out", "", "Directory to write the files to, at their paths on the host")
+		cmd.MarkFlagRequired("out")
+		renderCmd.AddCommand(cmd)
+	}
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestRenderInit(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	files, err := renderInitFiles(initConfiguration(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRendered(host.Path("/render"), files); err != nil {
+		t.Fatal(err)
+	}
+	// Rendering runs no commands and writes only below the output directory
+	assertGolden(t, "render-init", h.state(t))
+}
+
+func TestRenderJoin(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	files, err := renderJoinFiles(joinConfiguration(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRendered(host.Path("/render"), files); err != nil {
+		t.Fatal(err)
+	}
+	assertGolden(t, "render-join", h.state(t))
+}
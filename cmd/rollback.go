@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/utils"
+)
+
+// undoFunc records what a phase is about to change, and returns the action
+// that undoes the change
+type undoFunc func(ctx context.Context) (func(ctx context.Context) error, error)
+
+// restores returns an undoFunc that puts paths and units back as they were
+func restores(paths []string, units ...string) undoFunc {
+	return func(ctx context.Context) (func(ctx context.Context) error, error) {
+		snapshot := &utils.Snapshot{}
+		if err := snapshot.AddPaths(paths...); err != nil {
+			return nil, err
+		}
+		if err := snapshot.AddUnits(ctx, units...); err != nil {
+			return nil, err
+		}
+		return snapshot.Restore, nil
+	}
+}
+
+// removesImages returns an undoFunc that removes the images a download adds
+// to the runtime, under their upstream, mirror and local registry names
+func removesImages(config apis.CacheConfiguration, clusterImages apis.ImageConfiguration) undoFunc {
+	return func(ctx context.Context) (func(ctx context.Context) error, error) {
+		rt, err := containerruntime.New(config.ContainerRuntime)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create container runtime: %v", err)
+		}
+		seen := make(map[string]bool)
+		var images []string
+		for _, upstream := range utils.GetImages() {
+			for _, image := range []string{upstream, utils.ResolveImage(config.ImageConfiguration, upstream), utils.ResolveImage(clusterImages, upstream)} {
+				if !seen[image] {
+					seen[image] = true
+					images = append(images, image)
+				}
+			}
+		}
+		snapshot := &utils.Snapshot{}
+		if err := snapshot.AddImages(ctx, rt, images...); err != nil {
+			return nil, err
+		}
+		return snapshot.Restore, nil
+	}
+}
+
+// resetsKubeadm returns an undoFunc that runs kubeadm reset and puts paths
+// back as they were
+func resetsKubeadm(timeout time.Duration, paths ...string) undoFunc {
+	return func(ctx context.Context) (func(ctx context.Context) error, error) {
+		restore, err := restores(paths)(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			kubeadmReset(ctx, timeout)
+			return restore(ctx)
+		}, nil
+	}
+}
+
+// deletesJoinToken returns an undoFunc that deletes the bootstrap token of the
+// join information if the phase replaced it, and puts the join information
+// back as it was
+func deletesJoinToken(timeout time.Duration) undoFunc {
+	return func(ctx context.Context) (func(ctx context.Context) error, error) {
+		previous, err := readJoinInfo()
+		if err != nil {
+			return nil, err
+		}
+		restore, err := restores([]string{constants.JoinInfoFile})(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			info, err := readJoinInfo()
+			if err != nil {
+				return err
+			}
+			if info != nil && (previous == nil || info.Token != previous.Token) {
+				if err := deleteToken(ctx, timeout, info.Token); err != nil {
+					return err
+				}
+			}
+			return restore(ctx)
+		}, nil
+	}
+}
+
+// Paths and units changed by the phases of init and join
+var (
+	hostPaths    = []string{constants.ModulesLoadFile, constants.SysctlFile, constants.FstabFile}
+	binaryPaths  = []string{filepath.Join(constants.BaseInstallDir, constants.KubeadmFilename), filepath.Join(constants.BaseInstallDir, constants.KubectlFilename), constants.CNIBaseDir}
+	kubeletPaths = []string{filepath.Join(constants.BaseInstallDir, constants.KubeletFilename), filepath.Join(constants.SystemdDir, constants.KubeletSystemdUnitFilename), filepath.Join(constants.SystemdDir, constants.KubeletSystemdUnitFilename+".d")}
+	vipPaths     = []string{filepath.Join(constants.SystemdDir, "keepalived.service"), constants.KeepalivedConfigFilename}
+	addonPaths   = []string{constants.NodeadmInstallPath, filepath.Join(constants.SystemdDir, constants.RegistrySystemdUnitFilename)}
+)
+
+// transaction registers the undo action of every phase before it runs, so
+// that the phases that ran can be undone, in reverse order, when one fails
+type transaction struct {
+	undo []undoAction
+}
+
+type undoAction struct {
+	phase string
+	run   func(ctx context.Context) error
+}
+
+// wrap returns the phases, changed to register their undo action before they
+// run
+func (t *transaction) wrap(phases []phase) []phase {
+	var wrapped []phase
+	for _, p := range phases {
+		p := p
+		run := p.run
+		if p.undo != nil {
+			run = func(ctx context.Context) error {
+				undo, err := p.undo(ctx)
+				if err != nil {
+					return fmt.Errorf("unable to prepare rollback: %v", err)
+				}
+				t.undo = append(t.undo, undoAction{p.name, undo})
+				return p.run(ctx)
+			}
+		}
+		wrapped = append(wrapped, phase{p.name, p.inputs, run, p.undo})
+	}
+	return wrapped
+}
+
+// rollback undoes the phases that ran, latest first, and forgets that they
+// and the phases after them completed. It undoes as much as it can, and returns every failure.
+func (t *transaction) rollback(ctx context.Context, command string, s *state) error {
+	var failures []string
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		u := t.undo[i]
+		log.Infof("[nodeadm:%s] Rolling back phase %q", command, u.phase)
+		if err := u.run(ctx); err != nil {
+			log.Errorf("[nodeadm:%s] Failed to roll back phase %q: %v", command, u.phase, err)
+			failures = append(failures, fmt.Sprintf("phase %q: %v", u.phase, err))
+		}
+		delete(s.Completed, u.phase)
+	}
+	// The phases after the earliest one undone changed what it set up, e.g.
+	// the cluster that kubeadm reset removes, so they must run again too
+	if len(t.undo) > 0 {
+		forget := false
+		for _, name := range commandPhaseNames[command] {
+			forget = forget || name == t.undo[0].phase
+			if forget {
+				delete(s.Completed, name)
+			}
+		}
+	}
+	if len(s.Completed) == 0 {
+		s.Command = ""
+		if err := removeState(); err != nil {
+			failures = append(failures, err.Error())
+		}
+	} else if err := s.save(); err != nil {
+		failures = append(failures, err.Error())
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/utils"
+)
+
+// state records the phases of init or join that completed on the host, with
+// a hash of their inputs, so that a re-run resumes after them
+type state struct {
+	// Command is init or join
+	Command string `json:"command"`
+	// Completed maps the completed phases to the hash of their inputs
+	Completed map[string]string `json:"completed"`
+}
+
+// loadState reads the state file, or returns an empty state if there is none
+func loadState() (*state, error) {
+	s := &state{Completed: make(map[string]string)}
+	data, err := ioutil.ReadFile(host.Path(constants.StateFile))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state: %v", err)
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("unable to parse state %q: %v", constants.StateFile, err)
+	}
+	if s.Completed == nil {
+		s.Completed = make(map[string]string)
+	}
+	return s, nil
+}
+
+func (s *state) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal state: %v", err)
+	}
+	if err := utils.WriteFile(host.Path(constants.StateFile), append(data, '\n'), constants.Read); err != nil {
+		return fmt.Errorf("unable to write state: %v", err)
+	}
+	return nil
+}
+
+// removeState forgets every completed phase
+func removeState() error {
+	if err := host.RemoveAll(constants.StateFile); err != nil {
+		return fmt.Errorf("unable to remove state: %v", err)
+	}
+	return nil
+}
+
+func inputsHash(inputs interface{}) (string, error) {
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal inputs: %v", err)
+	}
+	h := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(h[:]), nil
+}
+
+// resumePhases returns the steps that run the phases of command that have not
+// completed with the same inputs. It fails if the inputs of a completed phase
+// changed, since the phase would have to be undone first.
+func resumePhases(s *state, command string, phases []phase) ([]step, error) {
+	var remaining []phase
+	for _, p := range phases {
+		completed, ok := s.Completed[p.name]
+		if p.inputs == nil || !ok {
+			remaining = append(remaining, p)
+			continue
+		}
+		hash, err := inputsHash(p.inputs)
+		if err != nil {
+			return nil, err
+		}
+		if hash != completed {
+			return nil, fmt.Errorf("the configuration of completed phase %q changed, run nodeadm reset first", p.name)
+		}
+		log.Infof("[nodeadm:%s] Phase %q already completed, skipping", command, p.name)
+	}
+	return recordPhases(s, command, remaining), nil
+}
+
+// recordPhases returns steps that run the phases and record in s the ones
+// that complete. Phases without inputs always run and are not recorded.
+func recordPhases(s *state, command string, phases []phase) []step {
+	var steps []step
+	for _, p := range phases {
+		p := p
+		steps = append(steps, step{p.name, func(ctx context.Context) error {
+			if err := p.run(ctx); err != nil {
+				return err
+			}
+			if p.inputs == nil {
+				return nil
+			}
+			hash, err := inputsHash(p.inputs)
+			if err != nil {
+				return err
+			}
+			s.Command = command
+			s.Completed[p.name] = hash
+			// A dry run leaves the recorded phases as they are
+			if host.Planning() {
+				return nil
+			}
+			return s.save()
+		}})
+	}
+	return steps
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestResumePhases(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	var ran []string
+	phases := func(inputs string) []phase {
+		var phases []phase
+		for _, name := range []string{"a", "b", "c"} {
+			name := name
+			phases = append(phases, phase{name, inputs, func(ctx context.Context) error {
+				ran = append(ran, name)
+				return nil
+			}, nil})
+		}
+		return phases
+	}
+
+	s, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := recordPhases(s, "init", phases("x")[:2])
+	runSteps(context.Background(), "init", steps)
+
+	s, err = loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran = nil
+	steps, err = resumePhases(s, "init", phases("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSteps(context.Background(), "init", steps)
+	if strings.Join(ran, ",") != "c" {
+		t.Errorf("resumed phases %v, want [c]", ran)
+	}
+
+	if _, err := resumePhases(s, "init", phases("y")); err == nil || !strings.Contains(err.Error(), `completed phase "a" changed`) {
+		t.Errorf("expected changed configuration error, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+)
+
+// step is one operation of a command. A step that fails or is interrupted
+// leaves no half-written files behind: files are replaced atomically, and
+// partially extracted directories are removed.
+type step struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// runSteps runs the steps of a command in order. It exits, reporting the step
+// it stopped at, when a step fails or ctx is done.
+func runSteps(ctx context.Context, command string, steps []step) {
+	if err := executeSteps(ctx, command, steps); err != nil {
+		log.Fatalf("[nodeadm:%s] %v", command, err)
+	}
+}
+
+// stepError reports the step a command stopped at
+type stepError struct {
+	step        string
+	completed   int
+	total       int
+	interrupted bool
+	err         error
+}
+
+func (e *stepError) Error() string {
+	switch {
+	case e.interrupted && e.err == nil:
+		return fmt.Sprintf("Interrupted before step %q, %d of %d steps completed", e.step, e.completed, e.total)
+	case e.interrupted:
+		return fmt.Sprintf("Interrupted during step %q, %d of %d steps completed: %v", e.step, e.completed, e.total, e.err)
+	}
+	return fmt.Sprintf("Step %q failed: %v", e.step, e.err)
+}
+
+// executeSteps runs the steps of a command in order, and returns a stepError
+// when a step fails or ctx is done
+func executeSteps(ctx context.Context, command string, steps []step) error {
+	for i, s := range steps {
+		if ctx.Err() != nil {
+			return &stepError{step: s.name, completed: i, total: len(steps), interrupted: true}
+		}
+		log.Infof("[nodeadm:%s] Step %d/%d: %s", command, i+1, len(steps), s.name)
+		if err := s.run(ctx); err != nil {
+			return &stepError{step: s.name, completed: i, total: len(steps), interrupted: ctx.Err() != nil, err: err}
+		}
+	}
+	return nil
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM, so
+// the running operation is abandoned and the command stops. A second signal
+// exits immediately. The returned function releases the signal handler.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("[nodeadm] Received %v, stopping. Repeat to exit immediately", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		sig := <-signals
+		log.Fatalf("[nodeadm] Received %v again, exiting", sig)
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/ghodss/yaml"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	bootstrapapi "k8s.io/client-go/tools/bootstrap/token/api"
+)
+
+// bootstrapToken is a bootstrap token as listed by nodeadm token list
+type bootstrapToken struct {
+	Token string `json:"token"`
+	// Expires is when the token expires, in RFC3339, or empty if it does not
+	Expires     string   `json:"expires,omitempty"`
+	Usages      []string `json:"usages"`
+	Description string   `json:"description,omitempty"`
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage bootstrap tokens with the admin kubeconfig of a master",
+}
+
+var tokenCmdCreate = &cobra.Command{
+	Use:   "create",
+	Short: "Create a bootstrap token to join nodes with",
+	Run: func(cmd *cobra.Command, args []string) {
+		ttl, err := cmd.Flags().GetDuration("ttl")
+		if err != nil {
+			log.Fatalf("Error parsing option value for ttl")
+		}
+		usages, err := cmd.Flags().GetStringSlice("usages")
+		if err != nil {
+			log.Fatalf("Error parsing option value for usages")
+		}
+		printJoinCommand, err := cmd.Flags().GetBool("print-join-command")
+		if err != nil {
+			log.Fatalf("Error parsing option value for print-join-command")
+		}
+		ctx, stop := signalContext()
+		defer stop()
+		token, err := createToken(ctx, constants.DefaultKubeadmTimeout, ttl, usages, cmd.Flag("description").Value.String())
+		if err != nil {
+			log.Fatalf("Failed to create token: %v", err)
+		}
+		output := cmd.Flag("output").Value.String()
+		if output == "" && !printJoinCommand {
+			fmt.Println(token)
+			return
+		}
+		info, err := tokenJoinInfo(token, ttl)
+		if err != nil {
+			log.Fatalf("Failed to get join information: %v", err)
+		}
+		if err := printFormatted(os.Stdout, output, info, info.joinCommand()+"\n"); err != nil {
+			log.Fatalf("Failed to print token: %v", err)
+		}
+	},
+}
+
+var tokenCmdList = &cobra.Command{
+	Use:   "list",
+	Short: "List bootstrap tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signalContext()
+		defer stop()
+		tokens, err := listTokens(ctx, constants.DefaultKubectlTimeout)
+		if err != nil {
+			log.Fatalf("Failed to list tokens: %v", err)
+		}
+		if err := printFormatted(os.Stdout, cmd.Flag("output").Value.String(), tokens, tokenTable(tokens)); err != nil {
+			log.Fatalf("Failed to print tokens: %v", err)
+		}
+	},
+}
+
+var tokenCmdDelete = &cobra.Command{
+	Use:   "delete <token or token ID>...",
+	Short: "Delete bootstrap tokens, e.g. the token of a join that succeeded",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flag("joined").Value.String() == "" {
+			return cobra.MinimumNArgs(1)(cmd, args)
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signalContext()
+		defer stop()
+		if node := cmd.Flag("joined").Value.String(); node != "" {
+			ids, err := joinedTokenIDs(ctx, constants.DefaultKubectlTimeout, node)
+			if err != nil {
+				log.Fatalf("Failed to find the token node %s joined with: %v", node, err)
+			}
+			args = append(args, ids...)
+		}
+		if err := deleteTokens(ctx, constants.DefaultKubeadmTimeout, args); err != nil {
+			log.Fatalf("Failed to delete tokens: %v", err)
+		}
+	},
+}
+
+// createToken creates a bootstrap token with kubeadm, valid for ttl. kubeadm
+// defaults the usages if there are none.
+func createToken(ctx context.Context, timeout, ttl time.Duration, usages []string, description string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	args := []string{"token", "create", "--kubeconfig", constants.AdminKubeconfigFile, "--ttl", ttl.String()}
+	if len(usages) > 0 {
+		args = append(args, "--usages", strings.Join(usages, ","))
+	}
+	if description != "" {
+		args = append(args, "--description", description)
+	}
+	out, err := host.Output(ctx, filepath.Join(constants.BaseInstallDir, constants.KubeadmFilename), args...)
+	if err != nil {
+		return "", fmt.Errorf("unable to create bootstrap token: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// tokenJoinInfo returns the join information of a token, with the API server
+// of the admin kubeconfig
+func tokenJoinInfo(token string, ttl time.Duration) (*joinInfo, error) {
+	endpoint, err := kubeconfigEndpoint(constants.AdminKubeconfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return newJoinInfo(endpoint, token, ttl)
+}
+
+// kubeconfigEndpoint returns the host:port of the API server of the cluster in
+// a kubeconfig
+func kubeconfigEndpoint(file string) (string, error) {
+	data, err := ioutil.ReadFile(host.Path(file))
+	if err != nil {
+		return "", fmt.Errorf("unable to read kubeconfig: %v", err)
+	}
+	var kubeconfig struct {
+		Clusters []struct {
+			Cluster struct {
+				Server string `json:"server"`
+			} `json:"cluster"`
+		} `json:"clusters"`
+	}
+	if err := yaml.Unmarshal(data, &kubeconfig); err != nil {
+		return "", fmt.Errorf("unable to decode kubeconfig %q: %v", file, err)
+	}
+	if len(kubeconfig.Clusters) == 0 {
+		return "", fmt.Errorf("no cluster in kubeconfig %q", file)
+	}
+	server, err := url.Parse(kubeconfig.Clusters[0].Cluster.Server)
+	if err != nil || server.Host == "" {
+		return "", fmt.Errorf("unable to parse API server of kubeconfig %q", file)
+	}
+	return server.Host, nil
+}
+
+// listTokens returns the bootstrap tokens of the cluster
+func listTokens(ctx context.Context, timeout time.Duration) ([]bootstrapToken, error) {
+	var secrets corev1.SecretList
+	if err := kubectlGet(ctx, timeout, constants.AdminKubeconfigFile, &secrets, "secrets", "--namespace=kube-system", "--field-selector=type="+string(bootstrapapi.SecretTypeBootstrapToken)); err != nil {
+		return nil, err
+	}
+	tokens := []bootstrapToken{}
+	for _, secret := range secrets.Items {
+		token := bootstrapToken{
+			Token:       string(secret.Data[bootstrapapi.BootstrapTokenIDKey]) + "." + string(secret.Data[bootstrapapi.BootstrapTokenSecretKey]),
+			Expires:     string(secret.Data[bootstrapapi.BootstrapTokenExpirationKey]),
+			Usages:      []string{},
+			Description: string(secret.Data[bootstrapapi.BootstrapTokenDescriptionKey]),
+		}
+		for key, value := range secret.Data {
+			if strings.HasPrefix(key, bootstrapapi.BootstrapTokenUsagePrefix) && string(value) == "true" {
+				token.Usages = append(token.Usages, strings.TrimPrefix(key, bootstrapapi.BootstrapTokenUsagePrefix))
+			}
+		}
+		sort.Strings(token.Usages)
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// tokenTable returns the tokens as a table
+func tokenTable(tokens []bootstrapToken) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN\tEXPIRES\tUSAGES\tDESCRIPTION")
+	for _, token := range tokens {
+		expires := token.Expires
+		if expires == "" {
+			expires = "<never>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", token.Token, expires, strings.Join(token.Usages, ","), token.Description)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// deleteTokens deletes bootstrap tokens, given as tokens or token IDs. The
+// join information written by init is removed if its token is deleted.
+func deleteTokens(ctx context.Context, timeout time.Duration, tokens []string) error {
+	ids := make(map[string]bool)
+	for _, token := range tokens {
+		if err := deleteToken(ctx, timeout, token); err != nil {
+			return err
+		}
+		ids[tokenID(token)] = true
+	}
+	info, err := readJoinInfo()
+	if err != nil || info == nil {
+		return err
+	}
+	if !ids[tokenID(info.Token)] {
+		return nil
+	}
+	log.Infof("[nodeadm] Removing %s, its token was deleted", constants.JoinInfoFile)
+	return host.RemoveAll(constants.JoinInfoFile)
+}
+
+func deleteToken(ctx context.Context, timeout time.Duration, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := host.Run(ctx, filepath.Join(constants.BaseInstallDir, constants.KubeadmFilename), "token", "delete", "--kubeconfig", constants.AdminKubeconfigFile, token); err != nil {
+		return fmt.Errorf("unable to delete bootstrap token %s: %v", tokenID(token), err)
+	}
+	return nil
+}
+
+// bootstrapUserPrefix is the prefix of the user a bootstrap token
+// authenticates as, followed by the token ID
+const bootstrapUserPrefix = "system:bootstrap:"
+
+// certificateSigningRequests is the part of a list of certificate signing
+// requests that tells which requests were approved, and by whom they were made
+type certificateSigningRequests struct {
+	Items []struct {
+		Spec struct {
+			// Request is the PEM encoded request
+			Request  []byte `json:"request"`
+			Username string `json:"username"`
+		} `json:"spec"`
+		Status struct {
+			Conditions []csrCondition `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// csrCondition is a condition of a certificate signing request, e.g. Approved
+type csrCondition struct {
+	Type string `json:"type"`
+}
+
+// joinedTokenIDs returns the IDs of the bootstrap tokens with which the
+// kubelet of node requested its client certificate, as it does once the join
+// succeeds. The requests are only kept for an hour after they are approved.
+func joinedTokenIDs(ctx context.Context, timeout time.Duration, node string) ([]string, error) {
+	var csrs certificateSigningRequests
+	if err := kubectlGet(ctx, timeout, constants.AdminKubeconfigFile, &csrs, "certificatesigningrequests"); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, csr := range csrs.Items {
+		if !strings.HasPrefix(csr.Spec.Username, bootstrapUserPrefix) || !approved(csr.Status.Conditions) {
+			continue
+		}
+		block, _ := pem.Decode(csr.Spec.Request)
+		if block == nil {
+			continue
+		}
+		request, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil || request.Subject.CommonName != "system:node:"+node {
+			continue
+		}
+		id := strings.TrimPrefix(csr.Spec.Username, bootstrapUserPrefix)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no approved certificate signing request of node %s made with a bootstrap token", node)
+	}
+	return ids, nil
+}
+
+// approved returns whether the conditions of a certificate signing request
+// include its approval
+func approved(conditions []csrCondition) bool {
+	for _, c := range conditions {
+		if c.Type == "Approved" {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenID returns the public part of a token, or the token ID itself
+func tokenID(token string) string {
+	return strings.SplitN(token, ".", 2)[0]
+}
+
+// printFormatted prints object as json or yaml, or text without a format
+func printFormatted(out io.Writer, format string, object interface{}, text string) error {
+	var data []byte
+	var err error
+	switch format {
+	case "":
+		_, err = io.WriteString(out, text)
+		return err
+	case "json":
+		data, err = json.MarshalIndent(object, "", "  ")
+	case "yaml":
+		data, err = yaml.Marshal(object)
+	default:
+		return fmt.Errorf("invalid output format %q, use json or yaml", format)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to encode output: %v", err)
+	}
+	_, err = fmt.Fprintln(out, strings.TrimSuffix(string(data), "\n"))
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCmdCreate, tokenCmdList, tokenCmdDelete)
+	tokenCmdCreate.Flags().Duration("ttl", constants.DefaultTokenTTL, "How long the token is valid, 0 for ever")
+	tokenCmdCreate.Flags().StringSlice("usages", nil, "Usages of the token, signing and authentication by default")
+	tokenCmdCreate.Flags().String("description", "", "Description of the token")
+	tokenCmdCreate.Flags().Bool("print-join-command", false, "Print the nodeadm join command instead of the token")
+	tokenCmdDelete.Flags().String("joined", "", "Also delete the token the node joined with, within an hour of the join")
+	for _, cmd := range []*cobra.Command{tokenCmdCreate, tokenCmdList} {
+		cmd.Flags().String("output", "", "Specify output format yaml/json")
+	}
+}
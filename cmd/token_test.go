@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestListTokens(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get secrets"] = host.FakeResponse{
+		Stdout: `{"items": [{"type": "bootstrap.kubernetes.io/token", "data": {
+			"token-id": "YWJjZGVm",
+			"token-secret": "MDEyMzQ1Njc4OWFiY2RlZg==",
+			"expiration": "MjAyNi0xMC0yMFQxMDowMDowMFo=",
+			"description": "am9pbnMgd29ya2Vycw==",
+			"usage-bootstrap-signing": "dHJ1ZQ==",
+			"usage-bootstrap-authentication": "dHJ1ZQ=="
+		}}]}`,
+	}
+	tokens, err := listTokens(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bootstrapToken{{
+		Token:       "abcdef.0123456789abcdef",
+		Expires:     "2026-10-20T10:00:00Z",
+		Usages:      []string{"authentication", "signing"},
+		Description: "joins workers",
+	}}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("got %+v, expected %+v", tokens, expected)
+	}
+}
+
+func TestDeleteTokens(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	if err := os.MkdirAll(filepath.Dir(host.Path(constants.JoinInfoFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(host.Path(constants.JoinInfoFile), []byte(`{"token": "abcdef.0123456789abcdef"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteTokens(context.Background(), time.Minute, []string{"012345"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(host.Path(constants.JoinInfoFile)); err != nil {
+		t.Errorf("join information of another token must be kept: %v", err)
+	}
+	if err := deleteTokens(context.Background(), time.Minute, []string{"abcdef.0123456789abcdef"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(host.Path(constants.JoinInfoFile)); !os.IsNotExist(err) {
+		t.Errorf("join information of a deleted token must be removed, got %v", err)
+	}
+	expected := []string{
+		"/opt/bin/kubeadm token delete --kubeconfig /etc/kubernetes/admin.conf 012345",
+		"/opt/bin/kubeadm token delete --kubeconfig /etc/kubernetes/admin.conf abcdef.0123456789abcdef",
+	}
+	if !reflect.DeepEqual(h.executor.Commands, expected) {
+		t.Errorf("ran %v, expected %v", h.executor.Commands, expected)
+	}
+}
+
+// csr returns a certificate signing request of the kubelet of node, made by
+// user, as listed by kubectl
+func csr(t *testing.T, node, user string, conditions ...string) map[string]interface{} {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:" + node, Organization: []string{"system:nodes"}}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status []map[string]string
+	for _, c := range conditions {
+		status = append(status, map[string]string{"type": c})
+	}
+	return map[string]interface{}{
+		"spec":   map[string]interface{}{"request": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), "username": user},
+		"status": map[string]interface{}{"conditions": status},
+	}
+}
+
+func TestJoinedTokenIDs(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	list, err := json.Marshal(map[string]interface{}{"items": []interface{}{
+		csr(t, "worker1", "system:bootstrap:abcdef", "Approved"),
+		csr(t, "worker1", "system:bootstrap:abcdef", "Approved"),
+		csr(t, "worker1", "system:bootstrap:pendin"),
+		csr(t, "worker2", "system:bootstrap:012345", "Approved"),
+		csr(t, "worker1", "system:node:worker1", "Approved"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.executor.Responses["/opt/bin/kubectl --kubeconfig=/etc/kubernetes/admin.conf get certificatesigningrequests"] = host.FakeResponse{Stdout: string(list)}
+	ids, err := joinedTokenIDs(context.Background(), time.Minute, "worker1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"abcdef"}) {
+		t.Errorf("got %v, expected the token of the approved request of worker1", ids)
+	}
+	if _, err := joinedTokenIDs(context.Background(), time.Minute, "worker3"); err == nil {
+		t.Errorf("expected an error for a node without requests")
+	}
+}
+
+func TestKubeconfigEndpoint(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	kubeconfig := `apiVersion: v1
+clusters:
+- cluster:
+    certificate-authority-data: ""
+    server: https://192.168.10.5:6443
+  name: kubernetes
+`
+	if err := os.MkdirAll(filepath.Dir(host.Path(constants.AdminKubeconfigFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(host.Path(constants.AdminKubeconfigFile), []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := kubeconfigEndpoint(constants.AdminKubeconfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != "192.168.10.5:6443" {
+		t.Errorf("got %s, expected 192.168.10.5:6443", endpoint)
+	}
+}
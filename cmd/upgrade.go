@@ -0,0 +1,438 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/preflight"
+	"github.com/platform9/nodeadm/utils"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	kubeletconfigv1beta1 "k8s.io/kubernetes/pkg/kubelet/apis/kubeletconfig/v1beta1"
+	"k8s.io/kubernetes/pkg/util/version"
+)
+
+// maxKubeletSkew is how many minor versions a kubelet may be older than the
+// API server
+const maxKubeletSkew = 2
+
+// kubeadmUpgradeNodeVersion is the first kubeadm with upgrade node, which
+// writes the kubelet configuration of the new version
+var kubeadmUpgradeNodeVersion = version.MustParseSemantic("v1.11.0")
+
+// clusterVersions are the versions running in the cluster and on the host
+type clusterVersions struct {
+	controlPlane *version.Version
+	// kubelets are the versions of the kubelets, by node name
+	kubelets map[string]*version.Version
+	// kubelet is the version of the kubelet of the host
+	kubelet *version.Version
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade the cluster to a Kubernetes version in the cache",
+}
+
+var upgradeCmdPlan = &cobra.Command{
+	Use:   "plan",
+	Short: "Show the current versions and the versions in the cache this node can upgrade to",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signalContext()
+		defer stop()
+		kubeconfig := constants.KubeletKubeconfigFile
+		if _, err := os.Stat(host.Path(constants.AdminKubeconfigFile)); err == nil {
+			kubeconfig = constants.AdminKubeconfigFile
+		}
+		current, err := getClusterVersions(ctx, constants.DefaultKubectlTimeout, kubeconfig)
+		if err != nil {
+			log.Fatalf("Failed to get versions: %v", err)
+		}
+		available, err := utils.CachedKubernetesVersions()
+		if err != nil {
+			log.Fatalf("Failed to get available versions: %v", err)
+		}
+		fmt.Print(upgradePlan(current, available))
+	},
+}
+
+var upgradeCmdApply = &cobra.Command{
+	Use:   "apply <version>",
+	Short: "Upgrade the control plane on a master, and its kubelet",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config := loadInitConfiguration(cmd)
+		skipChecks := skippedChecksFromFlags(cmd)
+		changeHost(cmd, func(ctx context.Context) {
+			upgradeApply(ctx, config, targetVersion(args[0]), skipChecks)
+		})
+	},
+}
+
+var upgradeCmdNode = &cobra.Command{
+	Use:   "node <version>",
+	Short: "Upgrade the kubelet of a worker",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config := loadJoinConfiguration(cmd)
+		skipChecks := skippedChecksFromFlags(cmd)
+		changeHost(cmd, func(ctx context.Context) {
+			upgradeNode(ctx, config, targetVersion(args[0]), skipChecks)
+		})
+	},
+}
+
+// upgradeApply upgrades the control plane to target with kubeadm, then the
+// kubelet, kubectl, keepalived and the cluster changes of init that depend on
+// the version. The preflight checks in skipChecks are not run.
+func upgradeApply(ctx context.Context, config *apis.InitConfiguration, target string, skipChecks []string) {
+	timeouts := config.Timeouts
+	images := utils.ClusterImageConfiguration(config)
+	installed := &utils.Snapshot{}
+	runSteps(ctx, "upgrade apply", []step{
+		{"preflight", func(ctx context.Context) error {
+			return preflight.Run(ctx, []preflight.Check{
+				preflight.PrivilegedUser(),
+				versionSkewCheck(func(ctx context.Context) (string, error) {
+					current, err := getClusterVersions(ctx, timeouts.Kubectl.Duration, constants.AdminKubeconfigFile)
+					if err != nil {
+						return "", err
+					}
+					return controlPlaneSkew(current, version.MustParseSemantic(target)), nil
+				}),
+			}, skipChecks)
+		}},
+		{"load images", func(ctx context.Context) error {
+			return utils.LoadCachedImages(ctx, config.ContainerRuntime)
+		}},
+		{"install kubeadm", func(ctx context.Context) error {
+			return installKubeadm(installed, target)
+		}},
+		{"kubeadm upgrade apply", func(ctx context.Context) error {
+			return restoringKubeadm(ctx, installed, func(ctx context.Context) error {
+				return kubeadm(ctx, timeouts.Kubeadm.Duration, "upgrade", "apply", "--yes", target)
+			})
+		}},
+		{"kubelet", func(ctx context.Context) error {
+			return upgradeKubelet(ctx, target, config.Networking, config.Kubelet, images, config.ContainerRuntime, timeouts)
+		}},
+		{"vip", func(ctx context.Context) error {
+			return utils.InstallVIP(ctx, config)
+		}},
+		{"workarounds", func(ctx context.Context) error {
+			// kubeadm replaces the kube-proxy daemonset with its own
+			if err := ensureKubeProxyRespectsHostoverride(ctx, timeouts.Kubectl.Duration, utils.ResolveImage(images, constants.KubeProxyImageOf(target))); err != nil {
+				return fmt.Errorf("unable to apply workaround: %v", err)
+			}
+			return nil
+		}},
+		{"network", func(ctx context.Context) error {
+			return networkInit(ctx, config)
+		}},
+		{"wait", func(ctx context.Context) error {
+			ready := initReadiness(config.MasterConfiguration.NodeName, len(config.MasterConfiguration.Etcd.Endpoints) > 0)
+			return waitReady(ctx, ready, timeouts.Ready.Duration, timeouts.Kubectl.Duration)
+		}},
+	})
+}
+
+// upgradeNode upgrades the kubelet and kubectl of a worker to target, which
+// must not be newer than the control plane. The preflight checks in
+// skipChecks are not run.
+func upgradeNode(ctx context.Context, config *apis.JoinConfiguration, target string, skipChecks []string) {
+	timeouts := config.Timeouts
+	installed := &utils.Snapshot{}
+	runSteps(ctx, "upgrade node", []step{
+		{"preflight", func(ctx context.Context) error {
+			return preflight.Run(ctx, []preflight.Check{
+				preflight.PrivilegedUser(),
+				versionSkewCheck(func(ctx context.Context) (string, error) {
+					current, err := getClusterVersions(ctx, timeouts.Kubectl.Duration, constants.KubeletKubeconfigFile)
+					if err != nil {
+						return "", err
+					}
+					return nodeSkew(current, version.MustParseSemantic(target)), nil
+				}),
+			}, skipChecks)
+		}},
+		{"load images", func(ctx context.Context) error {
+			return utils.LoadCachedImages(ctx, config.ContainerRuntime)
+		}},
+		{"install kubeadm", func(ctx context.Context) error {
+			return installKubeadm(installed, target)
+		}},
+		{"kubeadm upgrade node", func(ctx context.Context) error {
+			return restoringKubeadm(ctx, installed, func(ctx context.Context) error {
+				if version.MustParseSemantic(target).LessThan(kubeadmUpgradeNodeVersion) {
+					log.Infof("[nodeadm] kubeadm %s keeps the kubelet configuration", target)
+					return nil
+				}
+				return kubeadm(ctx, timeouts.Kubeadm.Duration, "upgrade", "node", "config", "--kubelet-version", target)
+			})
+		}},
+		{"kubelet", func(ctx context.Context) error {
+			return upgradeKubelet(ctx, target, config.Networking, config.Kubelet, config.ImageConfiguration, config.ContainerRuntime, timeouts)
+		}},
+		{"wait", func(ctx context.Context) error {
+			node, err := constants.GetHostnameOverride()
+			if err != nil {
+				return fmt.Errorf("unable to derive node name: %v", err)
+			}
+			return waitReady(ctx, joinReadiness(node), timeouts.Ready.Duration, timeouts.Kubectl.Duration)
+		}},
+	})
+}
+
+// upgradeKubelet replaces the kubelet and kubectl with those of target, and
+// waits for the kubelet to run
+func upgradeKubelet(ctx context.Context, target string, netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, images apis.ImageConfiguration, runtimeConfig apis.ContainerRuntimeConfiguration, timeouts apis.TimeoutConfiguration) error {
+	if err := utils.UpgradeKubelet(ctx, target, netConfig, kubeletConfig, images, runtimeConfig); err != nil {
+		return err
+	}
+	if err := utils.InstallKubernetesBinaries(target, constants.KubectlFilename); err != nil {
+		return err
+	}
+	return waitKubeletActive(ctx, timeouts)
+}
+
+// installKubeadm installs the kubeadm of target, recording the installed one
+// in snapshot
+func installKubeadm(snapshot *utils.Snapshot, target string) error {
+	if err := snapshot.AddPaths(filepath.Join(constants.BaseInstallDir, constants.KubeadmFilename)); err != nil {
+		return err
+	}
+	return utils.InstallKubernetesBinaries(target, constants.KubeadmFilename)
+}
+
+// restoringKubeadm runs upgrade, and puts back the kubeadm recorded in
+// snapshot if it fails, since the cluster is still at the version of that
+// kubeadm
+func restoringKubeadm(ctx context.Context, snapshot *utils.Snapshot, upgrade func(ctx context.Context) error) error {
+	if err := upgrade(ctx); err != nil {
+		if restoreErr := snapshot.Restore(ctx); restoreErr != nil {
+			return fmt.Errorf("%v, and unable to restore kubeadm: %v", err, restoreErr)
+		}
+		return err
+	}
+	return utils.RemoveBackups()
+}
+
+func kubeadm(ctx context.Context, timeout time.Duration, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return host.Run(ctx, filepath.Join(constants.BaseInstallDir, constants.KubeadmFilename), args...)
+}
+
+// versionSkewCheck is the preflight check of an upgrade. skew returns why the
+// upgrade is not supported, or an empty string if it is.
+func versionSkewCheck(skew func(ctx context.Context) (string, error)) preflight.Check {
+	return preflight.Check{Name: "VersionSkew", Severity: preflight.Error, Run: func(ctx context.Context) error {
+		reason, err := skew(ctx)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return errors.New(reason)
+		}
+		return nil
+	}}
+}
+
+// controlPlaneSkew returns why the control plane and the kubelet of the host
+// cannot be upgraded to target, or an empty string if they can. kubeadm
+// upgrades one minor version at a time, and every kubelet must stay within
+// maxKubeletSkew minor versions of the API server.
+func controlPlaneSkew(current *clusterVersions, target *version.Version) string {
+	if !versionCached(target) {
+		return fmt.Sprintf("v%v is not in the cache, run nodeadm download of that version", target)
+	}
+	switch {
+	case target.LessThan(current.controlPlane):
+		return fmt.Sprintf("v%v is older than the control plane v%v", target, current.controlPlane)
+	case target.Major() != current.controlPlane.Major() || target.Minor() > current.controlPlane.Minor()+1:
+		return fmt.Sprintf("v%v skips a minor version after the control plane v%v", target, current.controlPlane)
+	}
+	var old []string
+	for _, node := range sortedNodes(current.kubelets) {
+		if kubelet := current.kubelets[node]; target.Minor() > kubelet.Minor()+maxKubeletSkew {
+			old = append(old, fmt.Sprintf("%s v%v", node, kubelet))
+		}
+	}
+	if len(old) > 0 {
+		return fmt.Sprintf("upgrade the kubelets of %s first, they would be more than %d minor versions older than v%v", strings.Join(old, ", "), maxKubeletSkew, target)
+	}
+	return ""
+}
+
+// nodeSkew returns why the kubelet of the host cannot be upgraded to target,
+// or an empty string if it can. A kubelet must not be newer than the API
+// server.
+func nodeSkew(current *clusterVersions, target *version.Version) string {
+	switch {
+	case !versionCached(target):
+		return fmt.Sprintf("v%v is not in the cache, run nodeadm download of that version", target)
+	case target.LessThan(current.kubelet):
+		return fmt.Sprintf("v%v is older than the kubelet v%v", target, current.kubelet)
+	case current.controlPlane.LessThan(target):
+		return fmt.Sprintf("v%v is newer than the control plane v%v, run nodeadm upgrade apply on the masters first", target, current.controlPlane)
+	}
+	return ""
+}
+
+// versionCached returns whether the binaries of v are in the cache
+func versionCached(v *version.Version) bool {
+	available, err := utils.CachedKubernetesVersions()
+	if err != nil {
+		return false
+	}
+	for _, a := range available {
+		if a.String() == v.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradePlan renders the current versions, and for each available version
+// whether upgrade apply and upgrade node support it
+func upgradePlan(current *clusterVersions, available []*version.Version) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Control plane:\tv%v\n", current.controlPlane)
+	fmt.Fprintf(w, "Kubelet of this node:\tv%v\n", current.kubelet)
+	for _, node := range sortedNodes(current.kubelets) {
+		fmt.Fprintf(w, "Kubelet of %s:\tv%v\n", node, current.kubelets[node])
+	}
+	w.Flush()
+	if len(available) == 0 {
+		fmt.Fprintf(&b, "\nNo version in %s\n", filepath.Join(constants.CacheDir, constants.KubeDirNameOf("")))
+		return b.String()
+	}
+	fmt.Fprintln(&b)
+	w = tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "AVAILABLE\tUPGRADE APPLY\tUPGRADE NODE")
+	for _, v := range available {
+		fmt.Fprintf(w, "v%v\t%s\t%s\n", v, planEntry(controlPlaneSkew(current, v)), planEntry(nodeSkew(current, v)))
+	}
+	w.Flush()
+	return b.String()
+}
+
+func planEntry(skew string) string {
+	if skew == "" {
+		return "yes"
+	}
+	return "no: " + skew
+}
+
+// getClusterVersions returns the version of the API server and of the
+// kubelets, queried with kubeconfig, and of the kubelet of the host
+func getClusterVersions(ctx context.Context, timeout time.Duration, kubeconfig string) (*clusterVersions, error) {
+	versions := &clusterVersions{kubelets: make(map[string]*version.Version)}
+	var err error
+	if versions.controlPlane, err = controlPlaneVersion(ctx, timeout, kubeconfig); err != nil {
+		return nil, err
+	}
+	var nodes corev1.NodeList
+	if err := kubectlGet(ctx, timeout, kubeconfig, &nodes, "nodes"); err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %v", err)
+	}
+	for _, node := range nodes.Items {
+		v, err := version.ParseSemantic(node.Status.NodeInfo.KubeletVersion)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse kubelet version of node %s: %v", node.Name, err)
+		}
+		versions.kubelets[node.Name] = v
+	}
+	if versions.kubelet, err = kubeletVersion(ctx, timeout); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// controlPlaneVersion returns the version of the API server
+func controlPlaneVersion(ctx context.Context, timeout time.Duration, kubeconfig string) (*version.Version, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err := host.Output(ctx, filepath.Join(constants.BaseInstallDir, constants.KubectlFilename), "--kubeconfig="+kubeconfig, "version", "--output=json")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get control plane version: %v", err)
+	}
+	var versions struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := json.Unmarshal(out, &versions); err != nil {
+		return nil, fmt.Errorf("unable to decode kubectl version: %v", err)
+	}
+	v, err := version.ParseSemantic(versions.ServerVersion.GitVersion)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse control plane version: %v", err)
+	}
+	return v, nil
+}
+
+// kubeletVersion returns the version of the installed kubelet
+func kubeletVersion(ctx context.Context, timeout time.Duration) (*version.Version, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err := host.Output(ctx, filepath.Join(constants.BaseInstallDir, constants.KubeletFilename), "--version")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get kubelet version: %v", err)
+	}
+	// The output is "Kubernetes v1.10.11"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no kubelet version")
+	}
+	v, err := version.ParseSemantic(fields[len(fields)-1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse kubelet version: %v", err)
+	}
+	return v, nil
+}
+
+// targetVersion returns the version to upgrade to, prefixed with v as the
+// directories of the cache, and exits if it is invalid
+func targetVersion(arg string) string {
+	v, err := version.ParseSemantic(arg)
+	if err != nil {
+		log.Fatalf("Invalid version %q: %v", arg, err)
+	}
+	return "v" + v.String()
+}
+
+func sortedNodes(kubelets map[string]*version.Version) []string {
+	var nodes []string
+	for node := range kubelets {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+	upgradeCmd.AddCommand(upgradeCmdPlan, upgradeCmdApply, upgradeCmdNode)
+	for _, cmd := range []*cobra.Command{upgradeCmdApply, upgradeCmdNode} {
+		cmd.Flags().String("cfg", "", "Location of configuration file")
+		addLockFlags(cmd)
+		addDryRunFlag(cmd)
+		addPreflightFlag(cmd)
+	}
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/utils"
+	"k8s.io/kubernetes/pkg/util/version"
+)
+
+// cacheVersion adds the binaries of a Kubernetes version to the cache
+func (h *fakeHost) cacheVersion(t *testing.T, v string) {
+	for _, name := range []string{constants.KubeadmFilename, constants.KubeletFilename, constants.KubectlFilename} {
+		h.writeFile(t, filepath.Join(constants.CacheDir, constants.KubeDirNameOf(v), name), "fake "+name+" "+v+"\n")
+	}
+}
+
+// runVersions sets the versions of the control plane, of the kubelets and of
+// the kubelet of the host, queried with kubeconfig
+func (h *fakeHost) runVersions(kubeconfig, controlPlane, kubelet string) {
+	kubectl := "/opt/bin/kubectl --kubeconfig=" + kubeconfig
+	h.executor.Responses[kubectl+" version"] = host.FakeResponse{Stdout: `{"serverVersion": {"gitVersion": "` + controlPlane + `"}}`}
+	h.executor.Responses[kubectl+" get nodes"] = host.FakeResponse{
+		Stdout: `{"items": [{"metadata": {"name": "master"}, "status": {"nodeInfo": {"kubeletVersion": "` + controlPlane + `"}}}]}`,
+	}
+	h.executor.Responses["/opt/bin/kubelet --version"] = host.FakeResponse{Stdout: "Kubernetes " + kubelet + "\n"}
+}
+
+func TestControlPlaneSkew(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	for _, v := range []string{"v1.10.12", "v1.11.5", "v1.12.3", "v1.9.11"} {
+		h.cacheVersion(t, v)
+	}
+	current := &clusterVersions{
+		controlPlane: version.MustParseSemantic("v1.10.11"),
+		kubelets: map[string]*version.Version{
+			"master":  version.MustParseSemantic("v1.10.11"),
+			"worker1": version.MustParseSemantic("v1.9.11"),
+		},
+		kubelet: version.MustParseSemantic("v1.10.11"),
+	}
+	for _, test := range []struct {
+		target string
+		reason string
+	}{
+		{"v1.10.12", ""},
+		{"v1.11.5", ""},
+		{"v1.12.3", "skips a minor version"},
+		{"v1.9.11", "older than the control plane"},
+		{"v1.11.6", "not in the cache"},
+	} {
+		reason := controlPlaneSkew(current, version.MustParseSemantic(test.target))
+		if test.reason == "" && reason != "" || !strings.Contains(reason, test.reason) {
+			t.Errorf("upgrade apply %s: got %q, expected %q", test.target, reason, test.reason)
+		}
+	}
+
+	current.controlPlane = version.MustParseSemantic("v1.11.5")
+	if reason := controlPlaneSkew(current, version.MustParseSemantic("v1.12.3")); !strings.Contains(reason, "worker1 v1.9.11") {
+		t.Errorf("expected worker1 to be too old, got %q", reason)
+	}
+	if reason := nodeSkew(current, version.MustParseSemantic("v1.11.5")); reason != "" {
+		t.Errorf("upgrade node to the control plane version: got %q", reason)
+	}
+	if reason := nodeSkew(current, version.MustParseSemantic("v1.12.3")); !strings.Contains(reason, "newer than the control plane") {
+		t.Errorf("upgrade node past the control plane: got %q", reason)
+	}
+}
+
+func TestUpgradeApply(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	h.executor.Commands = nil
+	h.cacheVersion(t, "v1.11.5")
+	h.runVersions(constants.AdminKubeconfigFile, "v1.10.11", "v1.10.11")
+	upgradeApply(context.Background(), initConfiguration(t), "v1.11.5", nil)
+	assertGolden(t, "upgrade-apply", h.state(t))
+}
+
+func TestUpgradeApplyConfigFile(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	initNode(context.Background(), initConfiguration(t), phaseOptions{})
+	h.cacheVersion(t, "v1.11.5")
+	h.runVersions(constants.AdminKubeconfigFile, "v1.10.11", "v1.10.11")
+	upgradeApply(context.Background(), initConfiguration(t), "v1.11.5", nil)
+	h.executor.Commands = nil
+	h.cacheVersion(t, "v1.12.3")
+	h.runVersions(constants.AdminKubeconfigFile, "v1.11.5", "v1.11.5")
+	upgradeApply(context.Background(), initConfiguration(t), "v1.12.3", nil)
+	state := h.state(t)
+	// kubelet v1.12 fails on --cadvisor-port, and reads the configuration
+	// kubeadm writes
+	if strings.Contains(state, "--cadvisor-port") || !strings.Contains(state, "--config=/var/lib/kubelet/config.yaml") {
+		t.Errorf("the kubelet units are not those of v1.12")
+	}
+	assertGolden(t, "upgrade-apply-v1.12", state)
+}
+
+func TestUpgradeRestoresKubeadm(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.writeFile(t, "/opt/bin/kubeadm", "fake kubeadm v1.10.11\n")
+	h.cacheVersion(t, "v1.11.5")
+	installed := &utils.Snapshot{}
+	if err := installKubeadm(installed, "v1.11.5"); err != nil {
+		t.Fatal(err)
+	}
+	err := restoringKubeadm(context.Background(), installed, func(ctx context.Context) error {
+		return errors.New("upgrade failed")
+	})
+	if err == nil || err.Error() != "upgrade failed" {
+		t.Errorf("expected the upgrade to fail, got %v", err)
+	}
+	kubeadm, err := ioutil.ReadFile(host.Path("/opt/bin/kubeadm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(kubeadm) != "fake kubeadm v1.10.11\n" {
+		t.Errorf("expected the kubeadm of the cluster version to be restored, got %q", kubeadm)
+	}
+}
+
+func TestUpgradeNode(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	joinNode(context.Background(), joinConfiguration(t), "abcdef.0123456789abcdef", "192.168.10.10:6443", "sha256:0123", phaseOptions{})
+	h.executor.Commands = nil
+	h.cacheVersion(t, "v1.11.5")
+	h.runVersions(constants.KubeletKubeconfigFile, "v1.11.5", "v1.10.11")
+	upgradeNode(context.Background(), joinConfiguration(t), "v1.11.5", nil)
+	assertGolden(t, "upgrade-node", h.state(t))
+}
+
+func TestUpgradePlan(t *testing.T) {
+	h := newFakeHost(t)
+	defer h.restore()
+	h.cacheVersion(t, "v1.11.5")
+	h.runVersions(constants.AdminKubeconfigFile, "v1.10.11", "v1.10.11")
+	current, err := getClusterVersions(context.Background(), time.Minute, constants.AdminKubeconfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := upgradePlan(current, []*version.Version{version.MustParseSemantic("v1.11.5")})
+	for _, expected := range []string{
+		"Control plane:         v1.10.11",
+		"Kubelet of master:     v1.10.11",
+		"v1.11.5    yes            no: v1.11.5 is newer than the control plane v1.10.11",
+	} {
+		if !strings.Contains(plan, expected) {
+			t.Errorf("plan does not contain %q:\n%s", expected, plan)
+		}
+	}
+}
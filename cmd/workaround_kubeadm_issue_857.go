@@ -1,10 +1,8 @@
 package cmd
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -12,6 +10,7 @@ import (
 	log "github.com/platform9/nodeadm/pkg/logrus"
 
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
 )
 
 const (
@@ -83,18 +82,22 @@ const (
 // EnsureKubeProxyRespectsHostoverride patches the kube-proxy daemonset so that
 // kube-proxy respects the hostnameOverride setting. The function is idempotent.
 // See: https://github.com/kubernetes/kubeadm/issues/857
-func ensureKubeProxyRespectsHostoverride() error {
+func ensureKubeProxyRespectsHostoverride(ctx context.Context, timeout time.Duration, kubeProxyImage string) error {
 	log.Infoln("[workarounds] Checking whether kube-proxy daemonset is patched")
-	patched, err := isPatchedKubeProxyDaemonSet()
-	if err != nil {
-		return fmt.Errorf("unable to check if kube-proxy daemonset is patched: %v", err)
+	// A dry run cannot query a cluster that kubeadm has not created yet
+	patched := false
+	if !host.Planning() {
+		var err error
+		if patched, err = isPatchedKubeProxyDaemonSet(ctx, timeout); err != nil {
+			return fmt.Errorf("unable to check if kube-proxy daemonset is patched: %v", err)
+		}
 	}
 	if patched {
 		log.Infoln("[workarounds] Kube-proxy daemonset already patched. Continuing. ")
 		return nil
 	}
 	log.Infoln("[workarounds] Patching kube-proxy daemonset")
-	err = patchKubeProxyDaemonSet()
+	err := patchKubeProxyDaemonSet(ctx, timeout, kubeProxyImage)
 	if err != nil {
 		return fmt.Errorf("unable to patch kube-proxy daemonset: %v", err)
 	}
@@ -102,43 +105,37 @@ func ensureKubeProxyRespectsHostoverride() error {
 	return nil
 }
 
-func isPatchedKubeProxyDaemonSet() (bool, error) {
+func isPatchedKubeProxyDaemonSet(ctx context.Context, timeout time.Duration) (bool, error) {
 	name := "/bin/sh"
 	// If this field was changed, we assume the patch was applied. Because the
 	// entire patch applies or is rejected, we can infer that the other fields
 	// were updated as expected. We assume the daemonset was not edited by hand.
 	arg := fmt.Sprintf("%s --kubeconfig=%s --namespace=kube-system get daemonset kube-proxy -ojsonpath='{.spec.template.spec.containers[0].command[1]}'", filepath.Join(constants.BaseInstallDir, constants.KubectlFilename), constants.AdminKubeconfigFile)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	var stdout, stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, name, "-c", arg)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return false, fmt.Errorf("error running %q: %v (stdout: %s) (stderr: %s)", strings.Join(cmd.Args, " "), err, string(stdout.Bytes()), string(stderr.Bytes()))
+	stdout, err := host.Output(ctx, name, "-c", arg)
+	if err != nil {
+		return false, err
 	}
 
-	if strings.Compare(string(stdout.Bytes()), resultIfPatched) == 0 {
+	if strings.Compare(string(stdout), resultIfPatched) == 0 {
 		return true, nil
 	}
 	return false, nil
 }
 
-func patchKubeProxyDaemonSet() error {
-	patchWithKubeProxyVersion := fmt.Sprintf(patchTemplate, fmt.Sprintf("k8s.gcr.io/kube-proxy-amd64:%s", constants.KubernetesVersion))
+// kubeProxyPatch renders the JSON patch of the kube-proxy daemonset
+func kubeProxyPatch(kubeProxyImage string) string {
+	return fmt.Sprintf(patchTemplate, kubeProxyImage)
+}
+
+func patchKubeProxyDaemonSet(ctx context.Context, timeout time.Duration, kubeProxyImage string) error {
+	patchWithKubeProxyVersion := kubeProxyPatch(kubeProxyImage)
 	name := "/bin/sh"
 	arg := fmt.Sprintf("%s --kubeconfig=%s --namespace=kube-system patch --type=json daemonset kube-proxy --patch='%s'", filepath.Join(constants.BaseInstallDir, constants.KubectlFilename), constants.AdminKubeconfigFile, patchWithKubeProxyVersion)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	var stdout, stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, name, "-c", arg)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error running %q: %v (stdout: %s) (stderr: %s)", strings.Join(cmd.Args, " "), err, string(stdout.Bytes()), string(stderr.Bytes()))
-	}
-
-	return nil
+	return host.Run(ctx, name, "-c", arg)
 }
@@ -3,6 +3,7 @@ package constants
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 
 	netutil "k8s.io/apimachinery/pkg/util/net"
 )
@@ -24,11 +25,17 @@ const (
 	KubeadmConfig                         = "/tmp/kubeadm.yaml"
 	KubeDNSVersion                        = "1.14.8"
 	KeepalivedImage                       = "platform9/keepalived:v2.0.4"
+	PauseImage                            = "k8s.gcr.io/pause-amd64:3.1"
 	CacheDir                              = "/var/cache/nodeadm/"
+	DefaultRegistryPort                   = 5000
+	DefaultPullSecretName                 = "nodeadm-registry-auth"
 	Execute                               = 0744
 	Read                                  = 0644
 	FeatureGates                          = "ExperimentalCriticalPodAnnotation=true"
 	Sysctl                                = "/sbin/sysctl"
+	Modprobe                              = "/sbin/modprobe"
+	Swapoff                               = "/sbin/swapoff"
+	Swapon                                = "/sbin/swapon"
 	ControllerManagerAllocateNodeCIDRsKey = "allocate-node-cidrs"
 	ControllerManagerClusterCIDRKey       = "cluster-cidr"
 	ControllerManagerNodeCIDRMaskSizeKey  = "node-cidr-mask-size"
@@ -43,6 +50,16 @@ const (
 	KubeletConfigKubeReservedCPUKey    = "cpu"
 )
 
+const (
+	ContainerRuntimeDocker     = "docker"
+	ContainerRuntimeContainerd = "containerd"
+	ContainerRuntimeCRIO       = "cri-o"
+	DefaultContainerdEndpoint  = "unix:///run/containerd/containerd.sock"
+	DefaultCRIOEndpoint        = "unix:///var/run/crio/crio.sock"
+	CgroupDriverCgroupfs       = "cgroupfs"
+	CgroupDriverSystemd        = "systemd"
+)
+
 const (
 	VRRPScriptInterval = 10
 	VRRPScriptRise     = 2
@@ -50,11 +67,72 @@ const (
 	WgetTimeout        = 8
 )
 
-var KubeDirName = filepath.Join("kubernetes", KubernetesVersion)
+// Default timeouts of the operations in TimeoutConfiguration
+const (
+	DefaultDownloadTimeout    = 10 * time.Minute
+	DefaultImagePullTimeout   = 10 * time.Minute
+	DefaultKubeadmTimeout     = 10 * time.Minute
+	DefaultKubectlTimeout     = 2 * time.Minute
+	DefaultUnitActiveTimeout  = 2 * time.Minute
+	DefaultRestartLoopTimeout = time.Minute
+	DefaultReadyTimeout       = 5 * time.Minute
+)
+
+const (
+	// LockFile is locked by every command that changes the host
+	LockFile = "/var/run/nodeadm.lock"
+	// DefaultLockWaitTimeout is how long --wait waits for the lock
+	DefaultLockWaitTimeout = 10 * time.Minute
+	// StateFile records the phases of init or join that completed
+	StateFile = "/var/lib/nodeadm/state.json"
+	// BackupDir holds copies of the files the phases of init and join change,
+	// so that they can be rolled back
+	BackupDir = "/var/lib/nodeadm/backup"
+	// ManifestsDir is where nodeadm render places the manifests init applies
+	// to the cluster
+	ManifestsDir = "/etc/nodeadm/manifests"
+	// KubeProxyPatchFilename is the JSON patch of the kube-proxy daemonset
+	KubeProxyPatchFilename = "kube-proxy-patch.json"
+	// JoinInfoFile holds what nodes need to join the cluster, written by init
+	JoinInfoFile = "/etc/nodeadm/join.json"
+	// CACertFile is the certificate of the cluster CA, written by kubeadm
+	CACertFile = "/etc/kubernetes/pki/ca.crt"
+	// NodeadmInstallPath is where init installs the nodeadm that runs the
+	// local registry
+	NodeadmInstallPath = "/opt/bin/nodeadm"
+	// DefaultTokenTTL is how long nodeadm token create tokens are valid, as
+	// kubeadm's
+	DefaultTokenTTL = 24 * time.Hour
+)
+
+// Files of the host preparation
+const (
+	// ModulesLoadFile lists the kernel modules loaded on boot
+	ModulesLoadFile = "/etc/modules-load.d/nodeadm.conf"
+	// SysctlFile holds the sysctls set on boot
+	SysctlFile = "/etc/sysctl.d/99-nodeadm.conf"
+	// FstabFile is edited to keep swap off
+	FstabFile = "/etc/fstab"
+	// FstabSwapComment prefixes the swap entries of FstabFile commented out
+	// by nodeadm, so that reset can restore them
+	FstabSwapComment = "#nodeadm-swap# "
+	// DefaultConntrackMax is the default of net.netfilter.nf_conntrack_max,
+	// the minimum kube-proxy sets
+	DefaultConntrackMax = 131072
+)
+
+// KernelModules are loaded by init and join. br_netfilter lets iptables
+// filter bridged pod traffic; nf_conntrack provides the conntrack sysctls.
+var KernelModules = []string{"br_netfilter", "nf_conntrack"}
+
+var KubeDirName = KubeDirNameOf(KubernetesVersion)
 var FlannelDirName = filepath.Join("flannel", FlannelVersion)
 var CNIDirName = filepath.Join("cni", CNIVersion)
 var CniVersionInstallDir = filepath.Join(CNIBaseDir, CNIVersion)
+var FlannelImage = fmt.Sprintf("quay.io/coreos/flannel:%s-amd64", FlannelVersion)
+var KubeProxyImage = KubeProxyImageOf(KubernetesVersion)
 var ImagesCacheDir = filepath.Join(CacheDir, "images")
+var RegistryCacheDir = filepath.Join(CacheDir, "registry")
 
 const (
 	KubeadmFilename                     = "kubeadm"
@@ -64,21 +142,79 @@ const (
 	KubeadmKubeletSystemdDropinFilename = "10-kubeadm.conf"
 	FlannelManifestFilename             = "kube-flannel.yml"
 	AdminKubeconfigFile                 = "/etc/kubernetes/admin.conf"
+	KubeletKubeconfigFile               = "/etc/kubernetes/kubelet.conf"
+	KubeletBootstrapKubeconfigFile      = "/etc/kubernetes/bootstrap-kubelet.conf"
+	KubeProxyDaemonSet                  = "kube-proxy"
+	FlannelDaemonSet                    = "kube-flannel-ds"
 	KeepalivedConfigFilename            = "/etc/keepalived/keepalived.conf"
+	RegistrySystemdUnitFilename         = "nodeadm-registry.service"
 )
 
 var CNIPluginsFilename = fmt.Sprintf("cni-plugins-amd64-%s.tgz", CNIVersion)
 
+const (
+	// Based on https://github.com/kubernetes/kubernetes/blob/v1.10.11/build/debs/kubelet.service
+	KubeletSystemdUnitTemplate = `[Unit]
+Description=kubelet: The Kubernetes Node Agent
+Documentation=http://kubernetes.io/docs/
+
+[Service]
+ExecStart={{ .Kubelet }}
+Restart=always
+StartLimitInterval=0
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+`
+	// Based on https://github.com/kubernetes/kubernetes/blob/v1.10.11/build/debs/10-kubeadm.conf
+	KubeadmKubeletSystemdDropinTemplate = `[Service]
+Environment="KUBELET_KUBECONFIG_ARGS=--bootstrap-kubeconfig=/etc/kubernetes/bootstrap-kubelet.conf --kubeconfig=/etc/kubernetes/kubelet.conf"
+Environment="KUBELET_SYSTEM_PODS_ARGS=--pod-manifest-path=/etc/kubernetes/manifests --allow-privileged=true"
+Environment="KUBELET_NETWORK_ARGS=--network-plugin=cni --cni-conf-dir={{ .CNIConfigDir }}/net.d --cni-bin-dir={{ .CNIBinDir }}"
+Environment="KUBELET_DNS_ARGS=--cluster-dns=10.96.0.10 --cluster-domain=cluster.local"
+Environment="KUBELET_AUTHZ_ARGS=--authorization-mode=Webhook --client-ca-file=/etc/kubernetes/pki/ca.crt"
+Environment="KUBELET_CADVISOR_ARGS=--cadvisor-port=0"
+Environment="KUBELET_CERTIFICATE_ARGS=--rotate-certificates=true --cert-dir=/var/lib/kubelet/pki"
+ExecStart=
+ExecStart={{ .Kubelet }} $KUBELET_KUBECONFIG_ARGS $KUBELET_SYSTEM_PODS_ARGS $KUBELET_NETWORK_ARGS $KUBELET_DNS_ARGS $KUBELET_AUTHZ_ARGS $KUBELET_CADVISOR_ARGS $KUBELET_CERTIFICATE_ARGS $KUBELET_EXTRA_ARGS
+`
+	// Based on https://github.com/kubernetes/kubernetes/blob/v1.12.3/build/debs/10-kubeadm.conf,
+	// the same since v1.11. kubeadm init, join and upgrade apply write the
+	// flags file, but upgrade node config does not, so the CNI directories of
+	// nodeadm are kept.
+	KubeadmKubeletConfigFileSystemdDropinTemplate = `[Service]
+Environment="KUBELET_KUBECONFIG_ARGS=--bootstrap-kubeconfig=/etc/kubernetes/bootstrap-kubelet.conf --kubeconfig=/etc/kubernetes/kubelet.conf"
+Environment="KUBELET_CONFIG_ARGS=--config=/var/lib/kubelet/config.yaml"
+Environment="KUBELET_NETWORK_ARGS=--network-plugin=cni --cni-conf-dir={{ .CNIConfigDir }}/net.d --cni-bin-dir={{ .CNIBinDir }}"
+EnvironmentFile=-/var/lib/kubelet/kubeadm-flags.env
+EnvironmentFile=-/etc/default/kubelet
+ExecStart=
+ExecStart={{ .Kubelet }} $KUBELET_KUBECONFIG_ARGS $KUBELET_CONFIG_ARGS $KUBELET_NETWORK_ARGS $KUBELET_KUBEADM_ARGS $KUBELET_EXTRA_ARGS
+`
+)
+
 const (
 	// TODO(dlipovetsky) Move fields to configuration
 	KubeletEvictionHard                 = "memory.available<600Mi,nodefs.available<10%"
 	NodeadmKubeletSystemdDropinFilename = "20-nodeadm.conf"
 	NodeadmKubeletSystemdDropinTemplate = `[Service]
 Environment="KUBELET_DNS_ARGS=--cluster-dns={{ .ClusterDNS }} --cluster-domain={{ .ClusterDomain }}"
-Environment="KUBELET_EXTRA_ARGS=--max-pods={{ .MaxPods }} --fail-swap-on={{ .FailSwapOn }} --hostname-override={{ .HostnameOverride }} --kube-api-qps={{ .KubeAPIQPS }} --kube-api-burst={{ .KubeAPIBurst }} --feature-gates={{ .FeatureGates}} --eviction-hard={{ .EvictionHard }} --cpu-manager-policy={{ .CPUManagerPolicy }} --kube-reserved={{ .KubeReservedCPU }}"
+Environment="KUBELET_EXTRA_ARGS=--max-pods={{ .MaxPods }} --fail-swap-on={{ .FailSwapOn }} --hostname-override={{ .HostnameOverride }} --kube-api-qps={{ .KubeAPIQPS }} --kube-api-burst={{ .KubeAPIBurst }} --feature-gates={{ .FeatureGates}} --eviction-hard={{ .EvictionHard }} --cpu-manager-policy={{ .CPUManagerPolicy }} --kube-reserved={{ .KubeReservedCPU }} --pod-infra-container-image={{ .PodInfraImage }} {{ .RuntimeArgs }}"
 `
 )
 
+// KubeDirNameOf returns the directory of the Kubernetes binaries of version,
+// relative to CacheDir
+func KubeDirNameOf(version string) string {
+	return filepath.Join("kubernetes", version)
+}
+
+// KubeProxyImageOf returns the kube-proxy image of version
+func KubeProxyImageOf(version string) string {
+	return fmt.Sprintf("k8s.gcr.io/kube-proxy-amd64:%s", version)
+}
+
 func GetHostnameOverride() (string, error) {
 	defaultIP, err := netutil.ChooseHostInterface()
 	if err != nil {
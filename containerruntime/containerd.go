@@ -0,0 +1,176 @@
+package containerruntime
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+)
+
+// k8sNamespace is the containerd namespace of the images used by the kubelet
+const k8sNamespace = "k8s.io"
+
+const (
+	dockerHubDomain       = "docker.io"
+	legacyDockerHubDomain = "index.docker.io"
+)
+
+type containerd struct {
+	endpoint     string
+	cgroupDriver string
+}
+
+func newContainerd(config apis.ContainerRuntimeConfiguration) *containerd {
+	return &containerd{endpoint: config.Endpoint, cgroupDriver: config.CgroupDriver}
+}
+
+func (c *containerd) ctr(args ...string) []string {
+	return append([]string{"--address", strings.TrimPrefix(c.endpoint, "unix://"), "--namespace", k8sNamespace}, args...)
+}
+
+// normalizeImage returns the fully qualified reference ctr requires, e.g.
+// "platform9/keepalived:v2.0.4" becomes "docker.io/platform9/keepalived:v2.0.4".
+// It follows reference.ParseNormalizedNamed, which the vendored
+// docker/distribution predates, and adds the "latest" tag to untagged names.
+func normalizeImage(image string) (string, error) {
+	named, err := reference.ParseNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %v", image, err)
+	}
+	domain, remainder := dockerHubDomain, named.Name()
+	if i := strings.Index(remainder, "/"); i >= 0 {
+		if first := remainder[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			domain, remainder = first, remainder[i+1:]
+		}
+	}
+	if strings.ToLower(remainder) != remainder {
+		return "", fmt.Errorf("invalid image reference %q: repository name must be lowercase", image)
+	}
+	if domain == legacyDockerHubDomain {
+		domain = dockerHubDomain
+	}
+	if domain == dockerHubDomain && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	normalized := domain + "/" + remainder
+	tagged, isTagged := named.(reference.Tagged)
+	digested, isDigested := named.(reference.Digested)
+	if isTagged {
+		normalized += ":" + tagged.Tag()
+	}
+	if isDigested {
+		normalized += "@" + digested.Digest().String()
+	}
+	if !isTagged && !isDigested {
+		normalized += ":latest"
+	}
+	return normalized, nil
+}
+
+// normalizeImages normalizes every image of a ctr command
+func normalizeImages(images ...string) ([]string, error) {
+	normalized := make([]string, len(images))
+	for i, image := range images {
+		var err error
+		if normalized[i], err = normalizeImage(image); err != nil {
+			return nil, err
+		}
+	}
+	return normalized, nil
+}
+
+func (c *containerd) Name() string {
+	return constants.ContainerRuntimeContainerd
+}
+
+func (c *containerd) Service() string {
+	return "containerd.service"
+}
+
+func (c *containerd) Endpoint() string {
+	return c.endpoint
+}
+
+func (c *containerd) CgroupDriver() (string, error) {
+	return c.cgroupDriver, nil
+}
+
+func (c *containerd) ImagePresent(ctx context.Context, image string) (bool, error) {
+	name, err := normalizeImage(image)
+	if err != nil {
+		return false, imageError("list", err, image)
+	}
+	out, err := output(ctx, "ctr", c.ctr("images", "list", "--quiet", "name=="+name)...)
+	if err != nil {
+		return false, imageError("list", err, image)
+	}
+	return strings.TrimSpace(out) != "", nil
+}
+
+func (c *containerd) PullImage(ctx context.Context, image string, auth *types.AuthConfig) error {
+	name, err := normalizeImage(image)
+	if err != nil {
+		return imageError("pull", err, image)
+	}
+	args := []string{"images", "pull"}
+	if auth != nil {
+		args = append(args, "--user", credentials(auth))
+	}
+	return imageError("pull", pull(ctx, auth, "ctr", c.ctr(append(args, name)...)...), image)
+}
+
+func (c *containerd) TagImage(ctx context.Context, source, target string) error {
+	names, err := normalizeImages(source, target)
+	if err != nil {
+		return imageError("tag", err, source)
+	}
+	return imageError("tag", run(ctx, "ctr", c.ctr("images", "tag", "--force", names[0], names[1])...), source)
+}
+
+func (c *containerd) ImportImages(ctx context.Context, file string) error {
+	return imageError("import", run(ctx, "ctr", c.ctr("images", "import", file)...), file)
+}
+
+func (c *containerd) ExportImages(ctx context.Context, file string, images ...string) error {
+	names, err := normalizeImages(images...)
+	if err != nil {
+		return imageError("export", err, images...)
+	}
+	err = exportFile(file, func(tmp string) error {
+		return run(ctx, "ctr", c.ctr(append([]string{"images", "export", tmp}, names...)...)...)
+	})
+	return imageError("export", err, images...)
+}
+
+func (c *containerd) RemoveImage(ctx context.Context, image string) error {
+	name, err := normalizeImage(image)
+	if err != nil {
+		return imageError("remove", err, image)
+	}
+	return imageError("remove", run(ctx, "ctr", c.ctr("images", "remove", name)...), image)
+}
+
+func (c *containerd) ServiceUnit(spec ContainerSpec) string {
+	ctr := "/usr/bin/ctr " + strings.Join(c.ctr(), " ")
+	args := []string{ctr, "run", "--rm", "--net-host"}
+	if len(spec.Capabilities) != 0 {
+		// ctr cannot add individual capabilities
+		args = append(args, "--privileged")
+	}
+	for _, mount := range spec.Mounts {
+		args = append(args, "--mount", "type=bind,src="+mount.Source+",dst="+mount.Destination+",options=rbind:ro")
+	}
+	image, err := normalizeImage(spec.Image)
+	if err != nil {
+		// Rendering cannot fail; ctr reports the invalid reference when the unit starts
+		image = spec.Image
+	}
+	args = append(args, image, spec.Name)
+	return serviceUnit(spec, c.Service(), strings.Join(args, " "),
+		[]string{ctr + " tasks kill --signal SIGKILL " + spec.Name, ctr + " containers delete " + spec.Name},
+		[]string{ctr + " tasks kill " + spec.Name})
+}
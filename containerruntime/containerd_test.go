@@ -0,0 +1,90 @@
+package containerruntime
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		image, expected string
+	}{
+		{"busybox", "docker.io/library/busybox:latest"},
+		{"busybox:1.28", "docker.io/library/busybox:1.28"},
+		{"platform9/keepalived:v2.0.4", "docker.io/platform9/keepalived:v2.0.4"},
+		{"docker.io/platform9/keepalived:v2.0.4", "docker.io/platform9/keepalived:v2.0.4"},
+		{"index.docker.io/metallb/speaker:master", "docker.io/metallb/speaker:master"},
+		{"k8s.gcr.io/pause-amd64:3.1", "k8s.gcr.io/pause-amd64:3.1"},
+		{"localhost/pause", "localhost/pause:latest"},
+		{"mirror.example.com:5000/coreos/flannel:v0.10.0-amd64", "mirror.example.com:5000/coreos/flannel:v0.10.0-amd64"},
+		{"busybox@sha256:" + strings.Repeat("0", 64), "docker.io/library/busybox@sha256:" + strings.Repeat("0", 64)},
+	}
+	for _, tt := range tests {
+		normalized, err := normalizeImage(tt.image)
+		if err != nil {
+			t.Errorf("normalizeImage(%q) failed: %v", tt.image, err)
+			continue
+		}
+		if normalized != tt.expected {
+			t.Errorf("normalizeImage(%q) = %q, expected %q", tt.image, normalized, tt.expected)
+		}
+	}
+	for _, image := range []string{"", "Platform9/keepalived", "keepalived:"} {
+		if _, err := normalizeImage(image); err == nil {
+			t.Errorf("normalizeImage(%q) succeeded, expected an error", image)
+		}
+	}
+}
+
+func TestContainerdShortNames(t *testing.T) {
+	executor := host.NewFakeExecutor()
+	defer host.SetExecutor(host.SetExecutor(executor))
+	c := newContainerd(apis.ContainerRuntimeConfiguration{Endpoint: "unix:///run/containerd/containerd.sock"})
+	ctx := context.Background()
+
+	if _, err := c.ImagePresent(ctx, "platform9/keepalived:v2.0.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PullImage(ctx, "platform9/keepalived:v2.0.4", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TagImage(ctx, "platform9/keepalived:v2.0.4", "mirror.example.com/keepalived:v2.0.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveImage(ctx, "busybox"); err != nil {
+		t.Fatal(err)
+	}
+	ctr := "ctr --address /run/containerd/containerd.sock --namespace k8s.io "
+	expected := []string{
+		ctr + "images list --quiet name==docker.io/platform9/keepalived:v2.0.4",
+		ctr + "images pull docker.io/platform9/keepalived:v2.0.4",
+		ctr + "images tag --force docker.io/platform9/keepalived:v2.0.4 mirror.example.com/keepalived:v2.0.4",
+		ctr + "images remove docker.io/library/busybox:latest",
+	}
+	if !reflect.DeepEqual(executor.Commands, expected) {
+		t.Errorf("ran %q, expected %q", executor.Commands, expected)
+	}
+
+	unit := c.ServiceUnit(ContainerSpec{Name: "vip", Description: "Keepalived service", Image: "platform9/keepalived:v2.0.4"})
+	if !strings.Contains(unit, " docker.io/platform9/keepalived:v2.0.4 vip\n") {
+		t.Errorf("unit does not run the normalized image:\n%s", unit)
+	}
+}
+
+func TestContainerdPullHidesCredentials(t *testing.T) {
+	executor := host.NewFakeExecutor()
+	defer host.SetExecutor(host.SetExecutor(executor))
+	executor.Responses["ctr"] = host.FakeResponse{Err: errors.New("unauthorized")}
+	c := newContainerd(apis.ContainerRuntimeConfiguration{Endpoint: "unix:///run/containerd/containerd.sock"})
+	err := c.PullImage(context.Background(), "mirror.example.com/pause:3.1", &types.AuthConfig{Username: "admin", Password: "s3cret"})
+	if err == nil || strings.Contains(err.Error(), "s3cret") || !strings.Contains(err.Error(), "--user <redacted>") {
+		t.Errorf("expected the failed pull without the credentials, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package containerruntime
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+)
+
+// crio manages images through crictl, and uses podman, which shares the image
+// store of CRI-O, for what the CRI does not cover.
+type crio struct {
+	endpoint     string
+	cgroupDriver string
+}
+
+func newCRIO(config apis.ContainerRuntimeConfiguration) *crio {
+	return &crio{endpoint: config.Endpoint, cgroupDriver: config.CgroupDriver}
+}
+
+func (c *crio) crictl(args ...string) []string {
+	return append([]string{"--runtime-endpoint", c.endpoint, "--image-endpoint", c.endpoint}, args...)
+}
+
+func (c *crio) Name() string {
+	return constants.ContainerRuntimeCRIO
+}
+
+func (c *crio) Service() string {
+	return "crio.service"
+}
+
+func (c *crio) Endpoint() string {
+	return c.endpoint
+}
+
+func (c *crio) CgroupDriver() (string, error) {
+	return c.cgroupDriver, nil
+}
+
+func (c *crio) ImagePresent(ctx context.Context, image string) (bool, error) {
+	out, err := output(ctx, "crictl", c.crictl("images", "--quiet", image)...)
+	if err != nil {
+		return false, imageError("list", err, image)
+	}
+	return strings.TrimSpace(out) != "", nil
+}
+
+func (c *crio) PullImage(ctx context.Context, image string, auth *types.AuthConfig) error {
+	args := []string{"pull"}
+	if auth != nil {
+		args = append(args, "--creds", credentials(auth))
+	}
+	return imageError("pull", pull(ctx, auth, "crictl", c.crictl(append(args, image)...)...), image)
+}
+
+func (c *crio) TagImage(ctx context.Context, source, target string) error {
+	return imageError("tag", run(ctx, "podman", "tag", source, target), source)
+}
+
+func (c *crio) ImportImages(ctx context.Context, file string) error {
+	return imageError("import", run(ctx, "podman", "load", "--input", file), file)
+}
+
+func (c *crio) ExportImages(ctx context.Context, file string, images ...string) error {
+	err := exportFile(file, func(tmp string) error {
+		args := []string{"save", "--output", tmp}
+		if len(images) > 1 {
+			args = append(args, "--multi-image-archive")
+		}
+		return run(ctx, "podman", append(args, images...)...)
+	})
+	return imageError("export", err, images...)
+}
+
+func (c *crio) RemoveImage(ctx context.Context, image string) error {
+	return imageError("remove", run(ctx, "crictl", c.crictl("rmi", image)...), image)
+}
+
+func (c *crio) ServiceUnit(spec ContainerSpec) string {
+	args := []string{"/usr/bin/podman", "run", "--net=host", "--name", spec.Name}
+	for _, capability := range spec.Capabilities {
+		args = append(args, "--cap-add="+capability)
+	}
+	for _, mount := range spec.Mounts {
+		args = append(args, "-v", mount.Source+":"+mount.Destination)
+	}
+	args = append(args, spec.Image)
+	return serviceUnit(spec, c.Service(), strings.Join(args, " "),
+		[]string{"/usr/bin/podman kill " + spec.Name, "/usr/bin/podman rm " + spec.Name},
+		[]string{"/usr/bin/podman stop " + spec.Name, "/usr/bin/podman rm " + spec.Name})
+}
@@ -0,0 +1,193 @@
+package containerruntime
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+)
+
+// docker manages images through the Docker Engine API
+type docker struct {
+	cli          *client.Client
+	cgroupDriver string
+}
+
+func newDocker(config apis.ContainerRuntimeConfiguration) (*docker, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create docker client: %v", err)
+	}
+	return &docker{cli: cli, cgroupDriver: config.CgroupDriver}, nil
+}
+
+func (d *docker) Name() string {
+	return constants.ContainerRuntimeDocker
+}
+
+func (d *docker) Service() string {
+	return "docker.service"
+}
+
+func (d *docker) Endpoint() string {
+	return ""
+}
+
+func (d *docker) CgroupDriver() (string, error) {
+	if d.cgroupDriver != "" {
+		return d.cgroupDriver, nil
+	}
+	info, err := d.cli.Info(context.Background())
+	if err != nil {
+		return "", fmt.Errorf("unable to get docker info: %v", err)
+	}
+	return info.CgroupDriver, nil
+}
+
+func (d *docker) ImagePresent(ctx context.Context, image string) (bool, error) {
+	nameFilter := filters.NewArgs()
+	nameFilter.Add("reference", image)
+	list, err := d.cli.ImageList(ctx, types.ImageListOptions{
+		Filters: nameFilter,
+	})
+	if err != nil {
+		return false, imageError("list", err, image)
+	}
+	return len(list) != 0, nil
+}
+
+func (d *docker) PullImage(ctx context.Context, image string, auth *types.AuthConfig) error {
+	var registryAuth string
+	if auth != nil {
+		b, err := json.Marshal(auth)
+		if err != nil {
+			return imageError("pull", fmt.Errorf("unable to encode credentials for %q: %v", auth.ServerAddress, err), image)
+		}
+		registryAuth = base64.URLEncoding.EncodeToString(b)
+	}
+	stream, err := d.cli.ImagePull(ctx, image, types.ImagePullOptions{
+		RegistryAuth: registryAuth,
+	})
+	if err != nil {
+		return imageError("pull", err, image)
+	}
+	defer stream.Close()
+	return imageError("pull", readProgress(image, stream), image)
+}
+
+func (d *docker) TagImage(ctx context.Context, source, target string) error {
+	return imageError("tag", d.cli.ImageTag(ctx, source, target), source)
+}
+
+func (d *docker) ImportImages(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return imageError("import", err, file)
+	}
+	defer f.Close()
+	resp, err := d.cli.ImageLoad(ctx, f, false)
+	if err != nil {
+		return imageError("import", err, file)
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return imageError("import", err, file)
+	}
+	return imageError("import", readProgress(file, resp.Body), file)
+}
+
+// ExportImages writes the images into a temporary file first, so an
+// interrupted export does not leave a truncated tarball in the cache
+func (d *docker) ExportImages(ctx context.Context, file string, images ...string) error {
+	stream, err := d.cli.ImageSave(ctx, images)
+	if err != nil {
+		return imageError("export", err, images...)
+	}
+	defer stream.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return imageError("export", err, images...)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, stream); err != nil {
+		tmp.Close()
+		return imageError("export", err, images...)
+	}
+	if err := tmp.Close(); err != nil {
+		return imageError("export", err, images...)
+	}
+	return imageError("export", os.Rename(tmp.Name(), file), images...)
+}
+
+func (d *docker) RemoveImage(ctx context.Context, image string) error {
+	_, err := d.cli.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	return imageError("remove", err, image)
+}
+
+func (d *docker) ServiceUnit(spec ContainerSpec) string {
+	args := []string{"/usr/bin/docker", "run", "--net=host", "--name", spec.Name}
+	for _, capability := range spec.Capabilities {
+		args = append(args, "--cap-add="+capability)
+	}
+	for _, mount := range spec.Mounts {
+		args = append(args, "-v", mount.Source+":"+mount.Destination)
+	}
+	args = append(args, spec.Image)
+	return serviceUnit(spec, d.Service(), strings.Join(args, " "),
+		[]string{"/usr/bin/docker kill " + spec.Name, "/usr/bin/docker rm " + spec.Name},
+		[]string{"/usr/bin/docker stop " + spec.Name, "/usr/bin/docker rm " + spec.Name})
+}
+
+// progressMessage is a message of the JSON stream returned by image pulls and loads
+type progressMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress"`
+	Stream   string `json:"stream"`
+	Error    string `json:"error"`
+}
+
+// readProgress logs the progress of an image operation. The operation fails
+// asynchronously, so its error is reported in the stream.
+func readProgress(subject string, stream io.Reader) error {
+	decoder := json.NewDecoder(stream)
+	lastStatus := make(map[string]string)
+	for {
+		var msg progressMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read progress: %v", err)
+		}
+		switch {
+		case msg.Error != "":
+			return fmt.Errorf("%s", msg.Error)
+		case msg.Stream != "":
+			log.Infof("%s: %s", subject, strings.TrimSpace(msg.Stream))
+		case msg.Progress != "":
+			log.Debugf("%s: %s %s %s", subject, msg.ID, msg.Status, msg.Progress)
+		case lastStatus[msg.ID] != msg.Status:
+			// Log every status change of a layer once
+			lastStatus[msg.ID] = msg.Status
+			if msg.ID != "" {
+				log.Infof("%s: %s: %s", subject, msg.ID, msg.Status)
+			} else {
+				log.Infof("%s: %s", subject, msg.Status)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package containerruntime
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+)
+
+// Runtime manages the images and containers of a container runtime
+type Runtime interface {
+	// Name returns the name of the runtime
+	Name() string
+	// Service returns the systemd unit of the runtime
+	Service() string
+	// Endpoint returns the CRI endpoint the kubelet uses, or an empty string
+	// for the built-in docker integration
+	Endpoint() string
+	// CgroupDriver returns the cgroup driver the kubelet must use to match the runtime
+	CgroupDriver() (string, error)
+	// ImagePresent checks if an image is present
+	ImagePresent(ctx context.Context, image string) (bool, error)
+	// PullImage pulls an image, authenticating with auth unless it is nil
+	PullImage(ctx context.Context, image string, auth *types.AuthConfig) error
+	// TagImage adds the name target to the image source
+	TagImage(ctx context.Context, source, target string) error
+	// ImportImages imports the images of a tarball
+	ImportImages(ctx context.Context, file string) error
+	// ExportImages exports images into a tarball
+	ExportImages(ctx context.Context, file string, images ...string) error
+	// RemoveImage removes an image
+	RemoveImage(ctx context.Context, image string) error
+	// ServiceUnit renders a systemd unit that runs a container
+	ServiceUnit(spec ContainerSpec) string
+}
+
+// ContainerSpec describes a long-running container on the host network
+type ContainerSpec struct {
+	Name        string
+	Description string
+	Image       string
+	// Capabilities are added to the default capabilities of the container.
+	Capabilities []string
+	// Mounts maps host paths to container paths.
+	Mounts []Mount
+}
+
+// Mount bind mounts a host path into a container
+type Mount struct {
+	Source      string
+	Destination string
+}
+
+// New returns the runtime selected by the configuration, which must have its
+// defaults set
+func New(config apis.ContainerRuntimeConfiguration) (Runtime, error) {
+	switch config.Name {
+	case constants.ContainerRuntimeDocker:
+		return newDocker(config)
+	case constants.ContainerRuntimeContainerd:
+		return newContainerd(config), nil
+	case constants.ContainerRuntimeCRIO:
+		return newCRIO(config), nil
+	}
+	return nil, fmt.Errorf("unsupported container runtime %q", config.Name)
+}
+
+// ImageError is returned when an image operation fails
+type ImageError struct {
+	// Op is the failed operation, e.g. "pull"
+	Op string
+	// Images are the images the operation was applied to
+	Images []string
+	Err    error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("unable to %s %s: %v", e.Op, strings.Join(e.Images, ", "), e.Err)
+}
+
+func imageError(op string, err error, images ...string) error {
+	if err == nil {
+		return nil
+	}
+	return &ImageError{Op: op, Images: images, Err: err}
+}
+
+// run runs a command and returns its stderr as part of the error
+func run(ctx context.Context, name string, args ...string) error {
+	_, err := output(ctx, name, args...)
+	return err
+}
+
+// output runs a command and returns its stdout
+func output(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := host.Output(ctx, name, args...)
+	return string(out), err
+}
+
+// exportFile runs export into a temporary file next to file, and renames it to
+// file once export succeeds, so an interrupted export does not leave a
+// truncated tarball in the cache
+func exportFile(file string, export func(tmp string) error) error {
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".part")
+	defer os.Remove(tmp)
+	if err := export(tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// credentials formats auth as user:password, as expected by ctr and crictl
+func credentials(auth *types.AuthConfig) string {
+	return auth.Username + ":" + auth.Password
+}
+
+// pull runs a pull command that takes the credentials of auth, if any, as an
+// argument, and hides them in the error
+func pull(ctx context.Context, auth *types.AuthConfig, name string, args ...string) error {
+	err := run(ctx, name, args...)
+	if auth == nil {
+		return err
+	}
+	return host.Redact(err, credentials(auth))
+}
+
+// execLines renders one systemd directive per command
+func execLines(directive string, ignoreFailure bool, commands ...string) string {
+	prefix := ""
+	if ignoreFailure {
+		prefix = "-"
+	}
+	var lines []string
+	for _, command := range commands {
+		lines = append(lines, fmt.Sprintf("%s=%s%s", directive, prefix, command))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// serviceUnit renders a unit for a container run by a runtime service
+func serviceUnit(spec ContainerSpec, service, start string, preStart, stop []string) string {
+	return fmt.Sprintf(`[Unit]
+Description=%s
+After=network.target %s
+Requires=%s
+[Service]
+Type=simple
+ExecStart=%s
+%s
+%s
+Restart=on-failure
+MemoryLow=10M
+[Install]
+WantedBy=multi-user.target
+`, spec.Description, service, service, start, execLines("ExecStartPre", true, preStart...), execLines("ExecStop", false, stop...))
+}
@@ -0,0 +1,47 @@
+package host
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	new := "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\nk\n"
+	expected := `--- /etc/file
++++ /etc/file
+@@ -2,9 +2,10 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+ i
+ j
++k
+`
+	if diff := unifiedDiff("/etc/file", []byte(old), []byte(new)); diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
+
+func TestUnifiedDiffSeparateHunks(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	new := "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"
+	expected := `--- f
++++ f
+@@ -1,3 +1,4 @@
++0
+ 1
+ 2
+ 3
+@@ -9,4 +10,3 @@
+ 9
+ 10
+ 11
+-12
+`
+	if diff := unifiedDiff("f", []byte(old), []byte(new)); diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
@@ -0,0 +1,124 @@
+// Package host runs the commands and accesses the files of the machine nodeadm
+// configures. Both can be replaced, so flows can be tested without root.
+package host
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Executor runs commands on the host
+type Executor interface {
+	// Run runs a command, feeding it stdin unless it is nil, and returns its
+	// stdout. A command that fails returns a *CommandError.
+	Run(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error)
+}
+
+// CommandError is returned when a command fails
+type CommandError struct {
+	// Command is the name and arguments of the command
+	Command []string
+	// ExitCode is the exit code of the command, or -1 if it did not exit,
+	// e.g. because it was not found or was killed
+	ExitCode int
+	// Stderr is the trimmed stderr of the command
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("command %q", strings.Join(e.Command, " "))
+	if e.ExitCode >= 0 {
+		msg += fmt.Sprintf(" exited with code %d", e.ExitCode)
+	} else {
+		msg += fmt.Sprintf(" failed: %v", e.Err)
+	}
+	if e.Stderr != "" {
+		msg += ", stderr: " + e.Stderr
+	}
+	return msg
+}
+
+// Redact returns err with the secret, e.g. credentials passed as an argument,
+// hidden in the command and stderr of a *CommandError
+func Redact(err error, secret string) error {
+	cmdErr, ok := err.(*CommandError)
+	if !ok || secret == "" {
+		return err
+	}
+	redacted := *cmdErr
+	redacted.Command = make([]string, len(cmdErr.Command))
+	for i, arg := range cmdErr.Command {
+		redacted.Command[i] = strings.Replace(arg, secret, "<redacted>", -1)
+	}
+	redacted.Stderr = strings.Replace(cmdErr.Stderr, secret, "<redacted>", -1)
+	return &redacted
+}
+
+// OSExecutor runs commands with os/exec
+type OSExecutor struct{}
+
+func (OSExecutor) Run(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		exitCode := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+				exitCode = status.ExitStatus()
+			}
+		}
+		if ctx.Err() != nil {
+			// The command was killed
+			exitCode, err = -1, ctx.Err()
+		}
+		return nil, &CommandError{Command: cmd.Args, ExitCode: exitCode, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+var executor Executor = OSExecutor{}
+
+// SetExecutor replaces the executor used by the package functions and returns
+// the previous one
+func SetExecutor(e Executor) Executor {
+	previous := executor
+	executor = e
+	return previous
+}
+
+// Run runs a command. The command is killed when ctx is done. While
+// planning, the command is recorded instead.
+func Run(ctx context.Context, name string, args ...string) error {
+	if Planning() {
+		Record(CommandAction, "%s", strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	_, err := executor.Run(ctx, nil, name, args...)
+	return err
+}
+
+// Output runs a command that queries the host and returns its stdout. It runs
+// while planning too.
+func Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return executor.Run(ctx, nil, name, args...)
+}
+
+// RunWithInput runs a command, feeding it stdin. While planning, the command
+// is recorded instead.
+func RunWithInput(ctx context.Context, stdin io.Reader, name string, args ...string) error {
+	if Planning() {
+		Record(CommandAction, "%s < input", strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+	_, err := executor.Run(ctx, stdin, name, args...)
+	return err
+}
@@ -0,0 +1,52 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOSExecutorCommandError(t *testing.T) {
+	_, err := OSExecutor{}.Run(context.Background(), nil, "/bin/sh", "-c", "echo oops >&2; exit 3")
+	cmdErr, ok := err.(*CommandError)
+	if !ok {
+		t.Fatalf("expected a *CommandError, got %v", err)
+	}
+	if cmdErr.ExitCode != 3 || cmdErr.Stderr != "oops" {
+		t.Errorf("unexpected exit code %d and stderr %q", cmdErr.ExitCode, cmdErr.Stderr)
+	}
+	if !strings.Contains(err.Error(), "exited with code 3") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestOSExecutorCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := OSExecutor{}.Run(ctx, nil, "/bin/sh", "-c", "sleep 10")
+	cmdErr, ok := err.(*CommandError)
+	if !ok {
+		t.Fatalf("expected a *CommandError, got %v", err)
+	}
+	if cmdErr.ExitCode != -1 || cmdErr.Err != context.Canceled {
+		t.Errorf("unexpected exit code %d and error %v", cmdErr.ExitCode, cmdErr.Err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	err := &CommandError{Command: []string{"ctr", "images", "pull", "--user", "admin:s3cret", "busybox"}, ExitCode: 1, Stderr: "unauthorized for admin:s3cret"}
+	redacted := Redact(err, "admin:s3cret")
+	if strings.Contains(redacted.Error(), "s3cret") {
+		t.Errorf("the secret is not hidden: %v", redacted)
+	}
+	if !strings.Contains(redacted.Error(), "--user <redacted> busybox") {
+		t.Errorf("unexpected error %v", redacted)
+	}
+	if err.Command[4] != "admin:s3cret" {
+		t.Errorf("the original error was changed")
+	}
+	if other := errors.New("admin:s3cret"); Redact(other, "admin:s3cret") != other {
+		t.Errorf("only command errors are redacted")
+	}
+}
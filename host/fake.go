@@ -0,0 +1,72 @@
+package host
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// FakeResponse is the result of a command run by a FakeExecutor
+type FakeResponse struct {
+	Stdout string
+	Err    error
+	// Effect, unless it is nil, is called with the arguments of the command,
+	// e.g. to create the files the command would create
+	Effect func(args []string) error
+	// Hangs makes the command run until ctx is done, after its effect
+	Hangs bool
+}
+
+// FakeExecutor records the commands it is asked to run instead of running
+// them. It may be used concurrently.
+type FakeExecutor struct {
+	mu sync.Mutex
+	// Commands are the commands run so far, each joined with spaces
+	Commands []string
+	// Responses maps command prefixes to their result. The longest matching
+	// prefix wins; commands without a match succeed without output.
+	Responses map[string]FakeResponse
+}
+
+// NewFakeExecutor returns an executor that runs no commands
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{Responses: make(map[string]FakeResponse)}
+}
+
+func (f *FakeExecutor) Run(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	f.Commands = append(f.Commands, command)
+	var response FakeResponse
+	matched := -1
+	for prefix, r := range f.Responses {
+		if strings.HasPrefix(command, prefix) && len(prefix) > matched {
+			response, matched = r, len(prefix)
+		}
+	}
+	f.mu.Unlock()
+	if response.Err != nil {
+		return nil, &CommandError{Command: append([]string{name}, args...), ExitCode: -1, Err: response.Err}
+	}
+	if response.Effect != nil {
+		if err := response.Effect(args); err != nil {
+			return nil, &CommandError{Command: append([]string{name}, args...), ExitCode: -1, Err: err}
+		}
+	}
+	if response.Hangs {
+		<-ctx.Done()
+		return nil, &CommandError{Command: append([]string{name}, args...), ExitCode: -1, Err: ctx.Err()}
+	}
+	return []byte(response.Stdout), nil
+}
+
+// FakeNetwork records the links it is asked to delete
+type FakeNetwork struct {
+	DeletedLinks []string
+}
+
+func (f *FakeNetwork) DeleteLink(name string) error {
+	f.DeletedLinks = append(f.DeletedLinks, name)
+	return nil
+}
@@ -0,0 +1,112 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is how often a held lock is tried again while waiting
+var lockPollInterval = 500 * time.Millisecond
+
+// FileLock is an exclusive flock on a file, which records the PID and command
+// of its holder. The kernel releases it when the holder exits, so a crashed
+// run never leaves the host locked.
+type FileLock struct {
+	file *os.File
+}
+
+// LockError is returned when another process holds a lock
+type LockError struct {
+	Path string
+	// PID and Command identify the holder, as recorded in the lock file. They
+	// are empty if the holder has not recorded them yet.
+	PID     int
+	Command string
+}
+
+func (e *LockError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("lock %s is held by another process", e.Path)
+	}
+	return fmt.Sprintf("lock %s is held by process %d (%s)", e.Path, e.PID, e.Command)
+}
+
+// Lock takes the exclusive lock on path, recording command as its holder. If
+// another process holds the lock, Lock tries again until wait has passed or
+// ctx is done, and then returns a *LockError.
+func Lock(ctx context.Context, path, command string, wait time.Duration) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(Path(path)), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create dir %q: %v", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(Path(path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock %s: %v", path, err)
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %v", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			lockErr := holder(path, f)
+			f.Close()
+			return nil, lockErr
+		}
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			lockErr := holder(path, f)
+			f.Close()
+			return nil, fmt.Errorf("stopped waiting: %v: %v", lockErr, ctx.Err())
+		}
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to record holder of lock %s: %v", path, err)
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), command)), 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to record holder of lock %s: %v", path, err)
+	}
+	return &FileLock{file: f}, nil
+}
+
+// holder reads the holder recorded in a lock file
+func holder(path string, f *os.File) *LockError {
+	lockErr := &LockError{Path: path}
+	content, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 4096))
+	if err != nil {
+		return lockErr
+	}
+	lines := strings.SplitN(string(content), "\n", 3)
+	if len(lines) < 2 {
+		return lockErr
+	}
+	if pid, err := strconv.Atoi(lines[0]); err == nil {
+		lockErr.PID, lockErr.Command = pid, lines[1]
+	}
+	return lockErr
+}
+
+// Unlock clears the recorded holder and releases the lock
+func (l *FileLock) Unlock() error {
+	l.file.Truncate(0)
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return fmt.Errorf("unable to unlock %s: %v", l.file.Name(), err)
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,48 @@
+package host
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodeadm-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetRoot(SetRoot(dir))
+
+	lock, err := Lock(context.Background(), "/var/run/nodeadm.lock", "nodeadm init", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flock locks belong to the open file, so a second open conflicts
+	_, err = Lock(context.Background(), "/var/run/nodeadm.lock", "nodeadm reset", 10*time.Millisecond)
+	lockErr, ok := err.(*LockError)
+	if !ok {
+		t.Fatalf("expected a *LockError, got %v", err)
+	}
+	if lockErr.PID != os.Getpid() || lockErr.Command != "nodeadm init" {
+		t.Errorf("unexpected holder %d (%s)", lockErr.PID, lockErr.Command)
+	}
+
+	released := make(chan error)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		released <- lock.Unlock()
+	}()
+	lock, err = Lock(context.Background(), "/var/run/nodeadm.lock", "nodeadm reset", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
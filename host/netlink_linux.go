@@ -0,0 +1,64 @@
+package host
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// netlinkNetwork manages links with rtnetlink
+type netlinkNetwork struct{}
+
+func (netlinkNetwork) DeleteLink(name string) error {
+	index, err := linkIndex(name)
+	if err != nil || index == 0 {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("unable to open netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("unable to bind netlink socket: %v", err)
+	}
+
+	req := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofIfInfomsg)
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&req[0]))
+	hdr.Len = uint32(len(req))
+	hdr.Type = syscall.RTM_DELLINK
+	hdr.Flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+	hdr.Seq = 1
+	info := (*syscall.IfInfomsg)(unsafe.Pointer(&req[syscall.NLMSG_HDRLEN]))
+	info.Family = syscall.AF_UNSPEC
+	info.Index = int32(index)
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("unable to delete link %s: %v", name, err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("unable to delete link %s: %v", name, err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("unable to delete link %s: %v", name, err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != hdr.Seq || msg.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			// The acknowledgement is an error message with a negated errno,
+			// which is zero on success
+			if len(msg.Data) < 4 {
+				return fmt.Errorf("unable to delete link %s: truncated netlink acknowledgement", name)
+			}
+			if errno := *(*int32)(unsafe.Pointer(&msg.Data[0])); errno != 0 {
+				return fmt.Errorf("unable to delete link %s: %v", name, syscall.Errno(-errno))
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package host
+
+import "fmt"
+
+// netlinkNetwork is only available on Linux
+type netlinkNetwork struct{}
+
+func (netlinkNetwork) DeleteLink(name string) error {
+	return fmt.Errorf("unable to delete link %s: not supported on this platform", name)
+}
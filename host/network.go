@@ -0,0 +1,86 @@
+package host
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Network manages the network links of the host
+type Network interface {
+	// DeleteLink deletes a link. Deleting a link that does not exist succeeds.
+	DeleteLink(name string) error
+}
+
+var network Network = netlinkNetwork{}
+
+// SetNetwork replaces the network used by the package functions and returns
+// the previous one
+func SetNetwork(n Network) Network {
+	previous := network
+	network = n
+	return previous
+}
+
+// DeleteLink deletes a link of the host
+func DeleteLink(name string) error {
+	if Planning() {
+		Record(NetworkAction, "delete link %s", name)
+		return nil
+	}
+	return network.DeleteLink(name)
+}
+
+// linkIndex returns the index of a link, or 0 if it does not exist
+func linkIndex(name string) (int, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, fmt.Errorf("unable to list links: %v", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Name == name {
+			return iface.Index, nil
+		}
+	}
+	return 0, nil
+}
+
+// DefaultRouteInterface returns the interface of the default IPv4 route with
+// the lowest metric, as listed in /proc/net/route
+func DefaultRouteInterface() (string, error) {
+	routeFile := Path("/proc/net/route")
+	f, err := os.Open(routeFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read routing table: %v", err)
+	}
+	defer f.Close()
+	var iface string
+	var lowestMetric uint64
+	scanner := bufio.NewScanner(f)
+	// Skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		metric, err := strconv.ParseUint(fields[6], 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid metric %q in %s", fields[6], routeFile)
+		}
+		if iface == "" || metric < lowestMetric {
+			iface, lowestMetric = fields[0], metric
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("unable to read routing table: %v", err)
+	}
+	if iface == "" {
+		return "", fmt.Errorf("no default route in %s", routeFile)
+	}
+	return iface, nil
+}
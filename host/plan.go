@@ -0,0 +1,140 @@
+package host
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ActionKind groups the actions of a plan
+type ActionKind int
+
+const (
+	FileAction ActionKind = iota
+	SystemdAction
+	ImageAction
+	CommandAction
+	NetworkAction
+)
+
+var actionKindNames = []string{"Files", "Systemd", "Images", "Commands", "Network"}
+
+// Action is a change a dry run would make to the host
+type Action struct {
+	Kind ActionKind
+	// Description says what the action does, e.g. "overwrite /etc/keepalived/keepalived.conf"
+	Description string
+	// Diff is the unified diff of a changed text file
+	Diff string
+}
+
+// Plan records the changes to the host in the order they would be made
+type Plan struct {
+	Actions []Action
+}
+
+// Print writes the actions of the plan grouped by kind
+func (p *Plan) Print(w io.Writer) {
+	if len(p.Actions) == 0 {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+	for kind, name := range actionKindNames {
+		var printed bool
+		for _, a := range p.Actions {
+			if a.Kind != ActionKind(kind) {
+				continue
+			}
+			if !printed {
+				fmt.Fprintf(w, "%s:\n", name)
+				printed = true
+			}
+			fmt.Fprintf(w, "  %s\n", a.Description)
+			for _, line := range strings.SplitAfter(a.Diff, "\n") {
+				if line != "" {
+					fmt.Fprintf(w, "    %s", line)
+				}
+			}
+		}
+	}
+}
+
+var plan *Plan
+
+// SetPlan makes the package functions, and the packages that change the host,
+// record changes into p instead of making them, unless p is nil. Commands run
+// with Output, which only query the host, still run. It returns the previous
+// plan.
+func SetPlan(p *Plan) *Plan {
+	previous := plan
+	plan = p
+	return previous
+}
+
+// Planning reports whether changes are recorded instead of made
+func Planning() bool {
+	return plan != nil
+}
+
+// Record records an action in the plan
+func Record(kind ActionKind, format string, args ...interface{}) {
+	plan.Actions = append(plan.Actions, Action{Kind: kind, Description: fmt.Sprintf(format, args...)})
+}
+
+// RecordFile records writing data to file, a path returned by Path, with the
+// diff against its current content if both are text
+func RecordFile(file string, data []byte) {
+	old, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		Record(FileAction, "create %s", display(file))
+		if isText(data) {
+			plan.Actions[len(plan.Actions)-1].Diff = unifiedDiff(display(file), nil, data)
+		}
+		return
+	}
+	if err == nil && bytes.Equal(old, data) {
+		return
+	}
+	Record(FileAction, "overwrite %s", display(file))
+	if err == nil && isText(old) && isText(data) {
+		plan.Actions[len(plan.Actions)-1].Diff = unifiedDiff(display(file), old, data)
+	}
+}
+
+// RecordCopy records writing file, a path returned by Path, from source
+func RecordCopy(file, source string) {
+	verb := "create"
+	if _, err := os.Lstat(file); err == nil {
+		verb = "overwrite"
+	}
+	Record(FileAction, "%s %s from %s", verb, display(file), display(source))
+}
+
+// RemoveAll removes path on the host and everything below it
+func RemoveAll(path string) error {
+	if Planning() {
+		if _, err := os.Lstat(Path(path)); err == nil {
+			Record(FileAction, "delete %s", path)
+		}
+		return nil
+	}
+	return os.RemoveAll(Path(path))
+}
+
+// display returns file, a path returned by Path, as a path on the host
+func display(file string) string {
+	rel, err := filepath.Rel(root, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return file
+	}
+	return filepath.Join("/", rel)
+}
+
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
@@ -0,0 +1,39 @@
+package host
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// root is the directory the host filesystem is rooted at
+var root = "/"
+
+// SetRoot roots the host filesystem at dir and returns the previous root. It
+// is "/" except in tests.
+func SetRoot(dir string) string {
+	previous := root
+	root = dir
+	return previous
+}
+
+// Path returns where an absolute path of the host filesystem is found under
+// the root
+func Path(path string) string {
+	return filepath.Join(root, path)
+}
+
+// euid is the effective user ID nodeadm runs as
+var euid = os.Geteuid()
+
+// SetEuid makes nodeadm run as the effective user ID id and returns the
+// previous one. It is the real one except in tests.
+func SetEuid(id int) int {
+	previous := euid
+	euid = id
+	return previous
+}
+
+// Euid returns the effective user ID nodeadm runs as
+func Euid() int {
+	return euid
+}
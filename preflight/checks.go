@@ -0,0 +1,203 @@
+package preflight
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/systemd"
+)
+
+// Files read by the checks
+const (
+	swapsFile            = "/proc/swaps"
+	bridgeNetfilterFile  = "/proc/sys/net/bridge/bridge-nf-call-iptables"
+	procNetTCPFile       = "/proc/net/tcp"
+	procNetTCP6File      = "/proc/net/tcp6"
+	containerdConfigFile = "/etc/containerd/config.toml"
+	crioConfigFile       = "/etc/crio/crio.conf"
+)
+
+// tcpListenState is the state of a listening socket in /proc/net/tcp
+const tcpListenState = "0A"
+
+// PrivilegedUser checks that nodeadm runs as root
+func PrivilegedUser() Check {
+	return Check{"IsPrivilegedUser", Error, func(ctx context.Context) error {
+		if host.Euid() != 0 {
+			return fmt.Errorf("nodeadm must run as root")
+		}
+		return nil
+	}}
+}
+
+// Swap checks that swap is disabled. The kubelet only refuses to start with
+// swap enabled if failSwapOn is set, otherwise swap is a warning.
+func Swap(failSwapOn bool) Check {
+	severity := Warning
+	if failSwapOn {
+		severity = Error
+	}
+	return Check{"Swap", severity, func(ctx context.Context) error {
+		data, err := ioutil.ReadFile(host.Path(swapsFile))
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %v", swapsFile, err)
+		}
+		// The first line is a header
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) > 1 {
+			return fmt.Errorf("swap is enabled, disable it with swapoff -a or set failSwapOn to false")
+		}
+		return nil
+	}}
+}
+
+// BridgeNetfilter checks that bridged traffic can be filtered by iptables,
+// which the pod network needs
+func BridgeNetfilter() Check {
+	return Check{"BridgeNetfilter", Error, func(ctx context.Context) error {
+		if _, err := os.Stat(host.Path(bridgeNetfilterFile)); err != nil {
+			return fmt.Errorf("%s not found, load the br_netfilter module with modprobe br_netfilter", bridgeNetfilterFile)
+		}
+		return nil
+	}}
+}
+
+// Port checks that no process listens on the TCP port
+func Port(port int) Check {
+	return Check{fmt.Sprintf("Port-%d", port), Error, func(ctx context.Context) error {
+		listening, err := listeningPorts()
+		if err != nil {
+			return err
+		}
+		if listening[port] {
+			return fmt.Errorf("port %d is in use", port)
+		}
+		return nil
+	}}
+}
+
+// listeningPorts returns the TCP ports listened on, over IPv4 and IPv6
+func listeningPorts() (map[int]bool, error) {
+	ports := make(map[int]bool)
+	for _, file := range []string{procNetTCPFile, procNetTCP6File} {
+		data, err := ioutil.ReadFile(host.Path(file))
+		if os.IsNotExist(err) && file == procNetTCP6File {
+			// IPv6 is disabled
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", file, err)
+		}
+		if err := parseListeningPorts(data, ports); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", file, err)
+		}
+	}
+	return ports, nil
+}
+
+// parseListeningPorts adds the ports of the sockets in the listen state of a
+// /proc/net/tcp table to ports
+func parseListeningPorts(data []byte, ports map[int]bool) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// The first line is a header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpListenState {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			return fmt.Errorf("invalid local address %q", fields[1])
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid local address %q", fields[1])
+		}
+		ports[int(port)] = true
+	}
+	return scanner.Err()
+}
+
+// ContainerRuntime checks that the systemd unit of the container runtime is
+// active
+func ContainerRuntime(rt containerruntime.Runtime) Check {
+	return Check{"ContainerRuntime", Error, func(ctx context.Context) error {
+		active, err := systemd.Active(ctx, rt.Service())
+		if err != nil {
+			return fmt.Errorf("unable to check container runtime: %v", err)
+		}
+		if !active {
+			return fmt.Errorf("container runtime service %s is not active", rt.Service())
+		}
+		return nil
+	}}
+}
+
+// CgroupDriver checks that the cgroup driver configured for the kubelet is
+// the one the container runtime uses. It passes if no driver is configured,
+// since the kubelet then asks docker, or if the driver of the runtime cannot
+// be found out.
+func CgroupDriver(rt containerruntime.Runtime, configured string) Check {
+	return Check{"CgroupDriver", Error, func(ctx context.Context) error {
+		if configured == "" {
+			return nil
+		}
+		driver, err := runtimeCgroupDriver(ctx, rt)
+		if err != nil {
+			return err
+		}
+		if driver != "" && driver != configured {
+			return fmt.Errorf("%s uses the %s cgroup driver, but cgroupDriver is %s", rt.Name(), driver, configured)
+		}
+		return nil
+	}}
+}
+
+var (
+	containerdSystemdCgroup = regexp.MustCompile(`(?m)^\s*systemd_cgroup\s*=\s*true`)
+	crioCgroupManager       = regexp.MustCompile(`(?m)^\s*cgroup_manager\s*=\s*"(\w+)"`)
+)
+
+// runtimeCgroupDriver returns the cgroup driver the runtime uses, or an empty
+// string if it is not known
+func runtimeCgroupDriver(ctx context.Context, rt containerruntime.Runtime) (string, error) {
+	switch rt.Name() {
+	case constants.ContainerRuntimeDocker:
+		out, err := host.Output(ctx, "docker", "info", "--format", "{{.CgroupDriver}}")
+		if err != nil {
+			return "", fmt.Errorf("unable to get docker info: %v", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	case constants.ContainerRuntimeContainerd:
+		data, err := ioutil.ReadFile(host.Path(containerdConfigFile))
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("unable to read %s: %v", containerdConfigFile, err)
+		}
+		if containerdSystemdCgroup.Match(data) {
+			return constants.CgroupDriverSystemd, nil
+		}
+		return constants.CgroupDriverCgroupfs, nil
+	case constants.ContainerRuntimeCRIO:
+		data, err := ioutil.ReadFile(host.Path(crioConfigFile))
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to read %s: %v", crioConfigFile, err)
+		}
+		if m := crioCgroupManager.FindSubmatch(data); m != nil {
+			return string(m[1]), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,84 @@
+// Package preflight checks that the host is ready for nodeadm before it is
+// changed, so that problems are reported by name instead of surfacing later
+// as failures of the kubelet or kubeadm.
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+)
+
+// Severity says whether a failed check stops nodeadm
+type Severity int
+
+const (
+	// Error fails the command
+	Error Severity = iota
+	// Warning is logged, and the command continues
+	Warning
+)
+
+// Check is a named check of the host
+type Check struct {
+	Name     string
+	Severity Severity
+	Run      func(ctx context.Context) error
+}
+
+// Run runs the checks whose names are not in skip. Failed warnings are
+// logged; failed errors are returned together. It fails on skipped names that
+// are not checks, so that a typo does not run a check.
+func Run(ctx context.Context, checks []Check, skip []string) error {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for _, check := range checks {
+		delete(skipped, check.Name)
+	}
+	if len(skipped) > 0 {
+		var unknown []string
+		for name := range skipped {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown checks %s, checks are %s", strings.Join(unknown, ", "), Names(checks))
+	}
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	var failures []string
+	for _, check := range checks {
+		if skipped[check.Name] {
+			log.Infof("[preflight] Skipping check %s", check.Name)
+			continue
+		}
+		err := check.Run(ctx)
+		if err == nil {
+			continue
+		}
+		if check.Severity == Warning {
+			log.Warnf("[preflight] %s: %v", check.Name, err)
+			continue
+		}
+		log.Errorf("[preflight] %s: %v", check.Name, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", check.Name, err))
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("preflight checks failed, skip them with --skip-preflight-checks if they do not apply: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Names returns the names of the checks, separated by commas
+func Names(checks []Check) string {
+	var names []string
+	for _, check := range checks {
+		names = append(names, check.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,88 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestRun(t *testing.T) {
+	var ran []string
+	check := func(name string, severity Severity, err error) Check {
+		return Check{name, severity, func(ctx context.Context) error {
+			ran = append(ran, name)
+			return err
+		}}
+	}
+	checks := []Check{
+		check("Passes", Error, nil),
+		check("Warns", Warning, errors.New("warned")),
+		check("Fails", Error, errors.New("failed")),
+		check("Skipped", Error, errors.New("skipped")),
+	}
+	err := Run(context.Background(), checks, []string{"Skipped"})
+	if err == nil || !strings.Contains(err.Error(), "Fails: failed") || strings.Contains(err.Error(), "warned") {
+		t.Errorf("expected only the error of Fails, got %v", err)
+	}
+	if expected := []string{"Passes", "Warns", "Fails"}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("ran %v, expected %v", ran, expected)
+	}
+
+	ran = nil
+	if err := Run(context.Background(), checks, []string{"Typo"}); err == nil || !strings.Contains(err.Error(), "unknown checks Typo") {
+		t.Errorf("expected unknown check error, got %v", err)
+	}
+	if len(ran) > 0 {
+		t.Errorf("ran %v with an unknown check to skip", ran)
+	}
+}
+
+func TestParseListeningPorts(t *testing.T) {
+	table := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1A0B 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0016 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 20 4 30 10 -1
+`
+	ports := make(map[int]bool)
+	if err := parseListeningPorts([]byte(table), ports); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ports, map[int]bool{6667: true}) {
+		t.Errorf("got ports %v, expected only 6667 listening", ports)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	root, err := ioutil.TempDir("", "nodeadm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer host.SetRoot(host.SetRoot(root))
+	if err := os.MkdirAll(filepath.Join(root, "proc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	swaps := "Filename\tType\tSize\tUsed\tPriority\n"
+	if err := ioutil.WriteFile(host.Path(swapsFile), []byte(swaps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Swap(true).Run(context.Background()); err != nil {
+		t.Errorf("swap is off, got %v", err)
+	}
+	swaps += "/swapfile\tfile\t1048572\t0\t-2\n"
+	if err := ioutil.WriteFile(host.Path(swapsFile), []byte(swaps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Swap(true).Run(context.Background()); err == nil {
+		t.Errorf("swap is on, expected an error")
+	}
+	if Swap(false).Severity != Warning {
+		t.Errorf("swap must be a warning without failSwapOn")
+	}
+}
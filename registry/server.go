@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+)
+
+// Server is a pull-only Docker Registry HTTP API V2 server
+type Server struct {
+	store *Store
+}
+
+// NewServer creates a server for the images in store
+func NewServer(store *Store) *Server {
+	return &Server{store: store}
+}
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("[registry] %s %s", r.Method, r.URL.Path)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "registry is read-only", r.Method)
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case path == "/v2" || path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "/v2/_catalog":
+		s.serveCatalog(w)
+	case strings.HasPrefix(path, "/v2/"):
+		s.serveRepository(w, r, strings.TrimPrefix(path, "/v2/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveRepository(w http.ResponseWriter, r *http.Request, path string) {
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		s.serveManifest(w, r, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		s.serveBlob(w, r, path[i+len("/blobs/"):])
+		return
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		s.serveTags(w, strings.TrimSuffix(path, "/tags/list"))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, name, reference string) {
+	manifest, digest, ok := s.store.Manifest(name, reference)
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown", fmt.Sprintf("%s:%s", name, reference))
+		return
+	}
+	w.Header().Set("Content-Type", MediaTypeManifest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", fmt.Sprintf("%q", digest))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(manifest)
+	}
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, digest string) {
+	path, ok := s.store.BlobPath(digest)
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry", digest)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", "unable to open blob", err.Error())
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", "unable to stat blob", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", fmt.Sprintf("%q", digest))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+func (s *Server) serveCatalog(w http.ResponseWriter) {
+	repositories := s.store.Repositories()
+	sort.Strings(repositories)
+	writeJSON(w, struct {
+		Repositories []string `json:"repositories"`
+	}{repositories})
+}
+
+func (s *Server) serveTags(w http.ResponseWriter, name string) {
+	tags, ok := s.store.Tags(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry", name)
+		return
+	}
+	sort.Strings(tags)
+	writeJSON(w, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{name, tags})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("[registry] Failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []registryError `json:"errors"`
+	}{[]registryError{{Code: code, Message: message, Detail: detail}}})
+}
@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	tarball := filepath.Join(dir, "images.tar")
+	writeSaveTarball(t, tarball, []image{
+		{repoTags: []string{"k8s.gcr.io/pause-amd64:3.1"}, layers: []string{"pause"}},
+	})
+	if err := s.AddImageTarball(tarball); err != nil {
+		t.Fatal(err)
+	}
+	manifest, digest, _ := s.Manifest("pause-amd64", "3.1")
+	blob, err := s.putBlob([]byte("blob"), MediaTypeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewServer(s))
+	defer server.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+		digest string
+	}{
+		{http.MethodGet, "/v2/", http.StatusOK, "", ""},
+		{http.MethodGet, "/v2/_catalog", http.StatusOK, `{"repositories":["pause-amd64"]}` + "\n", ""},
+		{http.MethodGet, "/v2/pause-amd64/tags/list", http.StatusOK, `{"name":"pause-amd64","tags":["3.1"]}` + "\n", ""},
+		{http.MethodGet, "/v2/missing/tags/list", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/v2/pause-amd64/manifests/3.1", http.StatusOK, string(manifest), digest},
+		{http.MethodHead, "/v2/pause-amd64/manifests/3.1", http.StatusOK, "", digest},
+		{http.MethodGet, "/v2/pause-amd64/manifests/" + digest, http.StatusOK, string(manifest), digest},
+		{http.MethodGet, "/v2/pause-amd64/manifests/3.2", http.StatusNotFound, "", ""},
+		{http.MethodHead, "/v2/missing/manifests/3.1", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/v2/pause-amd64/blobs/" + blob.Digest, http.StatusOK, "blob", blob.Digest},
+		{http.MethodHead, "/v2/pause-amd64/blobs/" + blob.Digest, http.StatusOK, "", blob.Digest},
+		{http.MethodGet, "/v2/pause-amd64/blobs/sha256:" + strings.Repeat("f", 64), http.StatusNotFound, "", ""},
+		{http.MethodHead, "/v2/pause-amd64/blobs/sha256:" + strings.Repeat("f", 64), http.StatusNotFound, "", ""},
+		{http.MethodGet, "/v2/pause-amd64/blobs/sha256:..%2f..%2f..%2f" + strings.Repeat("0", 55), http.StatusNotFound, "", ""},
+		{http.MethodGet, "/v2/pause-amd64/other", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/other", http.StatusNotFound, "", ""},
+		{http.MethodPut, "/v2/pause-amd64/manifests/3.1", http.StatusMethodNotAllowed, "", ""},
+		{http.MethodPost, "/v2/pause-amd64/blobs/uploads/", http.StatusMethodNotAllowed, "", ""},
+		{http.MethodPatch, "/v2/pause-amd64/blobs/uploads/1", http.StatusMethodNotAllowed, "", ""},
+		{http.MethodDelete, "/v2/pause-amd64/manifests/" + digest, http.StatusMethodNotAllowed, "", ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s returned %d, expected %d", tt.method, tt.path, resp.StatusCode, tt.status)
+			continue
+		}
+		if resp.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" {
+			t.Errorf("%s %s returned no API version header", tt.method, tt.path)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if tt.body != "" && string(body) != tt.body {
+			t.Errorf("%s %s returned %q, expected %q", tt.method, tt.path, body, tt.body)
+		}
+		if tt.method == http.MethodHead && len(body) != 0 {
+			t.Errorf("%s %s returned a body", tt.method, tt.path)
+		}
+		if tt.digest != "" {
+			if got := resp.Header.Get("Docker-Content-Digest"); got != tt.digest {
+				t.Errorf("%s %s returned digest %q, expected %q", tt.method, tt.path, got, tt.digest)
+			}
+		}
+		if tt.method == http.MethodHead && strings.Contains(tt.path, "/manifests/") {
+			if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(manifest)) {
+				t.Errorf("%s %s returned length %s, expected %d", tt.method, tt.path, got, len(manifest))
+			}
+		}
+	}
+}
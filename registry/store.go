@@ -0,0 +1,418 @@
+package registry
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+)
+
+const (
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeConfig   = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// Descriptor references a blob in a manifest
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+// Manifest is a Docker Image Manifest Version 2, Schema 2
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// saveManifest is an entry of the manifest.json written by `docker save`
+type saveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Store serves manifests and blobs derived from the image tarballs in the
+// nodeadm image cache. Layers are compressed once and kept under the blob
+// directory, so restarting the registry is cheap.
+type Store struct {
+	blobDir  string
+	layerDir string
+	// manifests maps repository name to tag or digest to the marshalled manifest
+	manifests map[string]map[string][]byte
+}
+
+// NewStore creates a store that keeps its blobs under dir
+func NewStore(dir string) (*Store, error) {
+	s := &Store{
+		blobDir:   filepath.Join(dir, "blobs", "sha256"),
+		layerDir:  filepath.Join(dir, "layers"),
+		manifests: make(map[string]map[string][]byte),
+	}
+	for _, d := range []string{s.blobDir, s.layerDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create dir %q: %v", d, err)
+		}
+	}
+	return s, nil
+}
+
+// AddImagesFromDir indexes every `docker save` tarball found in dir
+func (s *Store) AddImagesFromDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("unable to list images in %q: %v", dir, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".tar" {
+			continue
+		}
+		if err := s.AddImageTarball(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddImageTarball indexes the images of a single `docker save` tarball
+func (s *Store) AddImageTarball(path string) error {
+	log.Infof("[registry] Indexing images from %s", path)
+	entries, err := readSaveManifest(path)
+	if err != nil {
+		return err
+	}
+	configs := make(map[string][]byte)
+	for _, entry := range entries {
+		configs[entry.Config] = nil
+	}
+	if err := walkTarball(path, func(name string, r io.Reader) error {
+		if _, ok := configs[name]; !ok {
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		configs[name] = b
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to read image configs from %q: %v", path, err)
+	}
+
+	for _, entry := range entries {
+		config := configs[entry.Config]
+		if config == nil {
+			return fmt.Errorf("image config %q missing from %q", entry.Config, path)
+		}
+		var ic imageConfig
+		if err := json.Unmarshal(config, &ic); err != nil {
+			return fmt.Errorf("unable to parse image config %q from %q: %v", entry.Config, path, err)
+		}
+		if len(ic.RootFS.DiffIDs) != len(entry.Layers) {
+			return fmt.Errorf("image config %q from %q lists %d layers, expected %d", entry.Config, path, len(ic.RootFS.DiffIDs), len(entry.Layers))
+		}
+		configDesc, err := s.putBlob(config, MediaTypeConfig)
+		if err != nil {
+			return err
+		}
+		layers, err := s.compressLayers(path, entry.Layers, ic.RootFS.DiffIDs)
+		if err != nil {
+			return err
+		}
+		manifest, err := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeManifest,
+			Config:        configDesc,
+			Layers:        layers,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to marshal manifest: %v", err)
+		}
+		for _, repoTag := range entry.RepoTags {
+			name, tag := RepositoryAndTag(repoTag)
+			s.addManifest(name, tag, manifest)
+		}
+	}
+	return nil
+}
+
+// Manifest returns the manifest and its digest for a repository by tag or digest
+func (s *Store) Manifest(name, reference string) ([]byte, string, bool) {
+	manifest, ok := s.manifests[name][reference]
+	if !ok {
+		return nil, "", false
+	}
+	return manifest, digestOf(manifest), true
+}
+
+// BlobPath returns the path of the blob with the given digest
+func (s *Store) BlobPath(digest string) (string, bool) {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if hex == digest || len(hex) != sha256.Size*2 || strings.ContainsAny(hex, "/.") {
+		return "", false
+	}
+	path := filepath.Join(s.blobDir, hex)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// Repositories returns the names of all indexed repositories
+func (s *Store) Repositories() []string {
+	var names []string
+	for name := range s.manifests {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Tags returns the tags of a repository
+func (s *Store) Tags(name string) ([]string, bool) {
+	refs, ok := s.manifests[name]
+	if !ok {
+		return nil, false
+	}
+	var tags []string
+	for ref := range refs {
+		if !strings.HasPrefix(ref, "sha256:") {
+			tags = append(tags, ref)
+		}
+	}
+	return tags, true
+}
+
+func (s *Store) addManifest(name, tag string, manifest []byte) {
+	if s.manifests[name] == nil {
+		s.manifests[name] = make(map[string][]byte)
+	}
+	s.manifests[name][tag] = manifest
+	s.manifests[name][digestOf(manifest)] = manifest
+	log.Debugf("[registry] Serving %s:%s", name, tag)
+}
+
+func (s *Store) putBlob(b []byte, mediaType string) (Descriptor, error) {
+	digest := digestOf(b)
+	path := filepath.Join(s.blobDir, strings.TrimPrefix(digest, "sha256:"))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			return Descriptor{}, fmt.Errorf("unable to write blob %q: %v", path, err)
+		}
+	}
+	return Descriptor{MediaType: mediaType, Size: int64(len(b)), Digest: digest}, nil
+}
+
+// compressLayers returns the descriptors of the gzipped layers, compressing
+// only the layers that were not compressed by a previous run.
+func (s *Store) compressLayers(path string, layers, diffIDs []string) ([]Descriptor, error) {
+	descs := make([]Descriptor, len(layers))
+	var missing []int
+	for i := range layers {
+		desc, ok := s.compressedLayer(diffIDs[i])
+		if ok {
+			descs[i] = desc
+			continue
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return descs, nil
+	}
+	// `docker save` stores a layer shared by several images once and links
+	// to it from the other layer directories.
+	links, err := readSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read layers from %q: %v", path, err)
+	}
+	pending := make(map[string][]int)
+	for _, i := range missing {
+		name := layers[i]
+		if target, ok := links[name]; ok {
+			name = target
+		}
+		pending[name] = append(pending[name], i)
+	}
+	err = walkTarball(path, func(name string, r io.Reader) error {
+		indexes, ok := pending[name]
+		if !ok {
+			return nil
+		}
+		desc, err := s.putCompressedLayer(r, diffIDs[indexes[0]])
+		if err != nil {
+			return err
+		}
+		for _, i := range indexes {
+			descs[i] = desc
+		}
+		delete(pending, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to compress layers from %q: %v", path, err)
+	}
+	for name := range pending {
+		return nil, fmt.Errorf("layer %q missing from %q", name, path)
+	}
+	return descs, nil
+}
+
+func (s *Store) compressedLayer(diffID string) (Descriptor, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(s.layerDir, strings.TrimPrefix(diffID, "sha256:")))
+	if err != nil {
+		return Descriptor{}, false
+	}
+	var desc Descriptor
+	if err := json.Unmarshal(b, &desc); err != nil {
+		return Descriptor{}, false
+	}
+	if _, ok := s.BlobPath(desc.Digest); !ok {
+		return Descriptor{}, false
+	}
+	return desc, true
+}
+
+func (s *Store) putCompressedLayer(r io.Reader, diffID string) (Descriptor, error) {
+	tmp, err := ioutil.TempFile(s.blobDir, ".layer")
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("unable to create temporary blob: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(tmp, h)}
+	zw := gzip.NewWriter(counter)
+	if _, err := io.Copy(zw, r); err != nil {
+		return Descriptor{}, fmt.Errorf("unable to compress layer %s: %v", diffID, err)
+	}
+	if err := zw.Close(); err != nil {
+		return Descriptor{}, fmt.Errorf("unable to compress layer %s: %v", diffID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return Descriptor{}, fmt.Errorf("unable to write layer %s: %v", diffID, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(s.blobDir, sum)); err != nil {
+		return Descriptor{}, fmt.Errorf("unable to store layer %s: %v", diffID, err)
+	}
+	desc := Descriptor{MediaType: MediaTypeLayer, Size: counter.n, Digest: "sha256:" + sum}
+	b, err := json.Marshal(desc)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.layerDir, strings.TrimPrefix(diffID, "sha256:")), b, 0644); err != nil {
+		return Descriptor{}, fmt.Errorf("unable to record layer %s: %v", diffID, err)
+	}
+	return desc, nil
+}
+
+// RepositoryAndTag splits an image reference into the repository name as
+// served by the registry, i.e. without the registry host, and the tag.
+func RepositoryAndTag(image string) (string, string) {
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			name = name[i+1:]
+		}
+	}
+	name = strings.TrimPrefix(name, "library/")
+	return name, tag
+}
+
+func readSaveManifest(path string) ([]saveManifest, error) {
+	var entries []saveManifest
+	err := walkTarball(path, func(name string, r io.Reader) error {
+		if name != "manifest.json" {
+			return nil
+		}
+		return json.NewDecoder(r).Decode(&entries)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest.json from %q: %v", path, err)
+	}
+	if entries == nil {
+		return nil, fmt.Errorf("no manifest.json in %q", path)
+	}
+	return entries, nil
+}
+
+// readSymlinks maps the symlinks in a tarball to the names they point to
+func readSymlinks(path string) (map[string]string, error) {
+	links := make(map[string]string)
+	err := walkTarballHeaders(path, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag == tar.TypeSymlink {
+			links[hdr.Name] = filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)
+		}
+		return nil
+	})
+	return links, err
+}
+
+// walkTarball calls fn for every regular file in a tarball
+func walkTarball(path string, fn func(name string, r io.Reader) error) error {
+	return walkTarballHeaders(path, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		return fn(hdr.Name, r)
+	})
+}
+
+func walkTarballHeaders(path string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,231 @@
+package registry
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type image struct {
+	repoTags []string
+	layers   []string
+}
+
+// writeSaveTarball writes a tarball in the format of `docker save`. Layers
+// with the same content are stored once and linked, as docker does.
+func writeSaveTarball(t *testing.T, path string, images []image) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	write := func(name string, b []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(b))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var entries []saveManifest
+	stored := make(map[string]string)
+	for i, img := range images {
+		var ic imageConfig
+		var layers []string
+		for j, content := range img.layers {
+			sum := sha256.Sum256([]byte(content))
+			diffID := hex.EncodeToString(sum[:])
+			ic.RootFS.DiffIDs = append(ic.RootFS.DiffIDs, "sha256:"+diffID)
+			name := fmt.Sprintf("%d-%d/layer.tar", i, j)
+			if target, ok := stored[diffID]; ok {
+				hdr := &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: filepath.Join("..", target)}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				write(name, []byte(content))
+				stored[diffID] = name
+			}
+			layers = append(layers, name)
+		}
+		config, err := json.Marshal(ic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configName := digestOf(config)[len("sha256:"):] + ".json"
+		write(configName, config)
+		entries = append(entries, saveManifest{Config: configName, RepoTags: img.repoTags, Layers: layers})
+	}
+	manifest, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("manifest.json", manifest)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "nodeadm-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(filepath.Join(dir, "store"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestRepositoryAndTag(t *testing.T) {
+	tests := []struct {
+		image, name, tag string
+	}{
+		{"busybox", "busybox", "latest"},
+		{"busybox:1.28", "busybox", "1.28"},
+		{"library/busybox:1.28", "busybox", "1.28"},
+		{"docker.io/library/busybox:1.28", "busybox", "1.28"},
+		{"platform9/keepalived:v2.0.4", "platform9/keepalived", "v2.0.4"},
+		{"k8s.gcr.io/kube-proxy-amd64:v1.10.4", "kube-proxy-amd64", "v1.10.4"},
+		{"quay.io/coreos/flannel:v0.10.0-amd64", "coreos/flannel", "v0.10.0-amd64"},
+		{"localhost/pause", "pause", "latest"},
+		{"localhost:5000/pause:3.1", "pause", "3.1"},
+		{"registry:5000/team/app", "team/app", "latest"},
+	}
+	for _, tt := range tests {
+		name, tag := RepositoryAndTag(tt.image)
+		if name != tt.name || tag != tt.tag {
+			t.Errorf("RepositoryAndTag(%q) = %q, %q, expected %q, %q", tt.image, name, tag, tt.name, tt.tag)
+		}
+	}
+}
+
+func TestAddImageTarball(t *testing.T) {
+	tests := []struct {
+		name    string
+		images  []image
+		tags    map[string]string
+		wantErr bool
+	}{
+		{"single image", []image{
+			{repoTags: []string{"k8s.gcr.io/pause-amd64:3.1"}, layers: []string{"pause"}},
+		}, map[string]string{"pause-amd64": "3.1"}, false},
+		{"shared layers", []image{
+			{repoTags: []string{"k8s.gcr.io/kube-proxy-amd64:v1.10.4"}, layers: []string{"base", "proxy"}},
+			{repoTags: []string{"k8s.gcr.io/kube-apiserver-amd64:v1.10.4"}, layers: []string{"base", "apiserver"}},
+		}, map[string]string{"kube-proxy-amd64": "v1.10.4", "kube-apiserver-amd64": "v1.10.4"}, false},
+		{"several tags", []image{
+			{repoTags: []string{"quay.io/coreos/flannel:v0.10.0-amd64", "mirror.local/coreos/flannel:v0.10.0-amd64"}, layers: []string{"flannel"}},
+		}, map[string]string{"coreos/flannel": "v0.10.0-amd64"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, dir := newTestStore(t)
+			defer os.RemoveAll(dir)
+			tarball := filepath.Join(dir, "images.tar")
+			writeSaveTarball(t, tarball, tt.images)
+
+			err := s.AddImageTarball(tarball)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			for name, tag := range tt.tags {
+				b, digest, ok := s.Manifest(name, tag)
+				if !ok {
+					t.Fatalf("no manifest for %s:%s", name, tag)
+				}
+				if _, byDigest, ok := s.Manifest(name, digest); !ok || byDigest != digest {
+					t.Errorf("manifest of %s not found by digest %s", name, digest)
+				}
+				var m Manifest
+				if err := json.Unmarshal(b, &m); err != nil {
+					t.Fatal(err)
+				}
+				for _, desc := range append([]Descriptor{m.Config}, m.Layers...) {
+					path, ok := s.BlobPath(desc.Digest)
+					if !ok {
+						t.Fatalf("blob %s of %s:%s missing", desc.Digest, name, tag)
+					}
+					info, err := os.Stat(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if info.Size() != desc.Size {
+						t.Errorf("blob %s has size %d, expected %d", desc.Digest, info.Size(), desc.Size)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAddImageTarballInvalid(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	tarball := filepath.Join(dir, "empty.tar")
+	f, err := os.Create(tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tar.NewWriter(f).Close()
+	f.Close()
+	if err := s.AddImageTarball(tarball); err == nil {
+		t.Errorf("expected an error for a tarball without manifest.json")
+	}
+	if err := s.AddImageTarball(filepath.Join(dir, "missing.tar")); err == nil {
+		t.Errorf("expected an error for a missing tarball")
+	}
+}
+
+func TestBlobPath(t *testing.T) {
+	s, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	desc, err := s.putBlob([]byte("blob"), MediaTypeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hex := strings.TrimPrefix(desc.Digest, "sha256:")
+	// A file outside the blob directory whose name passes the length check
+	outside := filepath.Join(dir, strings.Repeat("0", 64))
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		digest string
+		ok     bool
+	}{
+		{desc.Digest, true},
+		{hex, false},
+		{"sha256:" + strings.Repeat("f", 64), false},
+		{"sha256:" + hex[:10], false},
+		{"sha256:../../" + strings.Repeat("0", 58), false},
+		{"sha256:" + strings.Repeat(".", 64), false},
+		{"sha256:" + outside, false},
+		{outside, false},
+		{"/etc/passwd", false},
+		{"sha256:/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		path, ok := s.BlobPath(tt.digest)
+		if ok != tt.ok {
+			t.Errorf("BlobPath(%q) = %q, %v, expected %v", tt.digest, path, ok, tt.ok)
+			continue
+		}
+		if ok && filepath.Dir(path) != s.blobDir {
+			t.Errorf("BlobPath(%q) = %q is outside %q", tt.digest, path, s.blobDir)
+		}
+	}
+}
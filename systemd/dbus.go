@@ -0,0 +1,129 @@
+/**
+ *   Copyright 2018 Platform9 Systems, Inc.
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// dbusManager manages units through the systemd D-Bus API
+type dbusManager struct {
+	conn *dbus.Conn
+}
+
+// NewDBusManager returns a manager connected to systemd over D-Bus
+func NewDBusManager() (Manager, error) {
+	conn, err := dbus.New()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to systemd: %v", err)
+	}
+	return &dbusManager{conn: conn}, nil
+}
+
+func (m *dbusManager) Reload(ctx context.Context) error {
+	if err := m.conn.Reload(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+	return nil
+}
+
+func (m *dbusManager) Start(ctx context.Context, unit string) error {
+	return m.runJob(ctx, "start", unit, m.conn.StartUnit)
+}
+
+func (m *dbusManager) Stop(ctx context.Context, unit string) error {
+	return m.runJob(ctx, "stop", unit, m.conn.StopUnit)
+}
+
+// runJob enqueues a job and waits for its result, which is one of done,
+// canceled, timeout, failed, dependency or skipped
+func (m *dbusManager) runJob(ctx context.Context, op, unit string, enqueue func(string, string, chan<- string) (int, error)) error {
+	// The channel is buffered, so the result of a job we stopped waiting for
+	// does not block the D-Bus dispatcher
+	ch := make(chan string, 1)
+	if _, err := enqueue(unit, "replace", ch); err != nil {
+		return fmt.Errorf("failed to %s unit %s: %v", op, unit, err)
+	}
+	var result string
+	select {
+	case result = <-ch:
+	case <-time.After(JobTimeout):
+		result = "timeout"
+	case <-ctx.Done():
+		return fmt.Errorf("failed to %s unit %s: %v", op, unit, ctx.Err())
+	}
+	if result == "done" {
+		return nil
+	}
+	state, err := m.State(ctx, unit)
+	if err != nil {
+		return fmt.Errorf("failed to %s unit %s: job %s", op, unit, result)
+	}
+	return &JobError{Op: op, Unit: unit, Result: result, State: state}
+}
+
+func (m *dbusManager) Enable(ctx context.Context, unit string) error {
+	if _, _, err := m.conn.EnableUnitFiles([]string{unit}, false, true); err != nil {
+		return fmt.Errorf("failed to enable unit: %v", err)
+	}
+	return nil
+}
+
+func (m *dbusManager) Disable(ctx context.Context, unit string) error {
+	if _, err := m.conn.DisableUnitFiles([]string{unit}, false); err != nil {
+		return fmt.Errorf("failed to disable unit: %v", err)
+	}
+	return nil
+}
+
+func (m *dbusManager) ResetFailed(ctx context.Context, unit string) error {
+	if err := m.conn.ResetFailedUnit(unit); err != nil {
+		return fmt.Errorf("failed to reset failed unit: %v", err)
+	}
+	return nil
+}
+
+func (m *dbusManager) State(ctx context.Context, unit string) (UnitState, error) {
+	props, err := m.conn.GetUnitProperties(unit)
+	if err != nil {
+		return UnitState{}, fmt.Errorf("failed to get state of unit %s: %v", unit, err)
+	}
+	activeState, _ := props["ActiveState"].(string)
+	subState, _ := props["SubState"].(string)
+	state := UnitState{ActiveState: activeState, SubState: subState}
+	if strings.HasSuffix(unit, ".service") {
+		// Older systemd versions do not count restarts
+		if prop, err := m.conn.GetServiceProperty(unit, "NRestarts"); err == nil {
+			state.Restarts, _ = prop.Value.Value().(uint32)
+		}
+	}
+	return state, nil
+}
+
+func (m *dbusManager) Enabled(ctx context.Context, unit string) (bool, error) {
+	prop, err := m.conn.GetUnitProperty(unit, "UnitFileState")
+	if err != nil {
+		return false, fmt.Errorf("failed to get unit file state of unit %s: %v", unit, err)
+	}
+	state, _ := prop.Value.Value().(string)
+	return state == "enabled" || state == "enabled-runtime", nil
+}
@@ -0,0 +1,138 @@
+/**
+ *   Copyright 2018 Platform9 Systems, Inc.
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+// execManager manages units by running systemctl
+type execManager struct{}
+
+// NewExecManager returns a manager that runs systemctl
+func NewExecManager() Manager {
+	return execManager{}
+}
+
+func (execManager) Reload(ctx context.Context) error {
+	if _, err := systemctl(ctx, "daemon-reload"); err != nil {
+		return fmt.Errorf("failed to reload systemd: %v", err)
+	}
+	return nil
+}
+
+func (m execManager) Start(ctx context.Context, unit string) error {
+	return m.runJob(ctx, "start", unit)
+}
+
+func (m execManager) Stop(ctx context.Context, unit string) error {
+	return m.runJob(ctx, "stop", unit)
+}
+
+// runJob runs a systemctl command, which waits for the job to complete
+func (m execManager) runJob(ctx context.Context, op, unit string) error {
+	jobCtx, cancel := context.WithTimeout(ctx, JobTimeout)
+	defer cancel()
+	if _, err := systemctl(jobCtx, op, unit); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to %s unit %s: %v", op, unit, ctx.Err())
+		}
+		result := "failed"
+		if jobCtx.Err() == context.DeadlineExceeded {
+			result = "timeout"
+		}
+		state, stateErr := m.State(ctx, unit)
+		if stateErr != nil {
+			return fmt.Errorf("failed to %s unit %s: %v", op, unit, err)
+		}
+		return &JobError{Op: op, Unit: unit, Result: result, State: state}
+	}
+	return nil
+}
+
+func (execManager) Enable(ctx context.Context, unit string) error {
+	if _, err := systemctl(ctx, "enable", unit); err != nil {
+		return fmt.Errorf("failed to enable unit: %v", err)
+	}
+	return nil
+}
+
+func (execManager) Disable(ctx context.Context, unit string) error {
+	if _, err := systemctl(ctx, "disable", unit); err != nil {
+		return fmt.Errorf("failed to disable unit: %v", err)
+	}
+	return nil
+}
+
+func (execManager) ResetFailed(ctx context.Context, unit string) error {
+	if _, err := systemctl(ctx, "reset-failed", unit); err != nil {
+		return fmt.Errorf("failed to reset failed unit: %v", err)
+	}
+	return nil
+}
+
+func (execManager) State(ctx context.Context, unit string) (UnitState, error) {
+	props, err := showProperties(ctx, unit, "ActiveState", "SubState", "NRestarts")
+	if err != nil {
+		return UnitState{}, fmt.Errorf("failed to get state of unit %s: %v", unit, err)
+	}
+	state := UnitState{ActiveState: props["ActiveState"], SubState: props["SubState"]}
+	if restarts, err := strconv.ParseUint(props["NRestarts"], 10, 32); err == nil {
+		state.Restarts = uint32(restarts)
+	}
+	return state, nil
+}
+
+func (execManager) Enabled(ctx context.Context, unit string) (bool, error) {
+	props, err := showProperties(ctx, unit, "UnitFileState")
+	if err != nil {
+		return false, fmt.Errorf("failed to get unit file state of unit %s: %v", unit, err)
+	}
+	state := props["UnitFileState"]
+	return state == "enabled" || state == "enabled-runtime", nil
+}
+
+// showProperties returns properties of a unit
+func showProperties(ctx context.Context, unit string, names ...string) (map[string]string, error) {
+	args := []string{"show"}
+	for _, name := range names {
+		args = append(args, "--property="+name)
+	}
+	out, err := systemctl(ctx, append(args, unit)...)
+	if err != nil {
+		return nil, err
+	}
+	props := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			props[parts[0]] = parts[1]
+		}
+	}
+	return props, nil
+}
+
+// systemctl runs systemctl and returns its stdout
+func systemctl(ctx context.Context, args ...string) (string, error) {
+	out, err := host.Output(ctx, "systemctl", args...)
+	return string(out), err
+}
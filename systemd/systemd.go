@@ -17,158 +17,207 @@
 package systemd
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
-	"strings"
+	"sync"
+	"time"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/host"
 )
 
-func reloadSystemd() error {
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
-		return fmt.Errorf("failed to reload systemd: %v", err)
+// JobTimeout is how long to wait for a start or stop job to complete
+var JobTimeout = 5 * time.Minute
+
+// Manager manages systemd units. Start, Stop, Enable and Disable do not
+// reload systemd; call Reload once after a batch of unit files is written.
+// Start and Stop stop waiting for their job when ctx is done.
+type Manager interface {
+	// Reload reloads the unit files of systemd
+	Reload(ctx context.Context) error
+	// Start starts a unit and waits for the start job to complete
+	Start(ctx context.Context, unit string) error
+	// Stop stops a unit and waits for the stop job to complete
+	Stop(ctx context.Context, unit string) error
+	// Enable enables a unit
+	Enable(ctx context.Context, unit string) error
+	// Disable disables a unit
+	Disable(ctx context.Context, unit string) error
+	// ResetFailed resets the state of a failed unit
+	ResetFailed(ctx context.Context, unit string) error
+	// State returns the state of a unit
+	State(ctx context.Context, unit string) (UnitState, error)
+	// Enabled checks if a unit is enabled
+	Enabled(ctx context.Context, unit string) (bool, error)
+}
+
+// UnitState is the state of a unit, as reported by systemd
+type UnitState struct {
+	// ActiveState is e.g. "active", "activating" or "failed"
+	ActiveState string
+	// SubState is specific to the unit type, e.g. "running" or "auto-restart"
+	SubState string
+	// Restarts is the number of automatic restarts of a service. It is
+	// always zero for other units, and on systemd older than 235.
+	Restarts uint32
+}
+
+func (s UnitState) String() string {
+	return fmt.Sprintf("ActiveState=%s SubState=%s", s.ActiveState, s.SubState)
+}
+
+// JobError is returned when a start or stop job does not complete successfully
+type JobError struct {
+	// Op is the job type, e.g. "start"
+	Op   string
+	Unit string
+	// Result is the job result, e.g. "failed" or "timeout"
+	Result string
+	// State is the state of the unit after the job
+	State UnitState
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("failed to %s unit %s: job %s (%s)", e.Op, e.Unit, e.Result, e.State)
+}
+
+var (
+	managerOnce sync.Once
+	manager     Manager
+)
+
+// SetManager replaces the manager used by the package functions
+func SetManager(m Manager) {
+	managerOnce.Do(func() {})
+	manager = m
+}
+
+// defaultManager returns the manager used by the package functions. It talks
+// to systemd over D-Bus, and falls back to systemctl when D-Bus is unavailable.
+func defaultManager() Manager {
+	managerOnce.Do(func() {
+		m, err := NewDBusManager()
+		if err != nil {
+			log.Debugf("Unable to connect to systemd over D-Bus, using systemctl: %v", err)
+			manager = NewExecManager()
+			return
+		}
+		manager = m
+	})
+	return manager
+}
+
+// planned records a systemd action while the host is planning, and reports
+// whether it did
+func planned(format string, args ...interface{}) bool {
+	if !host.Planning() {
+		return false
 	}
-	return nil
+	host.Record(host.SystemdAction, format, args...)
+	return true
 }
 
-// Start starts a systemd unit
-func Start(unit string) error {
-	// Before we try to start any unit, make sure that systemd is ready
-	if err := reloadSystemd(); err != nil {
-		return err
+// Reload reloads the unit files of systemd
+func Reload(ctx context.Context) error {
+	if planned("daemon-reload") {
+		return nil
 	}
-	args := []string{"start", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		return fmt.Errorf("failed to start unit: %v", err)
+	return defaultManager().Reload(ctx)
+}
+
+// Start starts a systemd unit
+func Start(ctx context.Context, unit string) error {
+	if planned("start %s", unit) {
+		return nil
 	}
-	return nil
+	return defaultManager().Start(ctx, unit)
 }
 
 // Stop stops a systemd unit
-func Stop(unit string) error {
-	// Before we try to start any unit, make sure that systemd is ready
-	if err := reloadSystemd(); err != nil {
-		return err
-	}
-	args := []string{"stop", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		return fmt.Errorf("failed to stop unit: %v", err)
+func Stop(ctx context.Context, unit string) error {
+	if planned("stop %s", unit) {
+		return nil
 	}
-	return nil
+	return defaultManager().Stop(ctx, unit)
 }
 
 // Enable enables a systemd unit
-func Enable(unit string) error {
-	// Before we try to enable any unit, make sure that systemd is ready
-	if err := reloadSystemd(); err != nil {
-		return err
-	}
-	args := []string{"enable", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		return fmt.Errorf("failed to enable unit: %v", err)
+func Enable(ctx context.Context, unit string) error {
+	if planned("enable %s", unit) {
+		return nil
 	}
-	return nil
+	return defaultManager().Enable(ctx, unit)
 }
 
 // Disable disables a systemd unit
-func Disable(unit string) error {
-	// Before we try to disable any unit, make sure that systemd is ready
-	if err := reloadSystemd(); err != nil {
-		return err
+func Disable(ctx context.Context, unit string) error {
+	if planned("disable %s", unit) {
+		return nil
 	}
-	args := []string{"disable", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		return fmt.Errorf("failed to disable unit: %v", err)
+	return defaultManager().Disable(ctx, unit)
+}
+
+// ResetFailed resets the state of a failed systemd unit
+func ResetFailed(ctx context.Context, unit string) error {
+	if planned("reset-failed %s", unit) {
+		return nil
 	}
-	return nil
+	return defaultManager().ResetFailed(ctx, unit)
+}
+
+// State returns the ActiveState and SubState of a systemd unit
+func State(ctx context.Context, unit string) (UnitState, error) {
+	return defaultManager().State(ctx, unit)
+}
+
+// Enabled checks if a systemd unit is enabled
+func Enabled(ctx context.Context, unit string) (bool, error) {
+	return defaultManager().Enabled(ctx, unit)
 }
 
 // EnableAndStartUnit enables and starts a systemd unit
-func EnableAndStartUnit(unit string) error {
-	if err := Enable(unit); err != nil {
+func EnableAndStartUnit(ctx context.Context, unit string) error {
+	if err := Enable(ctx, unit); err != nil {
 		return err
 	}
-	return Start(unit)
+	return Start(ctx, unit)
 }
 
 // DisableAndStopUnit disables and stops a systemd unit
-func DisableAndStopUnit(unit string) error {
-	if err := Disable(unit); err != nil {
+func DisableAndStopUnit(ctx context.Context, unit string) error {
+	if err := Disable(ctx, unit); err != nil {
 		return err
 	}
-	return Stop(unit)
+	return Stop(ctx, unit)
 }
 
 // Active checks if a systemd unit is active
-func Active(unit string) (bool, error) {
-	args := []string{"is-active", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		switch v := err.(type) {
-		case *exec.Error:
-			return false, fmt.Errorf("failed to run command %q: %s", v.Name, v.Err)
-		case *exec.ExitError:
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
-}
-
-// Enabled checks if a systemd unit is enabled
-func Enabled(unit string) (bool, error) {
-	args := []string{"is-enabled", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		switch v := err.(type) {
-		case *exec.Error:
-			return false, fmt.Errorf("failed to run command %q: %s", v.Name, v.Err)
-		case *exec.ExitError:
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
-}
-
-// ResetFailed resets the state of a failed systemd unit
-func ResetFailed(unit string) error {
-	args := []string{"reset-failed", unit}
-	if err := exec.Command("systemctl", args...).Run(); err != nil {
-		return fmt.Errorf("failed to reset failed unit: %v", err)
+func Active(ctx context.Context, unit string) (bool, error) {
+	state, err := State(ctx, unit)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	return state.ActiveState == "active", nil
 }
 
 // Failed checks if a systemd unit is in a failed state
-func Failed(unit string) (bool, error) {
-	args := []string{"is-failed", unit}
-	out, err := exec.Command("systemctl", args...).CombinedOutput()
-
+func Failed(ctx context.Context, unit string) (bool, error) {
+	state, err := State(ctx, unit)
 	if err != nil {
-		switch err.(type) {
-		// systemctl ran and exited
-		case *exec.ExitError:
-			return false, nil
-		// exec encountered a different error
-		default:
-			return false, err
-		}
-	}
-	// We could return true,nil here but let's check stdout just to make sure
-	if strings.TrimSpace(string(out)) == "failed" {
-		return true, nil
+		return false, err
 	}
-	// We shouldn't hit this point but this is required.
-	return false, nil
+	return state.ActiveState == "failed", nil
 }
 
 // DisableIfEnabled disables a systemd unit if it is enabled
-func DisableIfEnabled(unit string) error {
-	enabled, err := Enabled(unit)
+func DisableIfEnabled(ctx context.Context, unit string) error {
+	enabled, err := Enabled(ctx, unit)
 	if err != nil {
 		return fmt.Errorf("unable to check if unit %s is enabled: %v", unit, err)
 	}
 	if enabled {
-		if err := Disable(unit); err != nil {
+		if err := Disable(ctx, unit); err != nil {
 			return fmt.Errorf("unable to disable unit %s: %v", unit, err)
 		}
 	}
@@ -176,13 +225,13 @@ func DisableIfEnabled(unit string) error {
 }
 
 // StopIfActive stops a systemd unit if it is active
-func StopIfActive(unit string) error {
-	active, err := Active(unit)
+func StopIfActive(ctx context.Context, unit string) error {
+	active, err := Active(ctx, unit)
 	if err != nil {
 		return fmt.Errorf("unable to check if unit %s is active: %v", unit, err)
 	}
 	if active {
-		if err := Stop(unit); err != nil {
+		if err := Stop(ctx, unit); err != nil {
 			return fmt.Errorf("unable to stop unit %s: %v", unit, err)
 		}
 	}
@@ -0,0 +1,134 @@
+/**
+ *   Copyright 2018 Platform9 Systems, Inc.
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+var (
+	// SettlePeriod is how long a unit must stay active to be considered healthy
+	SettlePeriod = 5 * time.Second
+	// JournalLines is the number of journal lines attached to a UnitError
+	JournalLines = 20
+	// pollInterval is how often the state of a unit is checked
+	pollInterval = time.Second
+)
+
+// UnitError is returned when a unit does not become healthy
+type UnitError struct {
+	Unit   string
+	Reason string
+	// State is the last observed state of the unit
+	State UnitState
+	// Journal holds the last journal lines of the unit
+	Journal []string
+}
+
+func (e *UnitError) Error() string {
+	msg := fmt.Sprintf("unit %s %s (%s)", e.Unit, e.Reason, e.State)
+	if len(e.Journal) == 0 {
+		return msg
+	}
+	return msg + ", last journal entries:\n\t" + strings.Join(e.Journal, "\n\t")
+}
+
+// WaitActive waits until a unit has been active for SettlePeriod. It fails
+// early if the unit fails, stops, or is still restarting restartLoop after it
+// first restarted, and when ctx is done.
+func WaitActive(ctx context.Context, unit string, timeout, restartLoop time.Duration) error {
+	if planned("wait for %s to become active", unit) {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	initial, err := State(ctx, unit)
+	if err != nil {
+		return err
+	}
+	state := initial
+	var activeSince, restartingSince time.Time
+	var autoRestarts uint32
+	for {
+		restarts := autoRestarts
+		if state.Restarts > initial.Restarts && state.Restarts-initial.Restarts > restarts {
+			restarts = state.Restarts - initial.Restarts
+		}
+		if restarts > 0 && restartingSince.IsZero() {
+			restartingSince = time.Now()
+		}
+		switch {
+		case !restartingSince.IsZero() && state.ActiveState != "active" && time.Since(restartingSince) >= restartLoop:
+			return unitError(ctx, unit, fmt.Sprintf("is in a restart loop, it restarted %d times in %v", restarts, restartLoop), state)
+		case state.ActiveState == "failed":
+			return unitError(ctx, unit, "failed", state)
+		case state.ActiveState == "inactive":
+			return unitError(ctx, unit, "stopped", state)
+		case state.ActiveState == "active":
+			if activeSince.IsZero() {
+				activeSince = time.Now()
+			}
+			if time.Since(activeSince) >= SettlePeriod {
+				return nil
+			}
+		default:
+			activeSince = time.Time{}
+		}
+		if time.Now().After(deadline) {
+			return unitError(ctx, unit, fmt.Sprintf("did not become active within %v", timeout), state)
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for unit %s: %v", unit, ctx.Err())
+		}
+
+		previous := state
+		if state, err = State(ctx, unit); err != nil {
+			return err
+		}
+		if state.SubState == "auto-restart" && previous.SubState != "auto-restart" {
+			autoRestarts++
+			activeSince = time.Time{}
+		}
+	}
+}
+
+func unitError(ctx context.Context, unit, reason string, state UnitState) error {
+	journal, err := Journal(ctx, unit, JournalLines)
+	if err != nil {
+		journal = []string{fmt.Sprintf("unable to read journal: %v", err)}
+	}
+	return &UnitError{Unit: unit, Reason: reason, State: state, Journal: journal}
+}
+
+// Journal returns the last lines of the journal of a unit
+func Journal(ctx context.Context, unit string, lines int) ([]string, error) {
+	out, err := host.Output(ctx, "journalctl", "--unit="+unit, fmt.Sprintf("--lines=%d", lines), "--no-pager", "--quiet")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal of unit %s: %v", unit, err)
+	}
+	trimmed := strings.TrimSpace(string(out))
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	return strings.Split(trimmed, "\n"), nil
+}
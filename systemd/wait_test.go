@@ -0,0 +1,64 @@
+package systemd
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/platform9/nodeadm/host"
+)
+
+// unitStates answers systemctl show with states in order, repeating the last
+type unitStates struct {
+	mu     sync.Mutex
+	states []string
+}
+
+func (u *unitStates) Run(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	if name != "systemctl" || len(args) == 0 || args[0] != "show" {
+		return nil, nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	state := u.states[0]
+	if len(u.states) > 1 {
+		u.states = u.states[1:]
+	}
+	return []byte(state), nil
+}
+
+func waitWithStates(t *testing.T, restartLoop time.Duration, states ...string) error {
+	defer host.SetExecutor(host.SetExecutor(&unitStates{states: states}))
+	SetManager(NewExecManager())
+	defer func(settle, poll time.Duration) { SettlePeriod, pollInterval = settle, poll }(SettlePeriod, pollInterval)
+	SettlePeriod, pollInterval = 0, time.Millisecond
+	return WaitActive(context.Background(), "kubelet.service", time.Minute, restartLoop)
+}
+
+func TestWaitActiveAfterRestarts(t *testing.T) {
+	// The kubelet restarts twice until kubeadm configures it, then settles
+	err := waitWithStates(t, time.Minute,
+		"ActiveState=activating\nSubState=auto-restart\nNRestarts=0\n",
+		"ActiveState=activating\nSubState=start\nNRestarts=1\n",
+		"ActiveState=activating\nSubState=auto-restart\nNRestarts=1\n",
+		"ActiveState=activating\nSubState=start\nNRestarts=2\n",
+		"ActiveState=active\nSubState=running\nNRestarts=2\n",
+	)
+	if err != nil {
+		t.Errorf("expected the kubelet to settle, got %v", err)
+	}
+}
+
+func TestWaitActiveRestartLoop(t *testing.T) {
+	err := waitWithStates(t, 10*time.Millisecond,
+		"ActiveState=activating\nSubState=auto-restart\nNRestarts=0\n",
+		"ActiveState=activating\nSubState=start\nNRestarts=1\n",
+		"ActiveState=activating\nSubState=auto-restart\nNRestarts=1\n",
+	)
+	if err == nil || !strings.Contains(err.Error(), "restart loop") {
+		t.Errorf("expected a restart loop, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractTarGz extracts a gzipped tarball into dir. Entries that would be
+// written outside of dir, including through symlinks, are rejected.
+func ExtractTarGz(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %v", file, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("unable to decompress %q: %v", file, err)
+	}
+	defer gz.Close()
+	dir = filepath.Clean(dir)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read %q: %v", file, err)
+		}
+		target, err := containedPath(dir, dir, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("refusing to extract %q: %v", file, err)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return fmt.Errorf("unable to extract %q: %v", file, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := extractFile(tr, target, mode); err != nil {
+				return fmt.Errorf("unable to extract %q: %v", file, err)
+			}
+		case tar.TypeSymlink:
+			if _, err := containedPath(dir, filepath.Dir(target), hdr.Linkname); err != nil {
+				return fmt.Errorf("refusing to extract %q: symlink %s: %v", file, hdr.Name, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("unable to extract %q: %v", file, err)
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("unable to extract %q: %v", file, err)
+			}
+		case tar.TypeLink:
+			source, err := containedPath(dir, dir, hdr.Linkname)
+			if err != nil {
+				return fmt.Errorf("refusing to extract %q: hard link %s: %v", file, hdr.Name, err)
+			}
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("unable to extract %q: %v", file, err)
+			}
+		default:
+			return fmt.Errorf("unable to extract %q: unsupported type of entry %s", file, hdr.Name)
+		}
+	}
+}
+
+// containedPath resolves name relative to base, and checks that the result is
+// dir or below it
+func containedPath(dir, base, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("absolute path %s", name)
+	}
+	path := filepath.Join(base, name)
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside of %s", name, dir)
+	}
+	// Never write through a symlink extracted earlier, it may resolve elsewhere
+	for parent := filepath.Dir(path); strings.HasPrefix(parent, dir+string(filepath.Separator)); parent = filepath.Dir(parent) {
+		if info, err := os.Lstat(parent); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path %s is below symlink %s", name, parent)
+		}
+	}
+	return path, nil
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// Replace symlinks instead of writing through them
+	os.Remove(target)
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
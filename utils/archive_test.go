@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func writeTarGz(t *testing.T, path string, entries []entry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0755, Size: int64(len(e.content)), Linkname: e.linkname}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTarGz(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		wantErr bool
+	}{
+		{"files", []entry{
+			{name: "./bin/", typeflag: tar.TypeDir},
+			{name: "./bin/bridge", typeflag: tar.TypeReg, content: "bridge"},
+			{name: "./loopback", typeflag: tar.TypeSymlink, linkname: "bin/bridge"},
+		}, false},
+		{"parent", []entry{{name: "../evil", typeflag: tar.TypeReg, content: "x"}}, true},
+		{"absolute", []entry{{name: "/evil", typeflag: tar.TypeReg, content: "x"}}, true},
+		{"escaping symlink", []entry{{name: "link", typeflag: tar.TypeSymlink, linkname: "../.."}}, true},
+		{"through symlink", []entry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "link/evil", typeflag: tar.TypeReg, content: "x"},
+		}, true},
+		{"hard link", []entry{{name: "link", typeflag: tar.TypeLink, linkname: "../evil"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "nodeadm-archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			archive := filepath.Join(tmp, "archive.tgz")
+			writeTarGz(t, archive, tt.entries)
+			dir := filepath.Join(tmp, "out")
+			err = ExtractTarGz(archive, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractTarGz() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Lstat(filepath.Join(tmp, "evil")); err == nil {
+				t.Fatal("file written outside of the destination")
+			}
+			if !tt.wantErr {
+				content, err := ioutil.ReadFile(filepath.Join(dir, "loopback"))
+				if err != nil || string(content) != "bridge" {
+					t.Fatalf("unexpected content %q: %v", content, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/platform9/nodeadm/apis"
+)
+
+const dockerHubRegistry = "docker.io"
+
+// dockerConfig is the subset of a docker config.json that holds credentials
+type dockerConfig struct {
+	Auths map[string]types.AuthConfig `json:"auths"`
+}
+
+// RegistryAuths returns the credentials of every configured registry, keyed
+// by registry host
+func RegistryAuths(config apis.RegistryAuthConfiguration) (map[string]types.AuthConfig, error) {
+	auths := make(map[string]types.AuthConfig)
+	if len(config.DockerConfigFile) != 0 {
+		b, err := ioutil.ReadFile(config.DockerConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read docker config file %q: %v", config.DockerConfigFile, err)
+		}
+		var dc dockerConfig
+		if err := json.Unmarshal(b, &dc); err != nil {
+			return nil, fmt.Errorf("unable to parse docker config file %q: %v", config.DockerConfigFile, err)
+		}
+		for server, auth := range dc.Auths {
+			if auth.Auth != "" && auth.Username == "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decode credentials for %q in %q: %v", server, config.DockerConfigFile, err)
+				}
+				parts := strings.SplitN(string(decoded), ":", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("invalid credentials for %q in %q", server, config.DockerConfigFile)
+				}
+				auth.Username, auth.Password = parts[0], parts[1]
+			}
+			auth.Auth = ""
+			host := normalizeRegistryHost(server)
+			auth.ServerAddress = host
+			auths[host] = auth
+		}
+	}
+	for server, credentials := range config.Credentials {
+		host := normalizeRegistryHost(server)
+		auths[host] = types.AuthConfig{
+			Username:      credentials.Username,
+			Password:      credentials.Password,
+			ServerAddress: host,
+		}
+	}
+	return auths, nil
+}
+
+// RegistryAuthFor returns the credentials for the registry of an image, or
+// nil if there are none
+func RegistryAuthFor(auths map[string]types.AuthConfig, image string) *types.AuthConfig {
+	auth, ok := auths[RegistryHost(image)]
+	if !ok {
+		return nil
+	}
+	return &auth
+}
+
+// RegistryHost returns the host of the registry an image is pulled from
+func RegistryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return dockerHubRegistry
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHubRegistry
+	}
+	return normalizeRegistryHost(host)
+}
+
+// normalizeRegistryHost turns the server addresses found in docker config
+// files, e.g. "https://index.docker.io/v1/", into a registry host
+func normalizeRegistryHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubRegistry
+	}
+	return host
+}
@@ -32,3 +32,17 @@ func JoinConfigurationFromFile(path string) (*apis.JoinConfiguration, error) {
 	}
 	return &config, nil
 }
+
+// CacheConfigurationFromFile reads the cache configuration shared by the init
+// and join configuration files
+func CacheConfigurationFromFile(path string) (*apis.CacheConfiguration, error) {
+	f, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+	config := apis.CacheConfiguration{}
+	if err := yaml.Unmarshal(f, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse config file: %v", err)
+	}
+	return &config, nil
+}
@@ -5,16 +5,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
 )
 
 type Artifact struct {
@@ -43,18 +44,6 @@ var NodeArtifact = []Artifact{
 		Upstream: fmt.Sprintf("https://storage.googleapis.com/kubernetes-release/release/%s/bin/linux/amd64/", constants.KubernetesVersion),
 		Local:    filepath.Join(constants.CacheDir, constants.KubeDirName),
 	},
-	{
-		Name:     constants.KubeletSystemdUnitFilename,
-		Type:     "regular",
-		Upstream: fmt.Sprintf("https://raw.githubusercontent.com/kubernetes/kubernetes/%s/build/debs/", constants.KubernetesVersion),
-		Local:    filepath.Join(constants.CacheDir, constants.KubeDirName),
-	},
-	{
-		Name:     constants.KubeadmKubeletSystemdDropinFilename,
-		Type:     "regular",
-		Upstream: fmt.Sprintf("https://raw.githubusercontent.com/kubernetes/kubernetes/%s/build/debs/", constants.KubernetesVersion),
-		Local:    filepath.Join(constants.CacheDir, constants.KubeDirName),
-	},
 	{
 		Name:     constants.CNIPluginsFilename,
 		Type:     "regular",
@@ -69,55 +58,83 @@ var NodeArtifact = []Artifact{
 	},
 }
 
-func loadAvailableImages(cli *client.Client) {
-	os.MkdirAll(constants.ImagesCacheDir, constants.Execute)
-	files, err := ioutil.ReadDir(constants.ImagesCacheDir)
+func loadAvailableImages(ctx context.Context, rt containerruntime.Runtime) error {
+	if _, err := os.Stat(host.Path(constants.ImagesCacheDir)); os.IsNotExist(err) && host.Planning() {
+		return nil
+	}
+	if err := os.MkdirAll(host.Path(constants.ImagesCacheDir), constants.Execute); err != nil {
+		return fmt.Errorf("unable to create dir %q: %v", constants.ImagesCacheDir, err)
+	}
+	files, err := ioutil.ReadDir(host.Path(constants.ImagesCacheDir))
 	if err != nil {
-		log.Errorf("\nFailed to list files from dir %s skipping loading images with err %v", constants.ImagesCacheDir, err)
+		return fmt.Errorf("unable to list cached images in %q: %v", constants.ImagesCacheDir, err)
 	}
 	for _, file := range files {
-		cmd := exec.Command("docker", "load", "-i", filepath.Join(constants.ImagesCacheDir, file.Name()))
-		err = cmd.Run()
-		if err != nil {
-			log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
+		// Skip the leftovers of interrupted exports
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if plannedImage("import %s", filepath.Join(constants.ImagesCacheDir, file.Name())) {
+			continue
+		}
+		if err := rt.ImportImages(ctx, host.Path(filepath.Join(constants.ImagesCacheDir, file.Name()))); err != nil {
+			return fmt.Errorf("unable to load cached images: %v", err)
 		}
 	}
+	return nil
 }
 
-func PopulateCache() {
-	cli, err := client.NewEnvClient()
-	if err != nil {
-		log.Fatalf("Failed to create docker client with error %v", err)
-	}
-	loadAvailableImages(cli)
-	for _, image := range GetImages() {
-		//first check if image is already in docker cache
-		nameFilter := filters.NewArgs()
-		nameFilter.Add("reference", image)
-		log.Infof("Checking if image %s is available in docker cache", image)
-		list, err := cli.ImageList(context.Background(), types.ImageListOptions{
-			Filters: nameFilter,
-		})
-		if err != nil {
-			log.Fatalf("\nFailed to list images with error %v", err)
-		}
-		if len(list) == 0 {
-			log.Infof("Trying to pull image %s", image)
-			cmd := exec.Command("docker", "pull", image)
-			err = cmd.Run()
-			if err != nil {
-				log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
-			}
+// TagImages tags the cached upstream images with the names they resolve to
+func TagImages(ctx context.Context, rt containerruntime.Runtime, config apis.ImageConfiguration) error {
+	for _, upstream := range GetImages() {
+		image := ResolveImage(config, upstream)
+		if image == upstream {
+			continue
+		}
+		if plannedImage("tag %s as %s", upstream, image) {
+			continue
+		}
+		if err := rt.TagImage(ctx, upstream, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageFilename returns the name of the cache file of an image
+func imageFilename(image string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image) + ".tar"
+}
 
+// PopulateCache pulls the images and downloads the artifacts nodeadm installs,
+// unless they are cached
+func PopulateCache(ctx context.Context, config apis.CacheConfiguration) error {
+	rt, err := containerruntime.New(config.ContainerRuntime)
+	if err != nil {
+		return fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	if err := loadAvailableImages(ctx, rt); err != nil {
+		return err
+	}
+	var keyring *Keyring
+	if config.SignatureVerification.Insecure {
+		log.Warnf("Skipping signature verification of downloaded artifacts")
+	} else {
+		if len(config.SignatureVerification.Keyring) == 0 {
+			return fmt.Errorf("no signature keyring configured. Set signatureVerification.keyring, or skip verification with signatureVerification.insecure or --insecure-skip-signature-verification")
 		}
-		list, err = cli.ImageList(context.Background(), types.ImageListOptions{
-			Filters: nameFilter,
-		})
-		imageFile := filepath.Join(constants.ImagesCacheDir, strings.Replace(list[0].ID, "sha256:", "", -1)+".tar")
-		cmd := exec.Command("docker", "save", image, "-o", imageFile)
-		err = cmd.Run()
+		keyring, err = ReadKeyring(config.SignatureVerification.Keyring)
 		if err != nil {
-			log.Fatalf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
+			return fmt.Errorf("unable to read signature keyring: %v", err)
+		}
+	}
+	auths, err := RegistryAuths(config.RegistryAuth)
+	if err != nil {
+		return fmt.Errorf("unable to read registry credentials: %v", err)
+	}
+	for _, upstream := range GetImages() {
+		if err := cacheImage(ctx, rt, config, auths, upstream); err != nil {
+			return err
 		}
 	}
 	for _, file := range NodeArtifact {
@@ -125,7 +142,112 @@ func PopulateCache() {
 		if file.Type == "executable" {
 			mode = constants.Execute
 		}
-		os.MkdirAll(file.Local, constants.Execute)
-		Download(filepath.Join(file.Local, file.Name), file.Upstream+file.Name, os.FileMode(mode))
+		if err := download(ctx, filepath.Join(file.Local, file.Name), file.Upstream+file.Name, os.FileMode(mode), config.Timeouts.Download.Duration); err != nil {
+			return err
+		}
+		if keyring != nil {
+			if err := verifyArtifact(ctx, keyring, config, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cacheImage pulls an image unless it is present in the runtime, and exports
+// it into the image cache
+func cacheImage(ctx context.Context, rt containerruntime.Runtime, config apis.CacheConfiguration, auths map[string]types.AuthConfig, upstream string) error {
+	image := ResolveImage(config.ImageConfiguration, upstream)
+	//first check if image is already in the runtime cache
+	log.Infof("Checking if image %s is available in %s cache", image, rt.Name())
+	present, err := rt.ImagePresent(ctx, image)
+	if err != nil {
+		return err
+	}
+	if !present && plannedImage("pull %s", image) {
+		present = true
+	}
+	if !present {
+		log.Infof("Trying to pull image %s", image)
+		if err := pullImage(ctx, rt, image, RegistryAuthFor(auths, image), config.Timeouts.ImagePull.Duration); err != nil {
+			return err
+		}
+		present, err = rt.ImagePresent(ctx, image)
+		if err != nil {
+			return err
+		}
+		if !present {
+			return fmt.Errorf("image %s is not present after pulling it", image)
+		}
+	}
+	// Keep the upstream name as well, so the local registry can serve
+	// the image under it
+	names := []string{image}
+	if image != upstream {
+		if !plannedImage("tag %s as %s", image, upstream) {
+			if err := rt.TagImage(ctx, image, upstream); err != nil {
+				return err
+			}
+		}
+		names = append(names, upstream)
+	}
+	file := filepath.Join(constants.ImagesCacheDir, imageFilename(upstream))
+	if plannedImage("export %s to %s", strings.Join(names, ", "), file) {
+		return nil
+	}
+	return rt.ExportImages(ctx, host.Path(file), names...)
+}
+
+// plannedImage records an image operation while the host is planning, and
+// reports whether it did
+func plannedImage(format string, args ...interface{}) bool {
+	if !host.Planning() {
+		return false
+	}
+	host.Record(host.ImageAction, format, args...)
+	return true
+}
+
+// pullImage pulls an image, giving up after timeout
+func pullImage(ctx context.Context, rt containerruntime.Runtime, image string, auth *types.AuthConfig, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return rt.PullImage(ctx, image, auth)
+}
+
+// download downloads an artifact, giving up after timeout
+func download(ctx context.Context, fileName, url string, mode os.FileMode, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return Download(ctx, fileName, url, mode)
+}
+
+// verifyArtifact downloads the detached signature of a cached artifact and
+// verifies it. The artifact and signature are removed if verification fails,
+// so they are downloaded again by the next run.
+func verifyArtifact(ctx context.Context, keyring *Keyring, cacheConfig apis.CacheConfiguration, file Artifact) error {
+	config := cacheConfig.SignatureVerification
+	localFile := filepath.Join(file.Local, file.Name)
+	sigFile := localFile + ".sig"
+	sigURL := file.Upstream + file.Name + ".sig"
+	if len(config.SignatureURL) != 0 {
+		rel, err := filepath.Rel(constants.CacheDir, localFile)
+		if err != nil {
+			return fmt.Errorf("unable to derive signature URL of %q: %v", localFile, err)
+		}
+		sigURL = strings.TrimSuffix(config.SignatureURL, "/") + "/" + filepath.ToSlash(rel) + ".sig"
+	}
+	if err := download(ctx, sigFile, sigURL, constants.Read, cacheConfig.Timeouts.Download.Duration); err != nil {
+		return err
+	}
+	if host.Planning() {
+		return nil
+	}
+	if err := keyring.VerifyFile(host.Path(localFile), host.Path(sigFile)); err != nil {
+		os.Remove(host.Path(localFile))
+		os.Remove(host.Path(sigFile))
+		return fmt.Errorf("refusing to use %q: %v", localFile, err)
 	}
+	log.Infof("Verified signature of %s", localFile)
+	return nil
 }
@@ -1,61 +1,184 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
-)
 
-func ReplaceString(file string, from string, to string) {
-	read, err := ioutil.ReadFile(file)
-	if err != nil {
-		log.Fatalf("Failed to read file %s with error %v", file, err)
-	}
-	newContents := strings.Replace(string(read), from, to, -1)
-	err = ioutil.WriteFile(file, []byte(newContents), 0)
-	if err != nil {
-		log.Fatalf("Failed to write file %s with error %v", file, err)
-	}
-}
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+)
 
-func Substitute(file string, from string, to string) string {
-	read, err := ioutil.ReadFile(file)
+// Substitute returns the content of file with every from replaced by to
+func Substitute(file string, from string, to string) (string, error) {
+	read, err := ioutil.ReadFile(host.Path(file))
 	if err != nil {
-		log.Fatalf("Failed to read file %s with error %v", file, err)
+		return "", fmt.Errorf("unable to read %q: %v", file, err)
 	}
-	newContents := strings.Replace(string(read), from, to, -1)
-	return newContents
+	return strings.Replace(string(read), from, to, -1), nil
 }
 
-func Download(fileName string, url string, mode os.FileMode) {
+// Download downloads url to fileName unless it exists, and sets its mode. The
+// download is abandoned when ctx is done, and never leaves a partial file.
+func Download(ctx context.Context, fileName string, url string, mode os.FileMode) error {
 	log.Infof("Downloading %s to location %s", url, fileName)
-	_, err := os.Stat(fileName)
+	path := host.Path(fileName)
+	_, err := os.Stat(path)
 	if !os.IsNotExist(err) {
 		log.Infof("\nFile already exists %s", fileName)
-		if err := os.Chmod(fileName, mode); err != nil {
-			log.Fatalf("\nFailed to set permissions for file %s, with error %v", fileName, err)
-		}
+	} else if host.Planning() {
+		host.Record(host.FileAction, "download %s to %s", url, fileName)
+		return nil
 	} else {
-		file, err := os.Create(fileName)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
 		if err != nil {
-			log.Fatalf("\nFailed to create file %s with err %v", fileName, err)
+			return fmt.Errorf("unable to download %s: %v", url, err)
 		}
-		defer file.Close()
-		response, err := http.Get(url)
+		response, err := http.DefaultClient.Do(req.WithContext(ctx))
 		if err != nil {
-			log.Fatalf("\nFailed to download %s with error %v", url, err)
+			return fmt.Errorf("unable to download %s: %v", url, err)
 		}
 		defer response.Body.Close()
-		_, err = io.Copy(file, response.Body)
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("unable to download %s: server returned %s", url, response.Status)
+		}
+		err = writeAtomically(path, mode, func(w io.Writer) error {
+			_, err := io.Copy(w, response.Body)
+			return err
+		})
 		if err != nil {
-			log.Fatalf("\nFailed to save file %s with error %v", fileName, err)
+			return fmt.Errorf("unable to download %s to %q: %v", url, fileName, err)
 		}
 	}
-	if err := os.Chmod(fileName, mode); err != nil {
-		log.Fatalf("\nFailed to set permissions for file %s, with error %v", fileName, err)
+	if host.Planning() {
+		return nil
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("unable to set permissions of %q: %v", fileName, err)
+	}
+	return nil
+}
+
+// CopyFile copies src to dst, preserving its permissions. The copy is written
+// next to dst and renamed, so dst is replaced atomically even if it is running.
+func CopyFile(src, dst string) error {
+	if host.Planning() {
+		if !sameContent(src, dst) {
+			host.RecordCopy(dst, src)
+		}
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %v", src, err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat %q: %v", src, err)
+	}
+	err = writeAtomically(dst, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to copy %q to %q: %v", src, dst, err)
+	}
+	return nil
+}
+
+// WriteFile writes data to file atomically, creating its directory if needed.
+// An interrupted write leaves the previous content in place.
+func WriteFile(file string, data []byte, mode os.FileMode) error {
+	if host.Planning() {
+		host.RecordFile(file, data)
+		return nil
+	}
+	err := writeAtomically(file, mode, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %q: %v", file, err)
+	}
+	return nil
+}
+
+// GeneratedFile is a file nodeadm renders and writes on the host
+type GeneratedFile struct {
+	// Path is the path of the file on the host
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// WriteFiles writes generated files on the host
+func WriteFiles(files []GeneratedFile) error {
+	for _, file := range files {
+		if err := WriteFile(host.Path(file.Path), file.Data, file.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAtomically writes a temporary file next to file with write, and
+// renames it to file
+func writeAtomically(file string, mode os.FileMode, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(file), constants.Execute); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// sameContent checks if the files a and b exist and have the same content
+func sameContent(a, b string) bool {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false
+	}
+	defer fb.Close()
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == errA
+		}
+		if errA != nil || errB != nil {
+			return false
+		}
 	}
 }
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "nodeadm-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "artifact")
+	if err := Download(context.Background(), file, server.URL+"/artifact", 0755); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected mode %v", info.Mode())
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil || string(content) != "content" {
+		t.Errorf("unexpected content %q: %v", content, err)
+	}
+}
+
+func TestWriteAtomicallyKeepsContentOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodeadm-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := WriteFile(file, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = writeAtomically(file, 0644, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("interrupted")
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil || string(content) != "old" {
+		t.Errorf("unexpected content %q: %v", content, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected the temporary file to be removed, found %d files", len(files))
+	}
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+)
+
+// RenderHostFiles renders the list of kernel modules and the sysctls that
+// PrepareHost persists
+func RenderHostFiles(config apis.HostPreparationConfiguration) []GeneratedFile {
+	modules := strings.Join(constants.KernelModules, "\n") + "\n"
+	sysctls := fmt.Sprintf(`net.bridge.bridge-nf-call-iptables = 1
+net.bridge.bridge-nf-call-ip6tables = 1
+net.ipv4.ip_forward = 1
+net.netfilter.nf_conntrack_max = %d
+`, config.ConntrackMax)
+	return []GeneratedFile{
+		{Path: constants.ModulesLoadFile, Mode: constants.Read, Data: []byte(modules)},
+		{Path: constants.SysctlFile, Mode: constants.Read, Data: []byte(sysctls)},
+	}
+}
+
+// PrepareHost loads the kernel modules and sets the sysctls the kubelet and
+// the pod network need, now and on every boot, and disables swap if
+// configured to
+func PrepareHost(ctx context.Context, config apis.HostPreparationConfiguration) error {
+	if err := WriteFiles(RenderHostFiles(config)); err != nil {
+		return fmt.Errorf("unable to prepare host: %v", err)
+	}
+	for _, module := range constants.KernelModules {
+		if err := host.Run(ctx, constants.Modprobe, module); err != nil {
+			return fmt.Errorf("unable to load kernel module %s: %v", module, err)
+		}
+	}
+	if err := host.Run(ctx, constants.Sysctl, "-p", constants.SysctlFile); err != nil {
+		return fmt.Errorf("unable to set sysctls: %v", err)
+	}
+	if !config.DisableSwap {
+		return nil
+	}
+	if err := host.Run(ctx, constants.Swapoff, "-a"); err != nil {
+		return fmt.Errorf("unable to disable swap: %v", err)
+	}
+	return editFstab(commentSwap)
+}
+
+// RestoreHost removes the files written by PrepareHost, and turns swap back
+// on if PrepareHost disabled it. Modules stay loaded and sysctls keep their
+// values until the next boot.
+func RestoreHost(ctx context.Context) error {
+	for _, file := range RenderHostFiles(apis.HostPreparationConfiguration{}) {
+		if err := host.RemoveAll(file.Path); err != nil {
+			return fmt.Errorf("unable to remove %q: %v", file.Path, err)
+		}
+	}
+	var restored bool
+	err := editFstab(func(line string) string {
+		if strings.HasPrefix(line, constants.FstabSwapComment) {
+			restored = true
+			return strings.TrimPrefix(line, constants.FstabSwapComment)
+		}
+		return line
+	})
+	if err != nil || !restored {
+		return err
+	}
+	if err := host.Run(ctx, constants.Swapon, "-a"); err != nil {
+		return fmt.Errorf("unable to enable swap: %v", err)
+	}
+	return nil
+}
+
+// commentSwap comments out an fstab line that mounts swap
+func commentSwap(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) >= 3 && fields[2] == "swap" && !strings.HasPrefix(fields[0], "#") {
+		log.Infof("Disabling swap on %s in %s", fields[0], constants.FstabFile)
+		return constants.FstabSwapComment + line
+	}
+	return line
+}
+
+// editFstab rewrites each line of /etc/fstab with edit, if it exists and any
+// line changes
+func editFstab(edit func(line string) string) error {
+	data, err := ioutil.ReadFile(host.Path(constants.FstabFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", constants.FstabFile, err)
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		lines[i] = edit(line)
+	}
+	edited := strings.Join(lines, "\n")
+	if edited == string(data) {
+		return nil
+	}
+	info, err := os.Stat(host.Path(constants.FstabFile))
+	if err != nil {
+		return fmt.Errorf("unable to stat %s: %v", constants.FstabFile, err)
+	}
+	return WriteFile(host.Path(constants.FstabFile), []byte(edited), info.Mode().Perm())
+}
@@ -2,8 +2,11 @@ package utils
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/registry"
 )
 
 var DOCKER_IMAGES = []string{
@@ -11,16 +14,60 @@ var DOCKER_IMAGES = []string{
 	fmt.Sprintf("k8s.gcr.io/kube-apiserver-amd64:%s", constants.KubernetesVersion),
 	fmt.Sprintf("k8s.gcr.io/kube-controller-manager-amd64:%s", constants.KubernetesVersion),
 	fmt.Sprintf("k8s.gcr.io/kube-scheduler-amd64:%s", constants.KubernetesVersion),
-	fmt.Sprintf("k8s.gcr.io/kube-proxy-amd64:%s", constants.KubernetesVersion),
+	constants.KubeProxyImage,
 	fmt.Sprintf("k8s.gcr.io/k8s-dns-sidecar-amd64:%s", constants.KubeDNSVersion),
 	fmt.Sprintf("k8s.gcr.io/k8s-dns-kube-dns-amd64:%s", constants.KubeDNSVersion),
 	fmt.Sprintf("k8s.gcr.io/k8s-dns-dnsmasq-nanny-amd64:%s", constants.KubeDNSVersion),
-	"quay.io/coreos/flannel:v0.10.0-amd64",
-	"k8s.gcr.io/pause-amd64:3.1",
+	constants.FlannelImage,
+	constants.PauseImage,
 	"metallb/speaker:master",
 	"metallb/controller:master",
 }
 
+// GetImages returns the upstream names of the images nodeadm caches
 func GetImages() []string {
 	return DOCKER_IMAGES
 }
+
+// GetResolvedImages returns the names the images are pulled as
+func GetResolvedImages(config apis.ImageConfiguration) []string {
+	var images []string
+	for _, image := range GetImages() {
+		images = append(images, ResolveImage(config, image))
+	}
+	return images
+}
+
+// ResolveImage rewrites an upstream image name using the per-image overrides,
+// or else the image repository
+func ResolveImage(config apis.ImageConfiguration, image string) string {
+	name, tag := splitImage(image)
+	if override, ok := config.ImageOverrides[name]; ok {
+		if _, overrideTag := splitImage(override); overrideTag == "" {
+			return override + ":" + tag
+		}
+		return override
+	}
+	if config.ImageRepository == "" {
+		return image
+	}
+	path, tag := registry.RepositoryAndTag(image)
+	return fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(config.ImageRepository, "/"), path, tag)
+}
+
+// ClusterImageConfiguration returns the image configuration of the images
+// the cluster runs. With a local registry, the master serves the upstream
+// images under their own names, so overrides no longer apply.
+func ClusterImageConfiguration(config *apis.InitConfiguration) apis.ImageConfiguration {
+	if config.LocalRegistry.Enabled {
+		return apis.ImageConfiguration{ImageRepository: config.LocalRegistry.Address}
+	}
+	return config.ImageConfiguration
+}
+
+func splitImage(image string) (string, string) {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
@@ -1,230 +1,216 @@
 package utils
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"text/template"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
 
-	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
 	kubeletconfigv1beta1 "k8s.io/kubernetes/pkg/kubelet/apis/kubeletconfig/v1beta1"
 
 	"github.com/platform9/nodeadm/apis"
 	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
 	"github.com/platform9/nodeadm/systemd"
 	netutil "k8s.io/apimachinery/pkg/util/net"
 )
 
-func InstallMasterComponents(config *apis.InitConfiguration) {
-	PopulateCache()
-	placeKubeComponents()
-	placeCNIPlugin()
-	if err := systemd.StopIfActive("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
-	}
-	if err := systemd.DisableIfEnabled("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
-	}
-	placeKubeletSystemAndDropinFiles(config.Networking, config.Kubelet)
-	if err := systemd.Enable("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
-	}
-	if err := systemd.Start("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
-	}
-	if config.VIPConfiguration.IP != "" {
-		if err := systemd.StopIfActive("keepalived.service"); err != nil {
-			log.Fatalf("Failed to install keepalived service: %v", err)
-		}
-		if err := systemd.DisableIfEnabled("keepalived.service"); err != nil {
-			log.Fatalf("Failed to install keepalived service: %v", err)
-		}
-		writeKeepAlivedServiceFiles(config)
-		if err := systemd.Enable("keepalived.service"); err != nil {
-			log.Fatalf("Failed to install keepalived service: %v", err)
-		}
-		if err := systemd.Start("keepalived.service"); err != nil {
-			log.Fatalf("Failed to install keepalived service: %v", err)
+// InstallBinaries installs kubectl, kubeadm and the CNI plugins from the cache
+func InstallBinaries() error {
+	if err := InstallKubernetesBinaries(constants.KubernetesVersion, constants.KubectlFilename, constants.KubeadmFilename); err != nil {
+		return err
+	}
+	return placeCNIPlugin()
+}
+
+// InstallKubernetesBinaries installs the named Kubernetes binaries of version
+// from the cache
+func InstallKubernetesBinaries(version string, names ...string) error {
+	for _, name := range names {
+		if err := copyFile(filepath.Join(constants.CacheDir, constants.KubeDirNameOf(version), name), filepath.Join(constants.BaseInstallDir, name)); err != nil {
+			return fmt.Errorf("unable to install %s: %v", name, err)
 		}
 	}
+	return nil
 }
 
-func InstallNodeComponents(config *apis.JoinConfiguration) {
-	PopulateCache()
-	placeKubeComponents()
-	placeCNIPlugin()
-	if err := systemd.StopIfActive("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
+// InstallKubelet installs the kubelet binary and units, unless they are up to
+// date, and starts the kubelet
+func InstallKubelet(ctx context.Context, netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, imageConfig apis.ImageConfiguration, runtimeConfig apis.ContainerRuntimeConfiguration) error {
+	rt, err := containerruntime.New(runtimeConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create container runtime: %v", err)
 	}
-	if err := systemd.DisableIfEnabled("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
+	changed, err := installKubelet(ctx, netConfig, kubeletConfig, imageConfig, rt)
+	if err != nil {
+		return err
 	}
-	placeKubeletSystemAndDropinFiles(config.Networking, config.Kubelet)
-	if err := systemd.Enable("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
+	if changed {
+		if err := systemd.Reload(ctx); err != nil {
+			return fmt.Errorf("unable to install kubelet service: %v", err)
+		}
 	}
-	if err := systemd.Start("kubelet.service"); err != nil {
-		log.Fatalf("Failed to install kubelet service: %v", err)
+	if err := systemd.EnableAndStartUnit(ctx, constants.KubeletSystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to install kubelet service: %v", err)
 	}
+	return nil
 }
 
-func placeKubeletSystemAndDropinFiles(netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration) {
-	placeAndModifyKubeletServiceFile()
-	placeAndModifyKubeadmKubeletSystemdDropin()
-	placeAndModifyNodeadmKubeletSystemdDropin(netConfig, kubeletConfig)
-}
-
-func placeAndModifyKubeletServiceFile() {
-	serviceFile := filepath.Join(constants.SystemdDir, "kubelet.service")
-	_, err := copyFile(filepath.Join(constants.CacheDir, constants.KubeDirName, "kubelet.service"), serviceFile)
-	checkError(err, "Unable to copy file")
-	ReplaceString(serviceFile, "/usr/bin", constants.BaseInstallDir)
-}
-
-func placeAndModifyKubeadmKubeletSystemdDropin() {
-	err := os.MkdirAll(filepath.Join(constants.SystemdDir, "kubelet.service.d"), constants.Execute)
+// InstallVIP installs and starts keepalived, which provides the virtual IP of
+// the API servers, unless no virtual IP is configured
+func InstallVIP(ctx context.Context, config *apis.InitConfiguration) error {
+	if config.VIPConfiguration.IP == "" {
+		log.Infof("No virtual IP configured, skipping keepalived")
+		return nil
+	}
+	rt, err := containerruntime.New(config.ContainerRuntime)
 	if err != nil {
-		log.Fatalf("\nFailed to create dir with error %v", err)
+		return fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	if err := systemd.StopIfActive(ctx, "keepalived.service"); err != nil {
+		return fmt.Errorf("unable to install keepalived service: %v", err)
+	}
+	if err := systemd.DisableIfEnabled(ctx, "keepalived.service"); err != nil {
+		return fmt.Errorf("unable to install keepalived service: %v", err)
+	}
+	if err := writeKeepAlivedServiceFiles(config, rt); err != nil {
+		return fmt.Errorf("unable to install keepalived service: %v", err)
 	}
-	confFile := filepath.Join(constants.SystemdDir, "kubelet.service.d", constants.KubeadmKubeletSystemdDropinFilename)
-	_, err = copyFile(filepath.Join(constants.CacheDir, constants.KubeDirName, constants.KubeadmKubeletSystemdDropinFilename), confFile)
-	checkError(err, "Unable to copy file")
-	ReplaceString(confFile, "/usr/bin", constants.BaseInstallDir)
+	if err := systemd.Reload(ctx); err != nil {
+		return fmt.Errorf("unable to install keepalived service: %v", err)
+	}
+	if err := systemd.EnableAndStartUnit(ctx, "keepalived.service"); err != nil {
+		return fmt.Errorf("unable to install keepalived service: %v", err)
+	}
+	if err := systemd.WaitActive(ctx, "keepalived.service", config.Timeouts.UnitActive.Duration, config.Timeouts.RestartLoop.Duration); err != nil {
+		return fmt.Errorf("unable to start keepalived service: %v", err)
+	}
+	return nil
 }
 
-func placeAndModifyNodeadmKubeletSystemdDropin(netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration) {
-	err := os.MkdirAll(filepath.Join(constants.SystemdDir, "kubelet.service.d"), constants.Execute)
-	if err != nil {
-		log.Fatalf("\nFailed to create dir with error %v", err)
+// InstallLocalRegistry installs and starts the registry that serves the image
+// cache, unless it is disabled
+func InstallLocalRegistry(ctx context.Context, config *apis.InitConfiguration) error {
+	if !config.LocalRegistry.Enabled {
+		return nil
 	}
-	confFile := filepath.Join(constants.SystemdDir, "kubelet.service.d", constants.NodeadmKubeletSystemdDropinFilename)
-
-	dnsIP, err := kubeadmconstants.GetDNSIP(netConfig.ServiceSubnet)
-	if err != nil {
-		log.Fatalf("Failed to derive DNS IP from service subnet %q: %v", netConfig.ServiceSubnet, err)
+	if err := systemd.StopIfActive(ctx, constants.RegistrySystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to install registry service: %v", err)
+	}
+	if err := installNodeadm(); err != nil {
+		return fmt.Errorf("unable to install registry service: %v", err)
+	}
+	if err := writeRegistryServiceFile(config); err != nil {
+		return fmt.Errorf("unable to install registry service: %v", err)
+	}
+	if err := systemd.Reload(ctx); err != nil {
+		return fmt.Errorf("unable to install registry service: %v", err)
 	}
+	if err := systemd.EnableAndStartUnit(ctx, constants.RegistrySystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to install registry service: %v", err)
+	}
+	if err := systemd.WaitActive(ctx, constants.RegistrySystemdUnitFilename, config.Timeouts.UnitActive.Duration, config.Timeouts.RestartLoop.Duration); err != nil {
+		return fmt.Errorf("unable to start registry service: %v", err)
+	}
+	return nil
+}
 
-	hostnameOverride, err := constants.GetHostnameOverride()
+// installKubelet installs the kubelet binary and units, unless the installed
+// ones are up to date. It stops the kubelet and returns true if it changed them.
+func installKubelet(ctx context.Context, netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, imageConfig apis.ImageConfiguration, rt containerruntime.Runtime) (bool, error) {
+	units, err := RenderKubeletUnits(constants.KubernetesVersion, netConfig, kubeletConfig, imageConfig, rt)
 	if err != nil {
-		log.Fatalf("Failed to dervice hostname override: %v", err)
+		return false, fmt.Errorf("unable to render kubelet units: %v", err)
 	}
-
-	data := struct {
-		FailSwapOn       bool
-		MaxPods          int32
-		ClusterDNS       string
-		ClusterDomain    string
-		HostnameOverride string
-		KubeAPIQPS       int32
-		KubeAPIBurst     int32
-		EvictionHard     string
-		FeatureGates     string
-		CPUManagerPolicy string
-		KubeReservedCPU  string
-	}{
-		FailSwapOn:       *kubeletConfig.FailSwapOn,
-		MaxPods:          kubeletConfig.MaxPods,
-		ClusterDNS:       dnsIP.String(),
-		ClusterDomain:    netConfig.DNSDomain,
-		HostnameOverride: hostnameOverride,
-		KubeAPIQPS:       *kubeletConfig.KubeAPIQPS,
-		KubeAPIBurst:     kubeletConfig.KubeAPIBurst,
-		EvictionHard:     constants.KubeletEvictionHard,
-		FeatureGates:     constants.FeatureGates,
-		CPUManagerPolicy: kubeletConfig.CPUManagerPolicy,
-	}
-	if value, ok := kubeletConfig.KubeReserved[constants.KubeletConfigKubeReservedCPUKey]; ok {
-		data.KubeReservedCPU = fmt.Sprintf("%q=%q", constants.KubeletConfigKubeReservedCPUKey, value)
+	if units.Installed() {
+		log.Infof("Kubelet is up to date")
+		return false, nil
 	}
-
-	writeTemplateIntoFile(constants.NodeadmKubeletSystemdDropinTemplate, "nodeadm-kubelet-systemd-dropin", confFile, data)
+	if err := systemd.StopIfActive(ctx, constants.KubeletSystemdUnitFilename); err != nil {
+		return false, fmt.Errorf("unable to install kubelet service: %v", err)
+	}
+	if err := systemd.DisableIfEnabled(ctx, constants.KubeletSystemdUnitFilename); err != nil {
+		return false, fmt.Errorf("unable to install kubelet service: %v", err)
+	}
+	if err := copyFile(filepath.Join(constants.CacheDir, constants.KubeDirName, constants.KubeletFilename), filepath.Join(constants.BaseInstallDir, constants.KubeletFilename)); err != nil {
+		return false, fmt.Errorf("unable to install kubelet: %v", err)
+	}
+	if err := units.Write(); err != nil {
+		return false, fmt.Errorf("unable to install kubelet service: %v", err)
+	}
+	return true, nil
 }
 
-func placeKubeComponents() {
-	_, err := copyFile(filepath.Join(constants.CacheDir, constants.KubeDirName, "kubectl"), filepath.Join(constants.BaseInstallDir, "kubectl"))
-	checkError(err, "Unable to copy file")
-	_, err = copyFile(filepath.Join(constants.CacheDir, constants.KubeDirName, "kubeadm"), filepath.Join(constants.BaseInstallDir, "kubeadm"))
-	checkError(err, "Unable to copy file")
-	_, err = copyFile(filepath.Join(constants.CacheDir, constants.KubeDirName, "kubelet"), filepath.Join(constants.BaseInstallDir, "kubelet"))
-	checkError(err, "Unable to copy file")
+func copyFile(src string, dst string) error {
+	return CopyFile(host.Path(src), host.Path(dst))
 }
 
-func checkError(err error, message string) {
-	if err != nil {
-		log.Fatalf("%s: %s", message, err)
+func placeCNIPlugin() error {
+	archive := filepath.Join(constants.CacheDir, constants.CNIDirName, constants.CNIPluginsFilename)
+	if _, err := os.Stat(host.Path(constants.CniVersionInstallDir)); !os.IsNotExist(err) {
+		return nil
+	}
+	if host.Planning() {
+		host.Record(host.FileAction, "extract %s into %s", archive, constants.CniVersionInstallDir)
+		host.Record(host.FileAction, "link the plugins in %s from %s", constants.CniVersionInstallDir, constants.CNIBaseDir)
+		return nil
+	}
+	if err := os.MkdirAll(host.Path(constants.CniVersionInstallDir), constants.Execute); err != nil {
+		return fmt.Errorf("unable to create dir %q: %v", constants.CniVersionInstallDir, err)
+	}
+	err := ExtractTarGz(host.Path(archive), host.Path(constants.CniVersionInstallDir))
+	if err == nil {
+		err = CreateSymLinks(constants.CniVersionInstallDir, constants.CNIBaseDir, true)
 	}
-}
-
-func copyFile(src string, dst string) ([]byte, error) {
-	cmd := exec.Command("cp", src, dst)
-	out, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to run %q: %s", strings.Join(cmd.Args, " "), err)
+		// Install again on the next run
+		os.RemoveAll(host.Path(constants.CniVersionInstallDir))
+		return fmt.Errorf("unable to install CNI plugins: %v", err)
 	}
-	return out, err
+	return nil
 }
 
-func placeCNIPlugin() {
-	tmpFile := fmt.Sprintf("cni-plugins-amd64-%s.tgz", constants.CNIVersion)
-	_, err := copyFile(filepath.Join(constants.CacheDir, constants.CNIDirName, tmpFile), filepath.Join("/tmp", tmpFile))
-	checkError(err, "Unable to copy file")
-	if _, err = os.Stat(constants.CniVersionInstallDir); os.IsNotExist(err) {
-		err := os.MkdirAll(constants.CniVersionInstallDir, constants.Execute)
-		if err != nil {
-			log.Fatalf("\nFailed to create dir %s with error %v", constants.CniVersionInstallDir, err)
-		}
-		cmd := exec.Command("tar", "-xvf", filepath.Join("/tmp", tmpFile), "-C", constants.CniVersionInstallDir)
-		err = cmd.Run()
-		if err != nil {
-			log.Fatalf("Failed to run %q: %s", strings.Join(cmd.Args, " "), err)
-		}
-		CreateSymLinks(constants.CniVersionInstallDir, constants.CNIBaseDir, true)
+func renderTemplate(tmpl, name, file string, data interface{}) (GeneratedFile, error) {
+	var b bytes.Buffer
+	t := template.Must(template.New(name).Parse(tmpl))
+	if err := t.Execute(&b, data); err != nil {
+		return GeneratedFile{}, fmt.Errorf("unable to render %q: %v", file, err)
 	}
-
+	return GeneratedFile{Path: file, Mode: constants.Read, Data: b.Bytes()}, nil
 }
 
-func writeTemplateIntoFile(tmpl, name, file string, data interface{}) {
-	err := os.MkdirAll(filepath.Dir(file), constants.Read)
-	if err != nil {
-		log.Fatalf("Failed to create dirs for path %s with error %v", filepath.Dir(file), err)
-	}
-	f, err := os.Create(file)
+func writeKeepAlivedServiceFiles(config *apis.InitConfiguration, rt containerruntime.Runtime) error {
+	files, err := RenderKeepalivedFiles(config, rt)
 	if err != nil {
-		log.Fatalf("Failed to create file %q: %v", file, err)
-	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	t := template.Must(template.New(name).Parse(tmpl))
-	t.Execute(w, data)
-	err = w.Flush()
-	if err != nil {
-		log.Fatalf("Failed to write to file %q: %v", file, err)
+		return err
 	}
+	return WriteFiles(files)
 }
 
-func writeKeepAlivedServiceFiles(config *apis.InitConfiguration) {
-	log.Infof("\nVip configuration as parsed from the file %v", config)
+// RenderKeepalivedFiles renders keepalived.conf and the keepalived unit,
+// choosing the virtual IP, its interface and router ID if they are not
+// configured
+func RenderKeepalivedFiles(config *apis.InitConfiguration, rt containerruntime.Runtime) ([]GeneratedFile, error) {
+	log.Infof("\nVip configuration as parsed from the file %+v", config.VIPConfiguration)
 	if len(config.VIPConfiguration.IP) == 0 {
 		ip, err := netutil.ChooseHostInterface()
 		if err != nil {
-			log.Fatalf("Failed to get default interface with err %v", err)
+			return nil, fmt.Errorf("unable to choose the virtual IP: %v", err)
 		}
 		config.VIPConfiguration.IP = ip.String()
 	}
 
 	if len(config.VIPConfiguration.NetworkInterface) == 0 {
-		cmdStr := "route | grep '^default' | grep -o '[^ ]*$'"
-		cmd := exec.Command("bash", "-c", cmdStr)
-		bytes, err := cmd.CombinedOutput()
+		iface, err := host.DefaultRouteInterface()
 		if err != nil {
-			log.Fatalf("Failed to get default interface with err %v", err)
+			return nil, fmt.Errorf("unable to choose the virtual IP interface: %v", err)
 		}
-		config.VIPConfiguration.NetworkInterface = strings.Trim(string(bytes), "\n ")
+		config.VIPConfiguration.NetworkInterface = iface
 	}
 
 	if config.VIPConfiguration.RouterID == 0 {
@@ -267,31 +253,60 @@ vrrp_instance K8S_APISERVER {
 		chk_apiserver
 	}
 }`
-	writeTemplateIntoFile(kaConfFileTemplate, "vipConfFileTemplate", constants.KeepalivedConfigFilename, configTemplateVals)
+	kaConfFile, err := renderTemplate(kaConfFileTemplate, "vipConfFileTemplate", constants.KeepalivedConfigFilename, configTemplateVals)
+	if err != nil {
+		return nil, err
+	}
+
+	kaServiceUnit := rt.ServiceUnit(containerruntime.ContainerSpec{
+		Name:         "vip",
+		Description:  "Keepalived service",
+		Image:        ResolveImage(ClusterImageConfiguration(config), constants.KeepalivedImage),
+		Capabilities: []string{"NET_ADMIN"},
+		Mounts: []containerruntime.Mount{
+			{Source: constants.KeepalivedConfigFilename, Destination: "/usr/local/etc/keepalived/keepalived.conf"},
+		},
+	})
+	kaServiceFile := GeneratedFile{Path: filepath.Join(constants.SystemdDir, "keepalived.service"), Mode: constants.Read, Data: []byte(kaServiceUnit)}
+	return []GeneratedFile{kaConfFile, kaServiceFile}, nil
+}
+
+func writeRegistryServiceFile(config *apis.InitConfiguration) error {
+	file, err := RenderRegistryServiceFile(config)
+	if err != nil {
+		return err
+	}
+	return WriteFiles([]GeneratedFile{file})
+}
+
+// installNodeadm copies this nodeadm executable to the install directory, so
+// that the registry unit does not depend on where nodeadm was run from
+func installNodeadm() error {
+	nodeadm, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find nodeadm executable: %v", err)
+	}
+	if err := CopyFile(nodeadm, host.Path(constants.NodeadmInstallPath)); err != nil {
+		return fmt.Errorf("unable to install nodeadm: %v", err)
+	}
+	return nil
+}
 
-	kaSvcFileTemplate := `
-[Unit]
-Description= Keepalived service
-After=network.target docker.service
-Requires=docker.service
+// RenderRegistryServiceFile renders the unit of the local registry, which
+// runs the installed nodeadm
+func RenderRegistryServiceFile(config *apis.InitConfiguration) (GeneratedFile, error) {
+	registrySvcFileTemplate := `[Unit]
+Description=nodeadm local image registry
+After=network.target
 [Service]
 Type=simple
-ExecStart=/usr/bin/docker run --cap-add=NET_ADMIN \
-		--net=host --name vip \
-		-v {{.ConfigFile}}:/usr/local/etc/keepalived/keepalived.conf \
-		{{.KeepAlivedImg}}
-ExecStartPre=-/usr/bin/docker kill vip
-ExecStartPre=-/usr/bin/docker rm vip
-ExecStop=/usr/bin/docker stop vip
-ExecStop=/usr/bin/docker rm vip
+ExecStart={{.Nodeadm}} registry serve --listen={{.ListenAddress}}
 Restart=on-failure
-MemoryLow=10M
 [Install]
 WantedBy=multi-user.target
-	`
-	type KaServiceData struct {
-		ConfigFile, KeepAlivedImg string
-	}
-	kaServiceData := KaServiceData{constants.KeepalivedConfigFilename, constants.KeepalivedImage}
-	writeTemplateIntoFile(kaSvcFileTemplate, "kaSvcFileTemplate", filepath.Join(constants.SystemdDir, "keepalived.service"), kaServiceData)
+`
+	registryServiceData := struct {
+		Nodeadm, ListenAddress string
+	}{constants.NodeadmInstallPath, config.LocalRegistry.ListenAddress}
+	return renderTemplate(registrySvcFileTemplate, "registrySvcFileTemplate", filepath.Join(constants.SystemdDir, constants.RegistrySystemdUnitFilename), registryServiceData)
 }
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	kubeadmconstants "k8s.io/kubernetes/cmd/kubeadm/app/constants"
+	kubeletconfigv1beta1 "k8s.io/kubernetes/pkg/kubelet/apis/kubeletconfig/v1beta1"
+	"k8s.io/kubernetes/pkg/util/version"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
+)
+
+// kubeletUnitHashPrefix starts the first line of every generated kubelet unit file
+const kubeletUnitHashPrefix = "# Generated by nodeadm, content hash "
+
+// kubeletConfigFileVersion is the first kubelet that kubeadm configures with
+// a configuration file, and that no longer has --cadvisor-port
+var kubeletConfigFileVersion = version.MustParseSemantic("v1.11.0")
+
+// KubeletUnits are the kubelet systemd unit and its drop-ins, keyed by path
+type KubeletUnits struct {
+	files map[string]string
+	// hash covers the files and the kubelet binary they run
+	hash string
+}
+
+// RenderKubeletUnits renders the kubelet unit, the kubeadm drop-in and the
+// nodeadm drop-in of the kubelet of kubernetesVersion from the cache
+func RenderKubeletUnits(kubernetesVersion string, netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, imageConfig apis.ImageConfiguration, rt containerruntime.Runtime) (*KubeletUnits, error) {
+	kubeadmDropin, err := kubeadmKubeletDropinTemplate(kubernetesVersion)
+	if err != nil {
+		return nil, err
+	}
+	dropinDir := filepath.Join(constants.SystemdDir, constants.KubeletSystemdUnitFilename+".d")
+	paths := struct {
+		Kubelet, CNIConfigDir, CNIBinDir string
+	}{
+		Kubelet:      filepath.Join(constants.BaseInstallDir, constants.KubeletFilename),
+		CNIConfigDir: constants.CNIConfigDir,
+		CNIBinDir:    constants.CNIBaseDir,
+	}
+	nodeadmData, err := nodeadmKubeletDropinData(netConfig, kubeletConfig, imageConfig, rt)
+	if err != nil {
+		return nil, err
+	}
+	units := &KubeletUnits{files: make(map[string]string)}
+	for _, file := range []struct {
+		path, tmpl string
+		data       interface{}
+	}{
+		{filepath.Join(constants.SystemdDir, constants.KubeletSystemdUnitFilename), constants.KubeletSystemdUnitTemplate, paths},
+		{filepath.Join(dropinDir, constants.KubeadmKubeletSystemdDropinFilename), kubeadmDropin, paths},
+		{filepath.Join(dropinDir, constants.NodeadmKubeletSystemdDropinFilename), constants.NodeadmKubeletSystemdDropinTemplate, nodeadmData},
+	} {
+		t, err := template.New(filepath.Base(file.path)).Parse(file.tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse template of %q: %v", file.path, err)
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, file.data); err != nil {
+			return nil, fmt.Errorf("unable to render %q: %v", file.path, err)
+		}
+		units.files[file.path] = b.String()
+	}
+
+	h := sha256.New()
+	for _, path := range units.paths() {
+		fmt.Fprintf(h, "%s\n%s\n", path, units.files[path])
+	}
+	kubelet, err := os.Open(host.Path(filepath.Join(constants.CacheDir, constants.KubeDirNameOf(kubernetesVersion), constants.KubeletFilename)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cached kubelet: %v", err)
+	}
+	defer kubelet.Close()
+	if _, err := io.Copy(h, kubelet); err != nil {
+		return nil, fmt.Errorf("unable to read cached kubelet: %v", err)
+	}
+	units.hash = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return units, nil
+}
+
+// kubeadmKubeletDropinTemplate returns the template of the kubeadm drop-in of
+// the kubelet of kubernetesVersion
+func kubeadmKubeletDropinTemplate(kubernetesVersion string) (string, error) {
+	v, err := version.ParseSemantic(kubernetesVersion)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse kubelet version: %v", err)
+	}
+	if v.LessThan(kubeletConfigFileVersion) {
+		return constants.KubeadmKubeletSystemdDropinTemplate, nil
+	}
+	return constants.KubeadmKubeletConfigFileSystemdDropinTemplate, nil
+}
+
+// Installed checks if every installed file was generated with the same hash
+func (u *KubeletUnits) Installed() bool {
+	for _, path := range u.paths() {
+		f, err := os.Open(host.Path(path))
+		if err != nil {
+			return false
+		}
+		firstLine, err := bufio.NewReader(f).ReadString('\n')
+		f.Close()
+		if err != nil || strings.TrimSpace(firstLine) != kubeletUnitHashPrefix+u.hash {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes the files, each starting with the content hash
+func (u *KubeletUnits) Write() error {
+	return WriteFiles(u.Files())
+}
+
+// Files returns the files, each starting with the content hash
+func (u *KubeletUnits) Files() []GeneratedFile {
+	var files []GeneratedFile
+	for _, path := range u.paths() {
+		content := kubeletUnitHashPrefix + u.hash + "\n" + u.files[path]
+		files = append(files, GeneratedFile{Path: path, Mode: constants.Read, Data: []byte(content)})
+	}
+	return files
+}
+
+func (u *KubeletUnits) paths() []string {
+	var paths []string
+	for path := range u.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func nodeadmKubeletDropinData(netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, imageConfig apis.ImageConfiguration, rt containerruntime.Runtime) (interface{}, error) {
+	dnsIP, err := kubeadmconstants.GetDNSIP(netConfig.ServiceSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive DNS IP from service subnet %q: %v", netConfig.ServiceSubnet, err)
+	}
+
+	hostnameOverride, err := constants.GetHostnameOverride()
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive hostname override: %v", err)
+	}
+
+	cgroupDriver, err := rt.CgroupDriver()
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive cgroup driver of %s: %v", rt.Name(), err)
+	}
+	runtimeArgs := fmt.Sprintf("--cgroup-driver=%s", cgroupDriver)
+	if endpoint := rt.Endpoint(); endpoint != "" {
+		runtimeArgs += fmt.Sprintf(" --container-runtime=remote --container-runtime-endpoint=%s", endpoint)
+	}
+
+	data := struct {
+		FailSwapOn       bool
+		MaxPods          int32
+		ClusterDNS       string
+		ClusterDomain    string
+		HostnameOverride string
+		KubeAPIQPS       int32
+		KubeAPIBurst     int32
+		EvictionHard     string
+		FeatureGates     string
+		CPUManagerPolicy string
+		KubeReservedCPU  string
+		PodInfraImage    string
+		RuntimeArgs      string
+	}{
+		FailSwapOn:       *kubeletConfig.FailSwapOn,
+		MaxPods:          kubeletConfig.MaxPods,
+		ClusterDNS:       dnsIP.String(),
+		ClusterDomain:    netConfig.DNSDomain,
+		HostnameOverride: hostnameOverride,
+		KubeAPIQPS:       *kubeletConfig.KubeAPIQPS,
+		KubeAPIBurst:     kubeletConfig.KubeAPIBurst,
+		EvictionHard:     constants.KubeletEvictionHard,
+		FeatureGates:     constants.FeatureGates,
+		CPUManagerPolicy: kubeletConfig.CPUManagerPolicy,
+		PodInfraImage:    ResolveImage(imageConfig, constants.PauseImage),
+		RuntimeArgs:      runtimeArgs,
+	}
+	if value, ok := kubeletConfig.KubeReserved[constants.KubeletConfigKubeReservedCPUKey]; ok {
+		data.KubeReservedCPU = fmt.Sprintf("%q=%q", constants.KubeletConfigKubeReservedCPUKey, value)
+	}
+	return data, nil
+}
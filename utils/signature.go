@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Keyring holds the public keys trusted to sign artifacts
+type Keyring struct {
+	keys []crypto.PublicKey
+}
+
+// ReadKeyring reads the PEM encoded ECDSA and RSA public keys of a file
+func ReadKeyring(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read keyring %q: %v", path, err)
+	}
+	keyring := &Keyring{}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse public key in keyring %q: %v", path, err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey:
+			keyring.keys = append(keyring.keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T in keyring %q", key, path)
+		}
+	}
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("no public keys in keyring %q", path)
+	}
+	return keyring, nil
+}
+
+// VerifyFile checks that the detached signature in sigFile was made over the
+// contents of file by one of the keys in the keyring
+func (k *Keyring) VerifyFile(file, sigFile string) error {
+	sig, err := readSignature(sigFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %v", file, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("unable to read %q: %v", file, err)
+	}
+	digest := h.Sum(nil)
+	for _, key := range k.keys {
+		if verifyDigest(key, digest, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature %q of %q was not made by a key in the keyring", sigFile, file)
+}
+
+func verifyDigest(key crypto.PublicKey, digest, sig []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) != 0 {
+			return false
+		}
+		return ecdsa.Verify(key, digest, esig.R, esig.S)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) == nil
+	}
+	return false
+}
+
+// readSignature reads a detached signature, which is base64 encoded or raw
+func readSignature(sigFile string) ([]byte, error) {
+	b, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signature %q: %v", sigFile, err)
+	}
+	if sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err == nil {
+		return sig, nil
+	}
+	return b, nil
+}
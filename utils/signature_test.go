@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePublicKeys(t *testing.T, path string, keys ...crypto.PublicKey) {
+	var b []byte
+	for _, key := range keys {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sign(t *testing.T, key crypto.Signer, content []byte) []byte {
+	digest := sha256.Sum256(content)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestReadKeyring(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "nodeadm-signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := filepath.Join(tmp, "keyring.pem")
+	writePublicKeys(t, keyring, rsaKey.Public(), ecdsaKey.Public())
+	k, err := ReadKeyring(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.keys) != 2 {
+		t.Errorf("read %d keys, expected 2", len(k.keys))
+	}
+
+	empty := filepath.Join(tmp, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no keys"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	malformed := filepath.Join(tmp, "malformed.pem")
+	if err := ioutil.WriteFile(malformed, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, malformed, filepath.Join(tmp, "missing.pem")} {
+		if _, err := ReadKeyring(path); err == nil {
+			t.Errorf("expected an error reading %s", filepath.Base(path))
+		}
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "nodeadm-signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := filepath.Join(tmp, "keyring.pem")
+	writePublicKeys(t, keyring, rsaKey.Public(), ecdsaKey.Public())
+	k, err := ReadKeyring(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("kubeadm")
+	tests := []struct {
+		name    string
+		content []byte
+		sig     []byte
+		wantErr bool
+	}{
+		{"rsa", content, sign(t, rsaKey, content), false},
+		{"ecdsa", content, sign(t, ecdsaKey, content), false},
+		{"base64", content, []byte(base64.StdEncoding.EncodeToString(sign(t, ecdsaKey, content)) + "\n"), false},
+		{"tampered rsa", []byte("kubeadm!"), sign(t, rsaKey, content), true},
+		{"tampered ecdsa", []byte("kubeadm!"), sign(t, ecdsaKey, content), true},
+		{"wrong key", content, sign(t, otherKey, content), true},
+		{"malformed", content, []byte("not a signature"), true},
+		{"truncated", content, sign(t, ecdsaKey, content)[:10], true},
+		{"empty", content, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(tmp, "artifact")
+			if err := ioutil.WriteFile(file, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file+".sig", tt.sig, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := k.VerifyFile(file, file+".sig")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+	if err := k.VerifyFile(filepath.Join(tmp, "missing"), filepath.Join(tmp, "artifact.sig")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	if err := k.VerifyFile(filepath.Join(tmp, "artifact"), filepath.Join(tmp, "missing.sig")); err == nil {
+		t.Errorf("expected an error for a missing signature")
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("kubelet")
+	digest := sha256.Sum256(content)
+	ecdsaSig := sign(t, ecdsaKey, content)
+	tests := []struct {
+		name string
+		key  crypto.PublicKey
+		sig  []byte
+		ok   bool
+	}{
+		{"rsa", rsaKey.Public(), sign(t, rsaKey, content), true},
+		{"ecdsa", ecdsaKey.Public(), ecdsaSig, true},
+		{"rsa signature for ecdsa key", ecdsaKey.Public(), sign(t, rsaKey, content), false},
+		{"ecdsa signature for rsa key", rsaKey.Public(), ecdsaSig, false},
+		{"trailing data", ecdsaKey.Public(), append(append([]byte{}, ecdsaSig...), 0), false},
+		{"unsupported key", "key", ecdsaSig, false},
+	}
+	for _, tt := range tests {
+		if ok := verifyDigest(tt.key, digest[:], tt.sig); ok != tt.ok {
+			t.Errorf("%s: verifyDigest returned %v, expected %v", tt.name, ok, tt.ok)
+		}
+	}
+}
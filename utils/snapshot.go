@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/systemd"
+)
+
+// Snapshot records files, systemd units and images before an install changes
+// them, so that a failed install can be rolled back. Files are copied into a
+// directory under constants.BackupDir, and moved back on restore.
+type Snapshot struct {
+	// dir holds the copies of the recorded paths
+	dir    string
+	paths  []pathState
+	units  []unitState
+	rt     containerruntime.Runtime
+	images []string
+}
+
+// pathState is a file, symlink or directory tree as it was
+type pathState struct {
+	path string
+	// backup is the copy of the path, or empty if the path did not exist
+	backup string
+}
+
+type unitState struct {
+	unit    string
+	active  bool
+	enabled bool
+}
+
+// AddPaths copies the files, symlinks and directory trees at paths on the
+// host into the backup directory. Nothing is recorded while planning, since
+// nothing changes.
+func (s *Snapshot) AddPaths(paths ...string) error {
+	if host.Planning() {
+		return nil
+	}
+	for _, path := range paths {
+		state := pathState{path: path}
+		_, err := os.Lstat(host.Path(path))
+		switch {
+		case err == nil:
+			if s.dir == "" {
+				if err := os.MkdirAll(host.Path(constants.BackupDir), 0700); err != nil {
+					return fmt.Errorf("unable to create dir %q: %v", constants.BackupDir, err)
+				}
+				if s.dir, err = ioutil.TempDir(host.Path(constants.BackupDir), "snapshot"); err != nil {
+					return fmt.Errorf("unable to create backup dir: %v", err)
+				}
+			}
+			state.backup = filepath.Join(s.dir, strconv.Itoa(len(s.paths)))
+			if err := copyTree(host.Path(path), state.backup); err != nil {
+				return fmt.Errorf("unable to snapshot %q: %v", path, err)
+			}
+		case !os.IsNotExist(err):
+			return fmt.Errorf("unable to snapshot %q: %v", path, err)
+		}
+		s.paths = append(s.paths, state)
+	}
+	return nil
+}
+
+// RemoveBackups removes the copies of every snapshot, once the phases they
+// were taken for succeeded or were rolled back
+func RemoveBackups() error {
+	if err := host.RemoveAll(constants.BackupDir); err != nil {
+		return fmt.Errorf("unable to remove backups: %v", err)
+	}
+	return nil
+}
+
+// AddUnits records whether the systemd units are active and enabled
+func (s *Snapshot) AddUnits(ctx context.Context, units ...string) error {
+	for _, unit := range units {
+		active, err := systemd.Active(ctx, unit)
+		if err != nil {
+			return fmt.Errorf("unable to snapshot %s: %v", unit, err)
+		}
+		enabled, err := systemd.Enabled(ctx, unit)
+		if err != nil {
+			return fmt.Errorf("unable to snapshot %s: %v", unit, err)
+		}
+		s.units = append(s.units, unitState{unit, active, enabled})
+	}
+	return nil
+}
+
+// AddImages records which of the images are missing from the runtime, so
+// that they are removed again on restore
+func (s *Snapshot) AddImages(ctx context.Context, rt containerruntime.Runtime, images ...string) error {
+	s.rt = rt
+	for _, image := range images {
+		present, err := rt.ImagePresent(ctx, image)
+		if err != nil {
+			return fmt.Errorf("unable to snapshot image %s: %v", image, err)
+		}
+		if !present {
+			s.images = append(s.images, image)
+		}
+	}
+	return nil
+}
+
+// Restore stops the recorded units, moves the recorded paths back, returns
+// the units to their recorded state and removes the images that were missing.
+// It restores as much as it can, and returns every failure.
+func (s *Snapshot) Restore(ctx context.Context) error {
+	var failures []string
+	fail := func(err error) {
+		failures = append(failures, err.Error())
+	}
+	for _, u := range s.units {
+		if err := systemd.StopIfActive(ctx, u.unit); err != nil {
+			fail(err)
+		}
+		if err := systemd.DisableIfEnabled(ctx, u.unit); err != nil {
+			fail(err)
+		}
+	}
+	restored := true
+	for _, p := range s.paths {
+		if err := p.restore(); err != nil {
+			fail(err)
+			restored = false
+		}
+	}
+	// Keep the backups of paths that could not be restored
+	if s.dir != "" && restored {
+		if err := os.RemoveAll(s.dir); err != nil {
+			fail(fmt.Errorf("unable to remove backup dir %q: %v", s.dir, err))
+		}
+	}
+	if len(s.units) > 0 {
+		if err := systemd.Reload(ctx); err != nil {
+			fail(err)
+		}
+	}
+	for _, u := range s.units {
+		if u.enabled {
+			if err := systemd.Enable(ctx, u.unit); err != nil {
+				fail(err)
+			}
+		}
+		if u.active {
+			if err := systemd.Start(ctx, u.unit); err != nil {
+				fail(err)
+			}
+		}
+	}
+	for _, image := range s.images {
+		present, err := s.rt.ImagePresent(ctx, image)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if present {
+			if err := s.rt.RemoveImage(ctx, image); err != nil {
+				fail(err)
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to restore snapshot: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (p pathState) restore() error {
+	if err := os.RemoveAll(host.Path(p.path)); err != nil {
+		return fmt.Errorf("unable to restore %q: %v", p.path, err)
+	}
+	if p.backup == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(host.Path(p.path)), 0755); err != nil {
+		return fmt.Errorf("unable to restore %q: %v", p.path, err)
+	}
+	if err := os.Rename(p.backup, host.Path(p.path)); err != nil {
+		// The backup directory is on another filesystem
+		if err := copyTree(p.backup, host.Path(p.path)); err != nil {
+			return fmt.Errorf("unable to restore %q: %v", p.path, err)
+		}
+	}
+	return nil
+}
+
+// copyTree copies the file, symlink or directory tree src to dst
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return CopyFile(path, target)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/host"
+)
+
+func TestSnapshotRestoresPaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "nodeadm-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer host.SetRoot(host.SetRoot(root))
+
+	if err := WriteFile(host.Path("/opt/cni/bin/v1/flannel"), []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v1/flannel", host.Path("/opt/cni/bin/flannel")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{}
+	if err := snapshot.AddPaths("/opt/cni/bin", "/opt/bin/kubeadm"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll(host.Path("/opt/cni/bin"))
+	if err := WriteFile(host.Path("/opt/cni/bin/v2/flannel"), []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(host.Path("/opt/bin/kubeadm"), []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := ioutil.ReadFile(host.Path("/opt/cni/bin/flannel")); err != nil || string(content) != "old" {
+		t.Errorf("unexpected content %q: %v", content, err)
+	}
+	if info, err := os.Stat(host.Path("/opt/cni/bin/v1/flannel")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected file %v: %v", info, err)
+	}
+	for _, path := range []string{"/opt/cni/bin/v2", "/opt/bin/kubeadm"} {
+		if _, err := os.Lstat(host.Path(path)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(host.Path("/opt/bin/kubeadm"))); err != nil {
+		t.Errorf("parent of a restored path was removed: %v", err)
+	}
+}
+
+func TestSnapshotBackups(t *testing.T) {
+	root, err := ioutil.TempDir("", "nodeadm-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer host.SetRoot(host.SetRoot(root))
+
+	if err := WriteFile(host.Path("/opt/bin/kubelet"), []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{}
+	if err := snapshot.AddPaths("/opt/bin/kubelet"); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := filepath.Glob(filepath.Join(host.Path(constants.BackupDir), "snapshot*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected one backup, got %v", backups)
+	}
+	if content, err := ioutil.ReadFile(backups[0]); err != nil || string(content) != "old" {
+		t.Errorf("unexpected backup %q: %v", content, err)
+	}
+
+	if err := WriteFile(host.Path("/opt/bin/kubelet"), []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.Restore(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(host.Path("/opt/bin/kubelet")); err != nil || string(content) != "old" {
+		t.Errorf("unexpected content %q: %v", content, err)
+	}
+	// The backup was moved back, and its directory removed
+	if dirs, err := filepath.Glob(filepath.Join(host.Path(constants.BackupDir), "*")); err != nil || len(dirs) != 0 {
+		t.Errorf("backups were not removed: %v %v", dirs, err)
+	}
+
+	if err := snapshot.AddPaths("/opt/bin/kubelet"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveBackups(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(host.Path(constants.BackupDir)); !os.IsNotExist(err) {
+		t.Errorf("backup dir was not removed: %v", err)
+	}
+}
@@ -1,25 +1,28 @@
 package utils
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 
 	log "github.com/platform9/nodeadm/pkg/logrus"
+
+	"github.com/platform9/nodeadm/host"
 )
 
 // Create symlinks of all the files inside sourceDir to targetDir
-func CreateSymLinks(sourceDir, targetDir string, overwriteSymlinks bool) {
-	files, err := ioutil.ReadDir(sourceDir)
+func CreateSymLinks(sourceDir, targetDir string, overwriteSymlinks bool) error {
+	files, err := ioutil.ReadDir(host.Path(sourceDir))
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("unable to list %q: %v", sourceDir, err)
 	}
 	_, parentDir := filepath.Split(sourceDir)
 
 	for _, f := range files {
 		log.Info("Creating symlink for " + f.Name())
 
-		symlinkPath := filepath.Join(targetDir, f.Name())
+		symlinkPath := host.Path(filepath.Join(targetDir, f.Name()))
 
 		if overwriteSymlinks {
 			if _, err := os.Lstat(symlinkPath); err == nil {
@@ -29,7 +32,8 @@ func CreateSymLinks(sourceDir, targetDir string, overwriteSymlinks bool) {
 
 		err = os.Symlink(filepath.Join(parentDir, f.Name()), symlinkPath)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("unable to create symlink %q: %v", filepath.Join(targetDir, f.Name()), err)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	kubeletconfigv1beta1 "k8s.io/kubernetes/pkg/kubelet/apis/kubeletconfig/v1beta1"
+	"k8s.io/kubernetes/pkg/util/version"
+
+	"github.com/platform9/nodeadm/apis"
+	"github.com/platform9/nodeadm/constants"
+	"github.com/platform9/nodeadm/containerruntime"
+	"github.com/platform9/nodeadm/host"
+	"github.com/platform9/nodeadm/systemd"
+)
+
+// CachedKubernetesVersions returns the Kubernetes versions whose kubeadm,
+// kubelet and kubectl are in the cache, oldest first. nodeadm download caches
+// the version of the nodeadm that runs it.
+func CachedKubernetesVersions() ([]*version.Version, error) {
+	dir := filepath.Join(constants.CacheDir, constants.KubeDirNameOf(""))
+	entries, err := ioutil.ReadDir(host.Path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list cached versions in %q: %v", dir, err)
+	}
+	var versions []*version.Version
+	for _, entry := range entries {
+		v, err := version.ParseSemantic(entry.Name())
+		if err != nil || !entry.IsDir() || !kubernetesBinariesCached(entry.Name()) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].LessThan(versions[j])
+	})
+	return versions, nil
+}
+
+func kubernetesBinariesCached(version string) bool {
+	for _, name := range []string{constants.KubeadmFilename, constants.KubeletFilename, constants.KubectlFilename} {
+		if _, err := os.Stat(host.Path(filepath.Join(constants.CacheDir, constants.KubeDirNameOf(version), name))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadCachedImages loads every image of the cache into the container runtime
+func LoadCachedImages(ctx context.Context, runtimeConfig apis.ContainerRuntimeConfiguration) error {
+	rt, err := containerruntime.New(runtimeConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	return loadAvailableImages(ctx, rt)
+}
+
+// UpgradeKubelet replaces the kubelet with the one of version from the cache,
+// rewrites its units and restarts it
+func UpgradeKubelet(ctx context.Context, version string, netConfig apis.Networking, kubeletConfig *kubeletconfigv1beta1.KubeletConfiguration, imageConfig apis.ImageConfiguration, runtimeConfig apis.ContainerRuntimeConfiguration) error {
+	rt, err := containerruntime.New(runtimeConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create container runtime: %v", err)
+	}
+	units, err := RenderKubeletUnits(version, netConfig, kubeletConfig, imageConfig, rt)
+	if err != nil {
+		return fmt.Errorf("unable to render kubelet units: %v", err)
+	}
+	if err := systemd.StopIfActive(ctx, constants.KubeletSystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to upgrade kubelet service: %v", err)
+	}
+	if err := InstallKubernetesBinaries(version, constants.KubeletFilename); err != nil {
+		return err
+	}
+	if err := units.Write(); err != nil {
+		return fmt.Errorf("unable to upgrade kubelet service: %v", err)
+	}
+	if err := systemd.Reload(ctx); err != nil {
+		return fmt.Errorf("unable to upgrade kubelet service: %v", err)
+	}
+	if err := systemd.EnableAndStartUnit(ctx, constants.KubeletSystemdUnitFilename); err != nil {
+		return fmt.Errorf("unable to upgrade kubelet service: %v", err)
+	}
+	return nil
+}